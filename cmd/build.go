@@ -12,6 +12,8 @@ import (
 )
 
 func NewBuildCommand() *cobra.Command {
+	var strict bool
+	var format string
 	var buildCmd = &cobra.Command{
 		Use:   "build <directory>",
 		Short: "Builds stored Kusto functions and tables into command scripts suitable for deployment.",
@@ -21,28 +23,53 @@ func NewBuildCommand() *cobra.Command {
 			into command scripts under the 'kout' directory relative to the current directory.
 	
 			To specify a subdirectory, simply pass the <directory> as an argument. 
+			If a 'ksd.yaml' is found in the current directory or a parent, its source root, output directory and
+			file extensions are used instead of the defaults.
 	
 			Build does the following:
-			- Parses comments that decorate a Kusto function or table declaration into documentation string that will show up in Azure Data Explorer.
-			- Transpiles table and function declarations into command-script syntax that can be executed to create or alter the function in a Azure Data Explorer database.
-			- Appends relative directory metadata to each function. Directory structure is mirrored in the database.`),
+			- Parses comments that decorate a Kusto function, table, materialized view or external table declaration into documentation string that will show up in Azure Data Explorer.
+			- Transpiles table, function, materialized view and external table declarations into command-script syntax that can be executed to create or alter the function in a Azure Data Explorer database.
+			- Appends relative directory metadata to each function, materialized view and external table. Directory structure is mirrored in the database.
+
+			Errors and warnings in all files are reported, each with the file, line and column of the problem.
+			Nothing is built if any file has errors. Pass '--strict' to treat warnings as errors.
+
+			Pass '--format sarif' to write the errors and warnings as a SARIF 2.1.0 log to stdout instead,
+			i.e. for code scanning in pull requests.`),
 		Example: heredoc.Doc(`
 			# Build functions and tables under current working directory
 			$ ksd build
 	
 			# Build functions and tables under the specified directory
 			$ ksd build <relative or absolute path>
+
+			# Fail the build on warnings, i.e. in CI
+			$ ksd build --strict
+
+			# Write errors and warnings for code scanning
+			$ ksd build --format sarif > ksd.sarif
 			`),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			root, err := os.Getwd()
+			if err := validateFormat(format); err != nil {
+				return err
+			}
+
+			wd, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+			config, err := ksd.FindConfig(wd)
 			if err != nil {
 				return err
 			}
+
+			// the directory argument overrides the source root of the config
+			root := config.SourceRoot(wd)
 			if len(args) == 1 {
 				if filepath.IsAbs(args[0]) {
 					root = args[0]
 				} else {
-					root = filepath.Join(root, args[0])
+					root = filepath.Join(wd, args[0])
 				}
 			}
 
@@ -58,14 +85,53 @@ func NewBuildCommand() *cobra.Command {
 				return err
 			}
 
-			outRoot := filepath.Join(root, ksd.OutDir)
+			outRoot := config.OutRoot(root)
 			if err := os.MkdirAll(outRoot, 0755); err != nil {
 				return err
 			}
 
-			return ksd.Build(root, outRoot)
+			opts := ksd.BuildOptions{Strict: strict, Extensions: config.SourceExtensions()}
+			return build(cmd, root, outRoot, opts, format)
 		},
 	}
+	buildCmd.Flags().BoolVar(&strict, "strict", false, "Treat warnings as errors")
+	buildCmd.Flags().StringVar(&format, "format", formatText, "The format of errors and warnings. Allowed values: text, sarif")
 
 	return buildCmd
 }
+
+// the formats of diagnostics
+const (
+	formatText  = "text"
+	formatSARIF = "sarif"
+)
+
+func validateFormat(format string) error {
+	if format != formatText && format != formatSARIF {
+		return fmt.Errorf("invalid value for `--format`: '%s'. Allowed values: text, sarif", format)
+	}
+	return nil
+}
+
+// writeDiagnostics writes the diagnostics of the source files under root in the format,
+// as text to stderr, or as a SARIF log to stdout.
+func writeDiagnostics(cmd *cobra.Command, diags ksd.Diagnostics, root string, format string) error {
+	if format == formatSARIF {
+		return diags.WriteSARIF(cmd.OutOrStdout(), root)
+	}
+	return diags.WriteText(cmd.ErrOrStderr())
+}
+
+// build builds the source files under root into outRoot, and writes the diagnostics in the format.
+func build(cmd *cobra.Command, root string, outRoot string, opts ksd.BuildOptions, format string) error {
+	diags, err := ksd.Build(root, outRoot, opts)
+	if writeErr := writeDiagnostics(cmd, diags, root, format); writeErr != nil {
+		return writeErr
+	}
+
+	// the errors are already written with their source lines
+	if count := diags.Count(ksd.SeverityError); count > 0 {
+		return fmt.Errorf("build failed with %d error(s)", count)
+	}
+	return err
+}
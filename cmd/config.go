@@ -2,41 +2,114 @@ package cmd
 
 import (
 	"errors"
+	"os"
 
+	"github.com/spf13/cobra"
 	"github.com/weikanglim/ksd/internal/ksd"
 )
 
-var clientId string
-var clientSecret string
-var credentialProvider string
-var tenantId string
-var endpoint string
+// connectionOptions are the flags of a command that connects to a database.
+type connectionOptions struct {
+	env                string
+	endpoint           string
+	clientId           string
+	clientSecret       string
+	tenantId           string
+	credentialProvider string
+}
+
+// The environment variables that set connection flags that are not passed.
+const (
+	envEnvironment        = "KSD_ENV"
+	envEndpoint           = "KSD_ENDPOINT"
+	envClientId           = "KSD_CLIENT_ID"
+	envClientSecret       = "KSD_CLIENT_SECRET"
+	envTenantId           = "KSD_TENANT_ID"
+	envCredentialProvider = "KSD_CREDENTIAL_PROVIDER"
+)
+
+// addFlags adds the connection flags to cmd.
+func (o *connectionOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&o.env, "env", "", "The environment in ksd.yaml to connect to")
+	cmd.Flags().StringVar(&o.endpoint, "endpoint", "", "The endpoint to the Azure Data Explorer database")
+	cmd.Flags().StringVar(&o.clientId, "client-id", "", "The ID of the application to authenticate with")
+	cmd.Flags().StringVar(&o.clientSecret, "client-secret", "", "The secret of the application to authenticate with")
+	cmd.Flags().StringVar(&o.tenantId, "tenant-id", "", "The tenant ID of the application to authenticate with")
+	cmd.Flags().StringVar(&o.credentialProvider, "credential-provider", "", "The credential provider to use instead of client-secret. Allowed values: github")
+}
+
+// resolve sets each connection flag that is not passed to cmd from its environment variable,
+// or else from the environment of the config selected by '--env'. An endpoint is required.
+func (o *connectionOptions) resolve(cmd *cobra.Command, config *ksd.Config) error {
+	if value := os.Getenv(envEnvironment); value != "" && !cmd.Flags().Changed("env") {
+		o.env = value
+	}
+
+	var environment ksd.Environment
+	if o.env != "" {
+		var err error
+		environment, err = config.Environment(o.env)
+		if err != nil {
+			return err
+		}
+	}
+
+	settings := []struct {
+		flag   string
+		envVar string
+		value  *string
+		// the value in the environment of the config. Secrets are never set in the config
+		config string
+	}{
+		{"endpoint", envEndpoint, &o.endpoint, environment.Endpoint},
+		{"client-id", envClientId, &o.clientId, environment.ClientId},
+		{"client-secret", envClientSecret, &o.clientSecret, ""},
+		{"tenant-id", envTenantId, &o.tenantId, environment.TenantId},
+		{"credential-provider", envCredentialProvider, &o.credentialProvider, environment.CredentialProvider},
+	}
+	for _, s := range settings {
+		if cmd.Flags().Changed(s.flag) {
+			continue
+		}
+		if value := os.Getenv(s.envVar); value != "" {
+			*s.value = value
+		} else if s.config != "" {
+			*s.value = s.config
+		}
+	}
+
+	if o.endpoint == "" {
+		return errors.New("missing `--endpoint`. Set this to a Azure Data Explorer database endpoint, i.e. https://samples.kusto.windows.net/MyDatabase, or select an environment of ksd.yaml with `--env`")
+	}
+	return nil
+}
 
-func GetCredentialOptionsFromFlags() (ksd.CredentialOptions, error) {
+// credentialOptions validates the credential flags and returns the options to authenticate with.
+func (o *connectionOptions) credentialOptions() (ksd.CredentialOptions, error) {
 	opts := ksd.CredentialOptions{}
-	if clientId != "" {
-		if tenantId == "" {
+	if o.clientId != "" {
+		if o.tenantId == "" {
 			return opts, errors.New("`--tenant-id` must be set when `--client-id` is provided")
 		}
 
-		if clientSecret == "" && credentialProvider == "" {
+		if o.clientSecret == "" && o.credentialProvider == "" {
 			return opts, errors.New("`--client-secret` or `--credential-provider` must be set when `--client-id` is provided")
 		}
 
-		opts.ClientId = clientId
-		opts.ClientSecret = clientSecret
-		opts.TenantId = tenantId
-		opts.CredentialProvider = credentialProvider
+		opts.ClientId = o.clientId
+		opts.ClientSecret = o.clientSecret
+		opts.TenantId = o.tenantId
+		opts.CredentialProvider = o.credentialProvider
 	} else {
-		if clientSecret != "" {
+		if o.clientSecret != "" {
 			return opts, errors.New("`--client-id` must be set when `--client-secret` is provided")
 		}
 
-		if credentialProvider != "" {
+		if o.credentialProvider != "" {
 			return opts, errors.New("`--client-id` must be set when `--credential-provider` is provided")
 		}
 
-		if tenantId != "" {
+		if o.tenantId != "" {
 			return opts, errors.New("`--client-id` must be set when `--tenant-id` is provided")
 		}
 	}
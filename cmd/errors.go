@@ -0,0 +1,11 @@
+package cmd
+
+// ExitCodeError is returned by commands that need to exit with a specific exit code.
+type ExitCodeError struct {
+	Code int
+	Msg  string
+}
+
+func (e *ExitCodeError) Error() string {
+	return e.Msg
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/spf13/cobra"
+	"github.com/weikanglim/ksd/internal/ksd"
+)
+
+// ExitCodeUnformatted is the exit code of 'fmt --check' when files are not formatted.
+const ExitCodeUnformatted = 1
+
+func NewFmtCommand() *cobra.Command {
+	var check bool
+	var fmtCmd = &cobra.Command{
+		Use:   "fmt <directory>",
+		Short: "Formats Kusto declaration files into a canonical layout.",
+		Args:  cobra.MaximumNArgs(1),
+		Long: heredoc.Doc(`
+			Fmt rewrites all Kusto declaration files under the current directory into a canonical layout,
+			and lists the files that were changed.
+
+			To specify a subdirectory, simply pass the <directory> as an argument.
+
+			The canonical layout:
+			- Separates declarations and comments with a single empty line, keeping each docstring block with its declaration.
+			- Spaces the 'let' header as 'let Name = '.
+			- Lists function parameters on one line, or one per line when the signature is long or has comments.
+			- Lists table columns one per line, and aligns the values of datatable rows.
+			- Indents each line of a body by its nesting, so that pipes line up.
+
+			Comments are kept, and formatting never changes what 'ksd build' produces other than whitespace.
+			Files with errors are reported and left unchanged.
+
+			Pass '--check' to list the files that are not formatted without rewriting them, i.e. in CI.`),
+		Example: heredoc.Doc(`
+			# Format files under current working directory
+			$ ksd fmt
+
+			# Fail if any file under the specified directory is not formatted
+			$ ksd fmt <relative or absolute path> --check
+			`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			wd, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+			config, err := ksd.FindConfig(wd)
+			if err != nil {
+				return err
+			}
+
+			// the directory argument overrides the source root of the config
+			root := config.SourceRoot(wd)
+			if len(args) == 1 {
+				if filepath.IsAbs(args[0]) {
+					root = args[0]
+				} else {
+					root = filepath.Join(wd, args[0])
+				}
+			}
+
+			_, err = os.Stat(root)
+			if errors.Is(err, os.ErrNotExist) {
+				displayDir := root
+				if len(args) > 0 {
+					displayDir = args[0]
+				}
+				return fmt.Errorf("directory %s does not exist", displayDir)
+			}
+			if err != nil {
+				return err
+			}
+
+			changed, diags, err := ksd.Format(root, ksd.FormatOptions{
+				Check:      check,
+				OutRoot:    config.OutRoot(root),
+				Extensions: config.SourceExtensions(),
+			})
+			if err != nil {
+				return err
+			}
+			if err := diags.WriteText(cmd.ErrOrStderr()); err != nil {
+				return err
+			}
+
+			for _, file := range changed {
+				fmt.Fprintln(cmd.OutOrStdout(), file)
+			}
+
+			if diags.Count(ksd.SeverityError) > 0 {
+				return fmt.Errorf("%d file(s) with errors were not formatted", countFiles(diags))
+			}
+
+			if check && len(changed) > 0 {
+				// the files are the output, avoid printing an error
+				cmd.SilenceErrors = true
+				return &ExitCodeError{
+					Code: ExitCodeUnformatted,
+					Msg:  "files not formatted",
+				}
+			}
+			return nil
+		},
+	}
+	fmtCmd.Flags().BoolVar(&check, "check", false, "List the files that are not formatted, without rewriting them")
+
+	return fmtCmd
+}
+
+// countFiles returns the number of files with errors.
+func countFiles(diags ksd.Diagnostics) int {
+	files := map[string]bool{}
+	for _, d := range diags {
+		if d.Severity == ksd.SeverityError {
+			files[d.File()] = true
+		}
+	}
+	return len(files)
+}
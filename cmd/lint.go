@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/spf13/cobra"
+	"github.com/weikanglim/ksd/internal/ksd"
+)
+
+func NewLintCommand() *cobra.Command {
+	var strict bool
+	var format string
+	var lintCmd = &cobra.Command{
+		Use:   "lint <directory>",
+		Short: "Checks Kusto declaration files for common problems.",
+		Args:  cobra.MaximumNArgs(1),
+		Long: heredoc.Docf(`
+			Lint checks all Kusto declaration files under the current directory against a set of rules,
+			and reports each problem with the file, line and column, and the name of the rule.
+
+			To specify a subdirectory, simply pass the <directory> as an argument.
+
+			Rules: %s.
+
+			Each rule is turned off, or set to report errors or warnings, in the 'lint' section of %s:
+
+			  lint:
+			    rules:
+			      pascal-case: "off"
+			      take-without-order: error
+
+			To ignore a problem, add '// ksd-ignore rule-name' after the code on its line, or on the line before it.
+
+			Lint fails if any problem is an error. Pass '--strict' to treat warnings as errors.
+
+			Pass '--format sarif' to write the problems as a SARIF 2.1.0 log to stdout instead,
+			i.e. for code scanning in pull requests.`,
+			strings.Join(ksd.LintRuleNames(), ", "), ksd.ConfigFile),
+		Example: heredoc.Doc(`
+			# Lint files under current working directory
+			$ ksd lint
+
+			# Fail on any problem under the specified directory, i.e. in CI
+			$ ksd lint <relative or absolute path> --strict
+
+			# Write problems for code scanning
+			$ ksd lint --format sarif > ksd.sarif
+			`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateFormat(format); err != nil {
+				return err
+			}
+
+			wd, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+			config, err := ksd.FindConfig(wd)
+			if err != nil {
+				return err
+			}
+
+			// the directory argument overrides the source root of the config
+			root := config.SourceRoot(wd)
+			if len(args) == 1 {
+				if filepath.IsAbs(args[0]) {
+					root = args[0]
+				} else {
+					root = filepath.Join(wd, args[0])
+				}
+			}
+
+			_, err = os.Stat(root)
+			if errors.Is(err, os.ErrNotExist) {
+				displayDir := root
+				if len(args) > 0 {
+					displayDir = args[0]
+				}
+				return fmt.Errorf("directory %s does not exist", displayDir)
+			}
+			if err != nil {
+				return err
+			}
+
+			diags, err := ksd.Lint(root, ksd.LintOptions{
+				Strict:     strict,
+				OutRoot:    config.OutRoot(root),
+				Extensions: config.SourceExtensions(),
+				Rules:      config.LintRules(),
+			})
+			if err != nil {
+				return err
+			}
+			if err := writeDiagnostics(cmd, diags, root, format); err != nil {
+				return err
+			}
+
+			if count := diags.Count(ksd.SeverityError); count > 0 {
+				return fmt.Errorf("lint failed with %d error(s)", count)
+			}
+			return nil
+		},
+	}
+	lintCmd.Flags().BoolVar(&strict, "strict", false, "Treat warnings as errors")
+	lintCmd.Flags().StringVar(&format, "format", formatText, "The format of problems. Allowed values: text, sarif")
+
+	return lintCmd
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/spf13/cobra"
+	"github.com/weikanglim/ksd/internal/ksd"
+)
+
+// The exit code of 'ksd plan' when changes are pending.
+const ExitCodeChangesPending = 2
+
+func NewPlanCommand() *cobra.Command {
+	var output string
+	var conn connectionOptions
+	var planCmd = &cobra.Command{
+		Use:   "plan <directory>",
+		Short: "Shows the changes that sync would make to a targeted Azure Data Explorer database",
+		Args:  cobra.MaximumNArgs(1),
+		Long: heredoc.Doc(`
+		plan parses Kusto function and table declarations the same way 'ksd build' does,
+		and compares them against the functions and tables in the target Kusto database.
+
+		Each declaration is reported as either created, altered, or unchanged by a sync.
+		Functions and tables that exist only in the database are also reported.
+		Function bodies are compared ignoring whitespace.
+
+		plan exits with code 2 when a sync would create or alter any function or table,
+		and 0 when there are no pending changes.`),
+		Example: heredoc.Doc(`
+		# Show pending changes for files under current directory
+		$ ksd plan --endpoint https://<cluster>.kusto.windows.net/<database>
+
+		# Show pending changes as JSON
+		$ ksd plan --endpoint https://<cluster>.kusto.windows.net/<database> --output json
+		`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			wd, err := os.Getwd()
+			if err != nil {
+				return fmt.Errorf("getting cwd: %w", err)
+			}
+			config, err := ksd.FindConfig(wd)
+			if err != nil {
+				return err
+			}
+
+			// the directory argument overrides the source root of the config
+			root := config.SourceRoot(wd)
+			if len(args) > 0 {
+				if filepath.IsAbs(args[0]) {
+					root = args[0]
+				} else {
+					root = filepath.Join(wd, args[0])
+				}
+			}
+
+			_, err = os.Stat(root)
+			if errors.Is(err, os.ErrNotExist) {
+				displayDir := root
+				if len(args) > 0 {
+					displayDir = args[0]
+				}
+				return fmt.Errorf("directory %s does not exist", displayDir)
+			}
+			if err != nil {
+				return err
+			}
+
+			if output != "text" && output != "json" {
+				return fmt.Errorf("invalid value for `--output`: '%s'. Allowed values: text, json", output)
+			}
+
+			if err := conn.resolve(cmd, config); err != nil {
+				return err
+			}
+
+			credOptions, err := conn.credentialOptions()
+			if err != nil {
+				return err
+			}
+
+			plan, err := ksd.ComputePlan(
+				root,
+				conn.endpoint,
+				credOptions,
+				http.DefaultClient,
+				ksd.PlanOptions{OutRoot: config.OutRoot(root), Extensions: config.SourceExtensions()})
+			if err != nil {
+				return err
+			}
+
+			if output == "json" {
+				err = plan.WriteJSON(cmd.OutOrStdout())
+			} else {
+				err = plan.WriteText(cmd.OutOrStdout())
+			}
+			if err != nil {
+				return err
+			}
+
+			if plan.Pending() {
+				// the plan itself is the output, avoid printing an error
+				cmd.SilenceErrors = true
+				return &ExitCodeError{
+					Code: ExitCodeChangesPending,
+					Msg:  "changes pending",
+				}
+			}
+
+			return nil
+		},
+	}
+	planCmd.Flags().StringVarP(&output, "output", "o", "text", "The output format. Allowed values: text, json")
+	// Connection flags
+	conn.addFlags(planCmd)
+
+	return planCmd
+}
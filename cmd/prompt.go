@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/weikanglim/ksd/internal/ksd"
+)
+
+// confirmPrune returns a confirmation prompt for dropping entities.
+//
+// Dropping functions requires a 'y' answer. Dropping tables requires
+// the name of the database to be typed, since tables contain data.
+func confirmPrune(in io.Reader, out io.Writer) ksd.PruneConfirmFunc {
+	reader := bufio.NewReader(in)
+	return func(db string, kind string, names []string) (bool, error) {
+		fmt.Fprintf(out, "The following %ss in database %s are not declared in source, and will be dropped:\n", kind, db)
+		for _, name := range names {
+			fmt.Fprintf(out, "  - %s\n", name)
+		}
+
+		if kind == "table" {
+			fmt.Fprintf(out, "Dropping a table deletes all of its data. Type the database name '%s' to confirm: ", db)
+			answer, err := readAnswer(reader)
+			if err != nil {
+				return false, err
+			}
+			return answer == db, nil
+		}
+
+		fmt.Fprintf(out, "Drop %d %s(s)? [y/N]: ", len(names), kind)
+		answer, err := readAnswer(reader)
+		if err != nil {
+			return false, err
+		}
+		answer = strings.ToLower(answer)
+		return answer == "y" || answer == "yes", nil
+	}
+}
+
+func readAnswer(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if errors.Is(err, io.EOF) && line == "" {
+		return "", errors.New("confirmation required. Pass `--yes` to confirm when running non-interactively")
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("reading confirmation: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/MakeNowJust/heredoc/v2"
 	"github.com/spf13/cobra"
+	"github.com/weikanglim/ksd/internal/ksd"
 )
 
 func NewRootCmd() *cobra.Command {
@@ -16,6 +17,7 @@ func NewRootCmd() *cobra.Command {
 
 	root := &cobra.Command{
 		Use:          "ksd",
+		Version:      ksd.Version,
 		SilenceUsage: true,
 		Short:        "ksd hlpes simplifies and accelerates development for Kusto.",
 		Example: heredoc.Doc(`
@@ -25,6 +27,9 @@ func NewRootCmd() *cobra.Command {
 		# sync files under src/kusto directory
 		$ ksd sync src/kusto --endpoint https://<cluster>.kusto.windows.net/<database>
 
+		# preview changes that sync would make
+		$ ksd plan --endpoint https://<cluster>.kusto.windows.net/<database>
+
 		# Sync files in CI (app credential).
 		$ ksd sync --endpoint https://<cluster>.kusto.windows.net/<database> --client-id <clientId> --client-secret <clientSecret> --tenantId <tenantId>
 		`),
@@ -38,7 +43,10 @@ func NewRootCmd() *cobra.Command {
 	root.Flags().BoolVar(&debug, "debug", false, "Enable debug logging")
 
 	root.AddCommand(NewBuildCommand())
+	root.AddCommand(NewFmtCommand())
+	root.AddCommand(NewLintCommand())
 	root.AddCommand(NewSyncCommand())
+	root.AddCommand(NewPlanCommand())
 	root.AddCommand(NewRunCmd())
 
 	return root
@@ -13,6 +13,7 @@ import (
 
 func NewRunCmd() *cobra.Command {
 	var script string
+	var conn connectionOptions
 
 	var runCmd = &cobra.Command{
 		Use:   "run <file>",
@@ -26,12 +27,20 @@ func NewRunCmd() *cobra.Command {
 			$ ksd run ./script.ksl --endpoint https://<cluster>.kusto.windows.net/<database> 
 			`),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if endpoint == "" {
-				return errors.New("missing `--endpoint`. Set this to a Azure Data Explorer database endpoint, i.e. https://samples.kusto.windows.net/MyDatabase")
+			wd, err := os.Getwd()
+			if err != nil {
+				return fmt.Errorf("getting cwd: %w", err)
+			}
+			config, err := ksd.FindConfig(wd)
+			if err != nil {
+				return err
+			}
+			if err := conn.resolve(cmd, config); err != nil {
+				return err
 			}
 
 			file := args[0]
-			_, err := os.Stat(file)
+			_, err = os.Stat(file)
 			if errors.Is(err, os.ErrNotExist) {
 				return fmt.Errorf("script file %s does not exist", file)
 			}
@@ -39,23 +48,19 @@ func NewRunCmd() *cobra.Command {
 				return fmt.Errorf("reading %s: %w", file, err)
 			}
 
-			credOptions, err := GetCredentialOptionsFromFlags()
+			credOptions, err := conn.credentialOptions()
 			if err != nil {
 				return err
 			}
 
-			return ksd.Run(file, endpoint, credOptions, http.DefaultClient)
+			return ksd.Run(file, conn.endpoint, credOptions, http.DefaultClient)
 		},
 	}
 
 	runCmd.Flags().StringVar(&script, "script", "", "The script file to run.")
 
 	// Connection flags
-	runCmd.Flags().StringVar(&endpoint, "endpoint", "", "The endpoint to the Azure Data Explorer database")
-	runCmd.Flags().StringVar(&clientId, "client-id", "", "The ID of the application to authenticate with")
-	runCmd.Flags().StringVar(&clientSecret, "client-secret", "", "The secret of the application to authenticate with")
-	runCmd.Flags().StringVar(&tenantId, "tenant-id", "", "The tenant ID of the application to authenticate with")
-	runCmd.Flags().StringVar(&credentialProvider, "credential-provider", "", "The credential provider to use instead of client-secret. Allowed values: github")
+	conn.addFlags(runCmd)
 
 	return runCmd
 }
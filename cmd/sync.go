@@ -15,6 +15,20 @@ import (
 
 func NewSyncCommand() *cobra.Command {
 	var fromOut string
+	var pruneFunctions bool
+	var pruneTables bool
+	var pruneFolders []string
+	var pruneNames []string
+	var yes bool
+	var strict bool
+	var batch bool
+	var continueOnErrors bool
+	var parallelism int
+	var track bool
+	var incremental bool
+	var overwrite bool
+	var force bool
+	var conn connectionOptions
 	var syncCmd = &cobra.Command{
 		Use:   "sync <directory>",
 		Short: "Syncs Kusto function and table declarations to a targeted Azure Data Explorer database",
@@ -24,7 +38,37 @@ func NewSyncCommand() *cobra.Command {
 		To skip this behavior, pass the '--from-out' flag specifying the output directory that is already built.
 
 		The command scripts, located in the 'kout' directory (which contain Kusto Management Commands) are loaded and executed against the target Kusto database.
-		Thus, sync ends up syncing functions and tables declaration stored locally to the database.`),
+		Thus, sync ends up syncing functions and tables declaration stored locally to the database.
+		Declarations are synced after the functions and tables they reference. If a declaration fails to sync,
+		the declarations that reference it are skipped.
+
+		Pass '--prune' to drop functions in the database that are no longer declared in source.
+		Pass '--prune-tables' to also drop tables that are no longer declared. Dropping a table deletes its data.
+		Only functions and tables owned by the project are dropped. By default, the project owns the top-level folders
+		of its declarations. Use '--prune-folder' and '--prune-name' to specify the owned folders and name patterns instead.
+		Dropping requires confirmation, unless '--yes' is passed.
+
+		Pass '--batch' to execute all commands in a single '.execute database script', instead of a request per command.
+		The script stops at the first failed command, and the declarations after it are skipped.
+		Commands that completed before the failure are not rolled back.
+		Pass '--continue-on-errors' to execute the remaining commands after a failure instead. The declarations are then
+		synced in a script per level of references, so that the declarations that reference a failed one are skipped.
+
+		Pass '--parallelism' to sync up to that many declarations at the same time, instead of one at a time.
+		A declaration is still synced after the declarations it references, and results are printed in the same order.
+		When the database throttles requests, sync waits and retries them.
+
+		Pass '--track' to create the 'KsdSyncState' table of the database. Once it exists, every sync records
+		what it deployed for each declaration in it: the hash of its commands, its definition in the database,
+		and the version of ksd. Before syncing a declaration, sync checks that its definition in the database
+		still matches the recorded one. If it was changed outside of ksd, i.e. in the Azure Data Explorer portal,
+		sync refuses to overwrite it, and shows both definitions. Pass '--overwrite' to overwrite such changes.
+
+		Pass '--incremental' to only sync declarations whose command scripts changed since they were last synced.
+		An incremental sync also creates the 'KsdSyncState' table. Pass '--force' to sync all declarations.
+
+		Pass '--env' to connect to an environment defined in the 'ksd.yaml' of the project.
+		Flags, and then KSD_* environment variables, override the settings of the environment.`),
 		Example: heredoc.Doc(`
 		# Sync either using 'az' login credentials, or an interactive login
 		$ ksd sync --endpoint https://<cluster>.kusto.windows.net/<database>
@@ -34,18 +78,42 @@ func NewSyncCommand() *cobra.Command {
 
 		# Sync using GitHub OIDC credentials. Recommended for CI workflows.
 		$ ksd sync --endpoint https://<cluster>.kusto.windows.net/<database> --client-id <clientId> --credential-provider github --tenantId <tenantId>
+
+		# Sync, and drop functions under the 'functions' folder that are no longer declared in source
+		$ ksd sync --endpoint https://<cluster>.kusto.windows.net/<database> --prune --prune-folder functions
+
+		# Sync all declarations in a single request
+		$ ksd sync --endpoint https://<cluster>.kusto.windows.net/<database> --batch
+
+		# Sync up to 8 declarations at the same time
+		$ ksd sync --endpoint https://<cluster>.kusto.windows.net/<database> --parallelism 8
+
+		# Record what is synced, and refuse to overwrite declarations changed outside of ksd from now on
+		$ ksd sync --endpoint https://<cluster>.kusto.windows.net/<database> --track
+
+		# Sync only the declarations that changed since the last sync
+		$ ksd sync --endpoint https://<cluster>.kusto.windows.net/<database> --incremental
+
+		# Sync to the 'prod' environment defined in ksd.yaml
+		$ ksd sync --env prod
 		`),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			root, err := os.Getwd()
+			wd, err := os.Getwd()
 			if err != nil {
 				return fmt.Errorf("getting cwd: %w", err)
 			}
+			config, err := ksd.FindConfig(wd)
+			if err != nil {
+				return err
+			}
 
+			// the directory argument overrides the source root of the config
+			root := config.SourceRoot(wd)
 			if len(args) > 0 {
 				if filepath.IsAbs(args[0]) {
 					root = args[0]
 				} else {
-					root = filepath.Join(root, args[0])
+					root = filepath.Join(wd, args[0])
 				}
 			}
 
@@ -61,15 +129,56 @@ func NewSyncCommand() *cobra.Command {
 				return err
 			}
 
-			if endpoint == "" {
-				return errors.New("missing `--endpoint`. Set this to a Azure Data Explorer database endpoint, i.e. https://samples.kusto.windows.net/MyDatabase")
+			if err := conn.resolve(cmd, config); err != nil {
+				return err
 			}
 
-			credOptions, err := GetCredentialOptionsFromFlags()
+			credOptions, err := conn.credentialOptions()
 			if err != nil {
 				return err
 			}
 
+			if !pruneFunctions && !pruneTables {
+				if len(pruneFolders) > 0 {
+					return errors.New("`--prune` or `--prune-tables` must be set when `--prune-folder` is provided")
+				}
+
+				if len(pruneNames) > 0 {
+					return errors.New("`--prune` or `--prune-tables` must be set when `--prune-name` is provided")
+				}
+			}
+
+			if continueOnErrors && !batch {
+				return errors.New("`--batch` must be set when `--continue-on-errors` is provided")
+			}
+
+			if parallelism < 1 {
+				return fmt.Errorf("invalid value for `--parallelism`: %d. It must be at least 1", parallelism)
+			}
+
+			if batch && parallelism > 1 {
+				return errors.New("`--parallelism` cannot be set when `--batch` is provided")
+			}
+
+			syncOptions := ksd.SyncOptions{
+				Prune: ksd.PruneOptions{
+					Functions: pruneFunctions,
+					Tables:    pruneTables,
+					Folders:   pruneFolders,
+					Names:     pruneNames,
+				},
+				Batch:            batch,
+				ContinueOnErrors: continueOnErrors,
+				Parallelism:      parallelism,
+				Track:            track,
+				Incremental:      incremental,
+				Overwrite:        overwrite,
+				Force:            force,
+			}
+			if !yes {
+				syncOptions.Prune.Confirm = confirmPrune(cmd.InOrStdin(), cmd.OutOrStdout())
+			}
+
 			var outRoot string
 			if fromOut != "" {
 				// from-out specified, skip build
@@ -79,7 +188,7 @@ func NewSyncCommand() *cobra.Command {
 					outRoot = filepath.Join(root, fromOut)
 				}
 
-				if !strings.HasSuffix(outRoot, ksd.OutDir) {
+				if !strings.HasSuffix(outRoot, ksd.OutDir) && outRoot != config.OutRoot(root) {
 					return fmt.Errorf(
 						"%s is an invalid out directory path. out directories are expected to be named '%s'",
 						fromOut,
@@ -87,14 +196,15 @@ func NewSyncCommand() *cobra.Command {
 				}
 			} else {
 				// default mode, build to out folder
-				outRoot = filepath.Join(root, ksd.OutDir)
+				outRoot = config.OutRoot(root)
 
 				if err := os.MkdirAll(outRoot, 0755); err != nil {
 					return err
 				}
 
 				fmt.Println("Building files...")
-				err = ksd.Build(root, outRoot)
+				opts := ksd.BuildOptions{Strict: strict, Extensions: config.SourceExtensions()}
+				err = build(cmd, root, outRoot, opts, formatText)
 				if err != nil {
 					return err
 				}
@@ -103,18 +213,31 @@ func NewSyncCommand() *cobra.Command {
 			fmt.Println("Syncing files...")
 			return ksd.Sync(
 				outRoot,
-				endpoint,
+				conn.endpoint,
 				credOptions,
-				http.DefaultClient)
+				http.DefaultClient,
+				syncOptions)
 		},
 	}
 	syncCmd.Flags().StringVar(&fromOut, "from-out", "", "The output directory that contains command files to sync.")
+	// Prune flags
+	syncCmd.Flags().BoolVar(&pruneFunctions, "prune", false, "Drop functions in the database that are no longer declared in source")
+	syncCmd.Flags().BoolVar(&pruneTables, "prune-tables", false, "Drop tables in the database that are no longer declared in source. This deletes the data in the tables")
+	syncCmd.Flags().StringSliceVar(&pruneFolders, "prune-folder", nil, "Limit pruning to entities in the folder, including subfolders. Can be repeated")
+	syncCmd.Flags().StringSliceVar(&pruneNames, "prune-name", nil, "Limit pruning to entities with names matching the pattern, i.e. 'Legacy*'. Can be repeated")
+	syncCmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation when dropping entities")
+	syncCmd.Flags().BoolVar(&strict, "strict", false, "Treat build warnings as errors")
+	// Batch flags
+	syncCmd.Flags().BoolVar(&batch, "batch", false, "Execute all commands in a single '.execute database script'")
+	syncCmd.Flags().BoolVar(&continueOnErrors, "continue-on-errors", false, "Continue the batch script after a command fails")
+	syncCmd.Flags().IntVar(&parallelism, "parallelism", 1, "The maximum number of declarations to sync at the same time")
+	// State flags
+	syncCmd.Flags().BoolVar(&track, "track", false, "Record what sync deploys in the KsdSyncState table of the database, creating it if needed")
+	syncCmd.Flags().BoolVar(&incremental, "incremental", false, "Only sync declarations that changed since they were last synced")
+	syncCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Overwrite declarations changed outside of ksd since they were last synced")
+	syncCmd.Flags().BoolVar(&force, "force", false, "Sync declarations that did not change since they were last synced, and append their rows again")
 	// Connection flags
-	syncCmd.Flags().StringVar(&endpoint, "endpoint", "", "The endpoint to the Azure Data Explorer database")
-	syncCmd.Flags().StringVar(&clientId, "client-id", "", "The ID of the application to authenticate with")
-	syncCmd.Flags().StringVar(&clientSecret, "client-secret", "", "The secret of the application to authenticate with")
-	syncCmd.Flags().StringVar(&tenantId, "tenant-id", "", "The tenant ID of the application to authenticate with")
-	syncCmd.Flags().StringVar(&credentialProvider, "credential-provider", "", "The credential provider to use instead of client-secret. Allowed values: github")
+	conn.addFlags(syncCmd)
 
 	return syncCmd
 }
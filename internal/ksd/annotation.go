@@ -0,0 +1,125 @@
+package ksd
+
+import "strings"
+
+// annotation is a '// @name value' line in the comment block that precedes a declaration.
+//
+// Annotations configure how a declaration is synced, and are not part of the docstring.
+type annotation struct {
+	name  string
+	value string
+
+	// position of the '@'
+	row int
+	col int
+}
+
+// annotationFunc applies the annotation to the declaration.
+type annotationFunc func(decl *declaration, a annotation) error
+
+// declAnnotations are the annotations supported by each type of declaration.
+var declAnnotations = map[declType]map[string]annotationFunc{
+	functionType: {
+		"view":           applyViewAnnotation,
+		"skipvalidation": applySkipValidationAnnotation,
+		"folder":         applyFolderAnnotation,
+	},
+	tableType: {
+		"data":                     applyDataAnnotation,
+		"updatePolicy":             applyUpdatePolicyAnnotation,
+		"retentionPolicy":          applyPolicyAnnotation(retentionPolicy),
+		"cachingPolicy":            applyPolicyAnnotation(cachingPolicy),
+		"partitioningPolicy":       applyPolicyAnnotation(partitioningPolicy),
+		"mergePolicy":              applyPolicyAnnotation(mergePolicy),
+		"ingestionBatchingPolicy":  applyPolicyAnnotation(ingestionBatchingPolicy),
+		"streamingIngestionPolicy": applyPolicyAnnotation(streamingIngestionPolicy),
+		"rowOrderPolicy":           applyPolicyAnnotation(rowOrderPolicy),
+	},
+	materializedViewType: {
+		"backfill":          applyBackfillAnnotation,
+		"effectiveDateTime": applyEffectiveDateTimeAnnotation,
+		"lookback":          applyLookbackAnnotation,
+		"dimensionTables":   applyDimensionTablesAnnotation,
+	},
+	externalTableType: {
+		"kind":           applyKindAnnotation,
+		"dataFormat":     applyDataFormatAnnotation,
+		"connection":     applyConnectionAnnotation,
+		"partitionBy":    applyPartitionByAnnotation,
+		"pathFormat":     applyPathFormatAnnotation,
+		"fileExtension":  applyFileExtensionAnnotation,
+		"includeHeaders": applyIncludeHeadersAnnotation,
+		"sqlTable":       applySqlTableAnnotation,
+	},
+	continuousExportType: {
+		"intervalBetweenRuns": applyIntervalBetweenRunsAnnotation,
+		"forcedLatency":       applyForcedLatencyAnnotation,
+		"sizeLimit":           applySizeLimitAnnotation,
+		"distributed":         applyDistributedAnnotation,
+		"over":                applyOverAnnotation,
+	},
+}
+
+// declChecks verify that the annotations of a declaration are complete, after all its annotations are applied.
+var declChecks = map[declType]func(decl *declaration) error{
+	externalTableType:    checkExternalTable,
+	continuousExportType: checkContinuousExport,
+}
+
+// repeatableAnnotations are the annotations that may be declared more than once on a declaration.
+var repeatableAnnotations = map[string]bool{
+	"updatePolicy": true,
+	"connection":   true,
+}
+
+// parseAnnotation parses the comment line as an annotation,
+// returning false if the line is not an annotation.
+func parseAnnotation(line string, row int) (annotation, bool) {
+	text := strings.TrimSpace(strings.TrimPrefix(line, "//"))
+	if !strings.HasPrefix(text, "@") {
+		return annotation{}, false
+	}
+
+	name, value, _ := strings.Cut(text[1:], " ")
+	return annotation{
+		name:  name,
+		value: strings.TrimSpace(value),
+		row:   row,
+		col:   strings.Index(line, "@") + 1,
+	}, true
+}
+
+// applyAnnotations applies the annotations of the declaration.
+func applyAnnotations(decl *declaration) error {
+	seen := map[string]bool{}
+	for _, a := range decl.annotations {
+		apply, ok := declAnnotations[decl.declType][a.name]
+		if !ok {
+			return newParseError(a.row, a.col, "unknown annotation '@%s' for %s declaration", a.name, decl.declType)
+		}
+
+		if seen[a.name] && !repeatableAnnotations[a.name] {
+			return newParseError(a.row, a.col, "duplicate annotation '@%s'", a.name)
+		}
+		seen[a.name] = true
+
+		if err := apply(decl, a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// boolAnnotation parses the value of a flag annotation, i.e. '// @name' or '// @name true|false'.
+func boolAnnotation(a annotation) (bool, error) {
+	switch a.value {
+	case "", "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, newParseError(
+			a.row, a.col, "invalid value '%s' for '@%s'. Allowed values: true, false", a.value, a.name)
+	}
+}
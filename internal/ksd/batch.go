@@ -0,0 +1,253 @@
+package ksd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+)
+
+// scriptResult is the result of a command, as returned by '.execute database script'.
+// The results are in the order of the commands in the script.
+type scriptResult struct {
+	// Completed, Failed or Skipped
+	Result string
+	// the reason the command failed
+	Reason string
+}
+
+// the results of a command in '.execute database script'
+const (
+	scriptCompleted = "Completed"
+	scriptSkipped   = "Skipped"
+)
+
+// batchScript returns the '.execute database script' command that executes the commands in order.
+func batchScript(cmds []string, continueOnErrors bool) string {
+	var b strings.Builder
+	b.WriteString(".execute database script ")
+	if continueOnErrors {
+		b.WriteString("with (ContinueOnErrors=true) ")
+	}
+	b.WriteString("<|\n")
+	b.WriteString(strings.Join(cmds, "\n\n"))
+	return b.String()
+}
+
+// batchEntity is an entity synced in a batch.
+type batchEntity struct {
+	e manifestEntity
+	// the range of the commands of the entity in the script
+	start int
+	end   int
+}
+
+// outcome returns the error of the entity, as reported by the results of the script.
+// An entity succeeds if all its commands completed. A command without a result was not executed.
+func (b batchEntity) outcome(results []scriptResult) error {
+	for i := b.start; i < b.end; i++ {
+		if i >= len(results) || results[i].Result == scriptSkipped {
+			return errNotExecuted
+		}
+		if r := results[i]; r.Result != scriptCompleted {
+			if r.Reason == "" {
+				return fmt.Errorf("command result: %s", r.Result)
+			}
+			return errors.New(r.Reason)
+		}
+	}
+	return nil
+}
+
+// errNotExecuted is the outcome of an entity whose commands were not executed, as the script stopped
+// at a failed command.
+var errNotExecuted = errors.New("not executed, as the script stopped at a failed command")
+
+// syncBatch syncs the entities in the manifest of the output directory root in a single
+// '.execute database script', and reports the outcome of each entity from the results of the script.
+// An error is returned if syncing cannot continue.
+//
+// Commands are executed in dependency order. Unless continueOnErrors is true, the script stops at the first
+// failed command, and the entities after it are skipped. Commands executed before a failed command are not
+// rolled back.
+//
+// If continueOnErrors is true, the entities are instead synced in a script per level of dependencies,
+// as returned by batchLevels, so that the entities that depend on an entity that failed are skipped.
+//
+// A continuous export whose query drifted from source is synced after the script, a command at a time,
+// since it is only replaced if altering it is rejected.
+func syncBatch(
+	ctx context.Context,
+	client kustoClient,
+	db string,
+	root string,
+	m *manifest,
+	continueOnErrors bool) (*syncResult, error) {
+	s := &syncer{client: client, db: db, root: root, throttle: newThrottle()}
+	failed := map[string]bool{}
+	result := &syncResult{errs: []error{}}
+
+	scripts := [][]manifestEntity{m.Entities}
+	if continueOnErrors {
+		scripts = batchLevels(m)
+	}
+	for _, entities := range scripts {
+		cmds := []string{}
+		secrets := []string{}
+		batch := []batchEntity{}
+		drifted := []manifestEntity{}
+		for _, e := range entities {
+			rel := filepath.FromSlash(e.File)
+			if dep := failedDependency(e, failed); dep != "" {
+				skipDependent(e, dep, failed, result)
+				continue
+			}
+
+			entityCmds, err := readCommands(root, e)
+			if err != nil {
+				return nil, err
+			}
+
+			if e.Kind == declType(continuousExportType).String() {
+				exports, err := s.continuousExports(ctx)
+				if err != nil {
+					return nil, err
+				}
+				if exportDrifted(exports, e.Name, entityCmds[0]) {
+					drifted = append(drifted, e)
+					continue
+				}
+			}
+
+			prepared := make([]string, 0, len(entityCmds))
+			for _, cmd := range entityCmds {
+				var cmdSecrets []string
+				cmd, cmdSecrets, err = prepareCommand(e, cmd, db)
+				if err != nil {
+					break
+				}
+				prepared = append(prepared, cmd)
+				secrets = append(secrets, cmdSecrets...)
+			}
+			if err != nil {
+				failed[e.Name] = true
+				result.errs = append(result.errs, fmt.Errorf("syncing %s %s in file %s: %w", e.Kind, e.Name, rel, err))
+				continue
+			}
+
+			b := batchEntity{e: e, start: len(cmds)}
+			cmds = append(cmds, prepared...)
+			b.end = len(cmds)
+			batch = append(batch, b)
+		}
+
+		if len(cmds) > 0 {
+			executeScript(ctx, client, db, batchScript(cmds, continueOnErrors), batch, secrets, failed, result)
+		}
+
+		for _, e := range drifted {
+			if dep := failedDependency(e, failed); dep != "" {
+				skipDependent(e, dep, failed, result)
+				continue
+			}
+
+			outcome := s.syncEntity(ctx, e)
+			if outcome.fatal != nil {
+				return nil, outcome.fatal
+			}
+			if outcome.err != nil {
+				failed[e.Name] = true
+				result.errs = append(result.errs, outcome.err)
+				continue
+			}
+			fmt.Println(outcome.msg)
+			result.synced = append(result.synced, e)
+		}
+	}
+	return result, nil
+}
+
+// executeScript executes the script of the entities in batch, and records the outcome of each entity in result.
+// The entities that failed are added to failed. secrets are redacted from the errors.
+func executeScript(
+	ctx context.Context,
+	client kustoClient,
+	db string,
+	script string,
+	batch []batchEntity,
+	secrets []string,
+	failed map[string]bool,
+	result *syncResult) {
+	results := []scriptResult{}
+	err := mgmtRows(ctx, client, db, script, func(row *table.Row) error {
+		res := scriptResult{}
+		if err := row.ToStruct(&res); err != nil {
+			return err
+		}
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		// the script failed as a whole, and so did each entity in it
+		err = redactSecrets(err, secrets)
+		for _, b := range batch {
+			failed[b.e.Name] = true
+			result.errs = append(result.errs, fmt.Errorf(
+				"syncing %s %s in file %s: %w", b.e.Kind, b.e.Name, filepath.FromSlash(b.e.File), err))
+		}
+		return
+	}
+
+	for _, b := range batch {
+		rel := filepath.FromSlash(b.e.File)
+		err := b.outcome(results)
+		if err != nil {
+			failed[b.e.Name] = true
+		}
+		switch {
+		case errors.Is(err, errNotExecuted):
+			fmt.Printf("Skipped %s %s in %s: %v\n", b.e.Kind, b.e.Name, rel, err)
+			result.errs = append(result.errs, fmt.Errorf("skipped %s %s in file %s: %w", b.e.Kind, b.e.Name, rel, err))
+		case err != nil:
+			err = redactSecrets(err, secrets)
+			result.errs = append(result.errs, fmt.Errorf("syncing %s %s in file %s: %w", b.e.Kind, b.e.Name, rel, err))
+		default:
+			fmt.Printf("Synced %s %s in %s\n", b.e.Kind, b.e.Name, rel)
+			result.synced = append(result.synced, b.e)
+		}
+	}
+}
+
+// skipDependent skips the entity e, as dep, an entity it depends on, failed to sync.
+func skipDependent(e manifestEntity, dep string, failed map[string]bool, result *syncResult) {
+	rel := filepath.FromSlash(e.File)
+	failed[e.Name] = true
+	fmt.Printf("Skipped %s %s in %s: depends on %s, which failed to sync\n", e.Kind, e.Name, rel, dep)
+	result.errs = append(result.errs, fmt.Errorf(
+		"skipped %s %s in file %s: depends on %s, which failed to sync", e.Kind, e.Name, rel, dep))
+}
+
+// batchLevels returns the entities in the manifest by level of dependencies, in the order of the manifest.
+// An entity is in the level after the last level of the entities in the manifest that it depends on,
+// so that the entities of a level only depend on the entities of the levels before it.
+func batchLevels(m *manifest) [][]manifestEntity {
+	level := map[string]int{}
+	levels := [][]manifestEntity{}
+	for _, e := range m.Entities {
+		l := 0
+		for _, dep := range e.DependsOn {
+			if depLevel, has := level[dep]; has && depLevel+1 > l {
+				l = depLevel + 1
+			}
+		}
+		level[e.Name] = l
+		if l == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[l] = append(levels[l], e)
+	}
+	return levels
+}
@@ -0,0 +1,69 @@
+package ksd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_batchScript(t *testing.T) {
+	cmds := []string{".create-or-alter function F() {\n    T\n}", ".create-merge table T (a:int)"}
+	assert.Equal(t,
+		".execute database script <|\n.create-or-alter function F() {\n    T\n}\n\n.create-merge table T (a:int)",
+		batchScript(cmds, false))
+	assert.Equal(t,
+		".execute database script with (ContinueOnErrors=true) <|\n.create-merge table T (a:int)",
+		batchScript(cmds[1:], true))
+}
+
+func Test_batchEntity_outcome(t *testing.T) {
+	results := []scriptResult{
+		{Result: "Completed"},
+		{Result: "Completed"},
+		{Result: "Failed", Reason: "Semantic error: 'X' could not be resolved"},
+		{Result: "Completed"},
+		{Result: "Skipped"},
+		{Result: "Failed"},
+	}
+	tests := []struct {
+		name       string
+		start, end int
+		expected   string
+	}{
+		{"completed", 0, 2, ""},
+		{"failed", 1, 4, "Semantic error: 'X' could not be resolved"},
+		{"skipped", 4, 5, errNotExecuted.Error()},
+		{"failedWithoutReason", 5, 6, "command result: Failed"},
+		{"missing", 5, 7, "command result: Failed"},
+		{"notExecuted", 6, 8, errNotExecuted.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := batchEntity{start: tt.start, end: tt.end}.outcome(results)
+			if tt.expected == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.expected)
+			}
+		})
+	}
+}
+
+func Test_batchLevels(t *testing.T) {
+	m := &manifest{Entities: []manifestEntity{
+		{Name: "T"},
+		{Name: "U"},
+		{Name: "A", DependsOn: []string{"T", "External"}},
+		{Name: "B", DependsOn: []string{"A", "U"}},
+		{Name: "C", DependsOn: []string{"U"}},
+	}}
+	names := [][]string{}
+	for _, level := range batchLevels(m) {
+		levelNames := []string{}
+		for _, e := range level {
+			levelNames = append(levelNames, e.Name)
+		}
+		names = append(names, levelNames)
+	}
+	assert.Equal(t, [][]string{{"T", "U"}, {"A", "C"}, {"B"}}, names)
+}
@@ -1,12 +1,14 @@
 package ksd
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
 )
 
 // The default name of the output directory
@@ -16,20 +18,124 @@ func IsKustoSourceFile(ext string) bool {
 	return ext == ".kql" || ext == ".csl" || ext == ".kusto"
 }
 
+// isSourceFile returns true if a file with the extension ext is a Kusto source file.
+// extensions are the extensions of source files, or nil for the extensions of IsKustoSourceFile.
+func isSourceFile(ext string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return IsKustoSourceFile(ext)
+	}
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
 type declaration struct {
 	// name of table or function
 	name string
 	// signature of table or function
 	signature string
+	// parameters of a function
+	params []parameter
+	// columns of a table
+	columns []column
 	// body
 	body string
 	// the type of declaration
 	declType declType
 	// doc
 	doc string
+	// the database folder, when overridden by an annotation
+	folder string
+	// annotations in the comment block
+	annotations []annotation
+
+	// literal rows of a table, i.e. the contents between '[' and ']'
+	rows string
+	// how rows of a table are synced
+	dataMode dataMode
+
+	// source table of a materialized view, or target external table of a continuous export
+	source string
+	// options of a function
+	function functionOptions
+
+	// options of a materialized view
+	view viewOptions
+
+	// options of an external table
+	external externalOptions
+
+	// options of a continuous export, whose target external table is in source
+	export exportOptions
+
+	// update policies of a table
+	updatePolicies []updatePolicy
+	// other policies of a table
+	policies []policyDecl
+	// the policy of a policy declaration
+	policy policyDecl
 
-	// only used while parsing
-	parseState int
+	// position of the declaration name
+	row int
+	col int
+	// position of the '{' that starts the body
+	bodyRow int
+	bodyCol int
+}
+
+// references returns the names of the entities that the declaration references.
+// functions are the names of the declared functions, whose arguments may be tables.
+//
+// Only the body and the default values of parameters can reference other entities;
+// the names of columns and parameters are never references,
+// including uses of a parameter in the body that shadow an entity of the same name.
+func (d *declaration) references(functions map[string]bool) []string {
+	names := []string{}
+	switch d.declType {
+	case materializedViewType:
+		names = append(names, d.source)
+	case continuousExportType:
+		names = append(names, d.source)
+	case policyType:
+		names = append(names, d.policy.table)
+		names = append(names, d.policy.refs...)
+	}
+
+	names = append(names, references(d.body, functions)...)
+	for _, p := range d.params {
+		if p.defaultValue != "" {
+			names = append(names, references(p.defaultValue, functions)...)
+		}
+	}
+
+	switch d.declType {
+	case materializedViewType:
+		names = append(names, d.view.dimensionTables...)
+	case continuousExportType:
+		names = append(names, d.export.over...)
+	}
+
+	refs := []string{}
+	seen := map[string]bool{}
+	for _, ref := range names {
+		if ref != "" && !seen[ref] && !d.hasParam(ref) {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+func (d *declaration) hasParam(name string) bool {
+	for _, p := range d.params {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
 }
 
 type declType uint8
@@ -37,8 +143,72 @@ type declType uint8
 const (
 	functionType = iota
 	tableType
+	materializedViewType
+	policyType
+	externalTableType
+	continuousExportType
 )
 
+func (t declType) String() string {
+	switch t {
+	case functionType:
+		return "function"
+	case tableType:
+		return "table"
+	case materializedViewType:
+		return "materialized-view"
+	case policyType:
+		return "policy"
+	case externalTableType:
+		return "external-table"
+	case continuousExportType:
+		return "continuous-export"
+	default:
+		panic(fmt.Sprintf("unhandled declarationType: %d", t))
+	}
+}
+
+// source is a declaration parsed from a Kusto source file.
+type source struct {
+	// path of the source file, relative to the source root
+	rel  string
+	decl *declaration
+	// names of the declarations that this declaration references
+	dependsOn []string
+}
+
+// out returns the path of the command script file built from the source file, relative to the output directory.
+func (s source) out() string {
+	if IsKustoSourceFile(filepath.Ext(s.rel)) {
+		return s.rel
+	}
+	return s.rel + ".csl"
+}
+
+// folder returns the database folder of the declaration,
+// which mirrors the directory of the source file unless overridden by an annotation.
+func (s source) folder() string {
+	if s.decl.folder != "" {
+		return s.decl.folder
+	}
+	dir := filepath.Dir(s.rel)
+	// files at the source root are not in a folder
+	if dir == "." {
+		return ""
+	}
+	// ensure all folders are forward slashes
+	return strings.ReplaceAll(dir, "\\", "/")
+}
+
+// BuildOptions configures Build.
+type BuildOptions struct {
+	// Strict treats warnings as errors.
+	Strict bool
+	// Extensions are the file extensions of Kusto source files, i.e. .kql.
+	// Defaults to the extensions of IsKustoSourceFile.
+	Extensions []string
+}
+
 // Walks Kusto source files under srcRoot, and building the result files
 // under outRoot.
 //
@@ -47,16 +217,121 @@ const (
 // - .kql
 // - .csl
 // - .kusto
-func Build(srcRoot string, outRoot string) error {
+//
+// The errors and warnings in all source files are returned as diagnostics. If any diagnostic is an error,
+// no files are built and the errors are returned, joined.
+//
+// The files of the previous build, as listed in its manifest, are removed from outRoot.
+// An error is returned if outRoot holds other files without a manifest, as it was not built by Build.
+func Build(srcRoot string, outRoot string, opts BuildOptions) (Diagnostics, error) {
 	srcRoot = filepath.Clean(srcRoot)
 	outRoot = filepath.Clean(outRoot)
-	return filepath.WalkDir(srcRoot, func(path string, d fs.DirEntry, err error) error {
+	if isWithin(outRoot, srcRoot) {
+		return nil, fmt.Errorf("output directory %s must not contain the source directory", outRoot)
+	}
+	if err := checkOutDir(outRoot); err != nil {
+		return nil, err
+	}
+
+	sources, diags, err := parseSources(srcRoot, outRoot, opts.Extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	// references are only checked between files without errors, to avoid reporting errors twice
+	if diags.Count(SeverityError) == 0 {
+		diags.addErrors(checkPolicyReferences(sources))
+		diags.addErrors(checkExportTargets(sources))
+	}
+	sorted, errs := sortSources(sources)
+	diags.addErrors(errs)
+
+	if opts.Strict {
+		for i := range diags {
+			diags[i].Severity = SeverityError
+		}
+	}
+	diags.readLines(srcRoot)
+	if err := diags.err(); err != nil {
+		return diags, err
+	}
+
+	// remove previously built files, so that files of deleted declarations are not synced
+	if err := cleanOutDir(outRoot); err != nil {
+		return diags, fmt.Errorf("cleaning outDir: %w", err)
+	}
+	if err := os.MkdirAll(outRoot, 0777); err != nil {
+		return diags, fmt.Errorf("creating outDir: %w", err)
+	}
+
+	// the commands of the declarations in each file are written to a single out file,
+	// in the order they are declared.
+	lines := map[*declaration][]manifestCommand{}
+	for i := 0; i < len(sources); {
+		rel := sources[i].rel
+		fileCmds := []string{}
+		owners := []*declaration{}
+		for ; i < len(sources) && sources[i].rel == rel; i++ {
+			cmds, err := commands(sources[i].decl, sources[i].folder())
+			if err != nil {
+				return diags, fmt.Errorf("writing out file %s: %w", rel, err)
+			}
+			for _, cmd := range cmds {
+				fileCmds = append(fileCmds, cmd)
+				owners = append(owners, sources[i].decl)
+			}
+		}
+
+		fileLines, err := writeFile(filepath.Join(outRoot, sources[i-1].out()), fileCmds)
+		if err != nil {
+			return diags, fmt.Errorf("writing out file %s: %w", rel, err)
+		}
+		for j, l := range fileLines {
+			lines[owners[j]] = append(lines[owners[j]], l)
+		}
+	}
+
+	m := &manifest{Entities: make([]manifestEntity, 0, len(sorted))}
+	for _, src := range sorted {
+		entity := newManifestEntity(src)
+		entity.Commands = lines[src.decl]
+		m.Entities = append(m.Entities, entity)
+	}
+
+	return diags, writeManifest(outRoot, m)
+}
+
+// isWithin returns true if path is dir, or is under dir.
+func isWithin(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// parseSources walks Kusto source files under srcRoot, and parses the declarations in each file.
+// Declarations in the same file are returned together, in the order they are declared.
+// The policies of a table follow the table.
+//
+// Files under outRoot, and any directory named OutDir, are skipped.
+// extensions are the extensions of source files, or nil for the extensions of IsKustoSourceFile.
+// Parsing continues after errors in source files, which are returned as diagnostics,
+// together with the warnings. Only declarations without errors are returned.
+func parseSources(srcRoot string, outRoot string, extensions []string) ([]source, Diagnostics, error) {
+	parsed := []source{}
+	diags := Diagnostics{}
+	folders := map[string]*folderPolicies{}
+	err := filepath.WalkDir(srcRoot, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
 		// skip any file in specified outRoot
-		if strings.HasPrefix(path, outRoot) {
+		if isWithin(outRoot, path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -69,49 +344,161 @@ func Build(srcRoot string, outRoot string) error {
 		}
 
 		ext := filepath.Ext(path)
-		if !IsKustoSourceFile(ext) {
+		if !isSourceFile(ext, extensions) && d.Name() != PolicyFile {
 			return nil
 		}
 
 		rel, err := filepath.Rel(srcRoot, path)
 		if err != nil {
-			panic(fmt.Sprintf("calculating rel path of '%s' from root '%s: %v", path, outRoot, err))
+			panic(fmt.Sprintf("calculating rel path of '%s' from root '%s: %v", path, srcRoot, err))
 		}
-		outFile := filepath.Join(outRoot, rel)
-		outDir := filepath.Dir(outFile)
-		err = os.MkdirAll(outDir, 0777)
-		if err != nil {
-			return fmt.Errorf("creating outDir: %w", err)
+
+		if d.Name() == PolicyFile {
+			policies, err := readPolicyFile(path, rel)
+			if err != nil {
+				return diags.add(rel, err)
+			}
+			folders[filepath.Dir(rel)] = policies
+			return nil
 		}
-		reader, err := os.Open(path)
+
+		content, err := os.ReadFile(path)
 		if err != nil {
 			return err
 		}
-		defer reader.Close()
 
-		decl, err := parse(reader)
-		if err != nil {
-			return fmt.Errorf("parsing file %s: %w", rel, err)
+		decls, fileDiags := parseFile(string(content))
+		diags.addAll(rel, fileDiags)
+		for _, decl := range decls {
+			parsed = append(parsed, source{rel: rel, decl: decl})
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-		writer, err := os.Create(outFile)
-		if err != nil {
-			return fmt.Errorf("creating out file: %w", err)
+	sources := make([]source, 0, len(parsed))
+	for _, src := range parsed {
+		sources = append(sources, src)
+		if src.decl.declType != tableType {
+			continue
 		}
-		defer func() error {
-			if err := writer.Close(); err != nil {
-				return fmt.Errorf("writing out file: %w", err)
+
+		if err := applyDefaultPolicies(src, folders); err != nil {
+			if err := diags.add(src.rel, err); err != nil {
+				return nil, nil, err
 			}
-			return nil
-		}()
+			continue
+		}
 
-		err = write(writer, decl, filepath.Dir(rel))
+		policies, err := policyDeclarations(src.decl)
 		if err != nil {
-			return fmt.Errorf("writing out file %s: %w", rel, err)
+			if err := diags.add(src.rel, err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		for _, decl := range policies {
+			sources = append(sources, source{rel: src.rel, decl: decl})
 		}
+	}
 
-		return nil
-	})
+	if policies, has := folders["."]; has {
+		decls, err := databasePolicies(policies)
+		if err != nil {
+			if err := diags.add(PolicyFile, err); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, decl := range decls {
+			sources = append(sources, source{rel: PolicyFile, decl: decl})
+		}
+	}
+
+	return sources, diags, nil
+}
+
+// readPolicyFile reads the policy file at path. Database policies are only allowed at the source root.
+func readPolicyFile(path string, rel string) (*folderPolicies, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := parsePolicyFile(content)
+	if err != nil {
+		return nil, parseFileError(rel, err)
+	}
+
+	if len(policies.database) > 0 && filepath.Dir(rel) != "." {
+		a := policies.database[0]
+		return nil, parseFileError(
+			rel, newParseError(a.row, a.col, "database policies can only be declared in the %s at the source root", PolicyFile))
+	}
+	return policies, nil
+}
+
+// parseFileError sets the file of a ParseError in err to rel.
+func parseFileError(rel string, err error) error {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		parseErr.file = rel
+		return parseErr
+	}
+	return fmt.Errorf("parsing file %s: %w", rel, err)
+}
+
+// writeFile writes the commands to outFile, separated by empty lines.
+// The lines of each command in outFile are returned.
+func writeFile(outFile string, cmds []string) ([]manifestCommand, error) {
+	err := os.MkdirAll(filepath.Dir(outFile), 0777)
+	if err != nil {
+		return nil, fmt.Errorf("creating outDir: %w", err)
+	}
+
+	var b strings.Builder
+	lines := make([]manifestCommand, 0, len(cmds))
+	line := 1
+	for i, cmd := range cmds {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(cmd)
+
+		count := strings.Count(cmd, "\n") + 1
+		lines = append(lines, manifestCommand{Line: line, Lines: count})
+		// skip the empty line that separates commands
+		line += count + 1
+	}
+	b.WriteString("\n")
+
+	err = os.WriteFile(outFile, []byte(b.String()), 0666)
+	if err != nil {
+		return nil, fmt.Errorf("creating out file: %w", err)
+	}
+
+	return lines, nil
+}
+
+// commands returns the management commands that sync the declaration, in the order they are executed.
+func commands(decl *declaration, folder string) ([]string, error) {
+	var b strings.Builder
+	if err := write(&b, decl, folder); err != nil {
+		return nil, err
+	}
+	cmds := []string{strings.TrimRight(b.String(), "\n")}
+
+	if decl.declType == tableType {
+		if docs := columnDocstringsCommand(decl); docs != "" {
+			cmds = append(cmds, docs)
+		}
+		if data := dataCommand(decl); data != "" {
+			cmds = append(cmds, data)
+		}
+	}
+
+	return cmds, nil
 }
 
 func write(
@@ -120,18 +507,48 @@ func write(
 	folder string) error {
 	// ensure all folders are forward slashes
 	folder = strings.ReplaceAll(folder, "\\", "/")
+	body := decl.body
 	var err error
 	switch decl.declType {
 	case functionType:
 		_, err = writer.Write([]byte(
 			fmt.Sprintf(
-				".create-or-alter function with (folder=\"%s\",docstring=\"%s\") %s%s ",
-				folder, decl.doc, decl.name, decl.signature)))
+				".create-or-alter function with (folder=\"%s\",docstring=\"%s\"%s) %s %s ",
+				escapeString(folder), escapeString(decl.doc), functionProperties(decl.function),
+				quoteName(decl.name), decl.signature)))
+
 	case tableType:
 		_, err = writer.Write([]byte(
 			fmt.Sprintf(
-				".create-merge table %s%s\n",
-				decl.name, decl.signature)))
+				".create-merge table %s%s with (folder=\"%s\",docstring=\"%s\")\n",
+				quoteName(decl.name), decl.signature, escapeString(folder), escapeString(decl.doc))))
+
+	case materializedViewType:
+		_, err = writer.Write([]byte(
+			fmt.Sprintf(
+				".create-or-alter materialized-view with (folder=\"%s\",docstring=\"%s\"%s) %s on table %s ",
+				escapeString(folder), escapeString(decl.doc), viewProperties(decl.view),
+				quoteName(decl.name), quoteName(decl.source))))
+
+	case policyType:
+		_, err = writer.Write([]byte(
+			fmt.Sprintf(
+				".alter %s policy %s %s",
+				decl.policy.entity(), decl.policy.kind, decl.policy.arg)))
+
+	case externalTableType:
+		_, err = writer.Write([]byte(
+			fmt.Sprintf(
+				".create-or-alter external table %s %s\n%swith (folder=\"%s\",docstring=\"%s\"%s)\n",
+				quoteName(decl.name), decl.signature, externalTableClauses(decl.external),
+				escapeString(folder), escapeString(decl.doc), externalTableProperties(decl.external))))
+
+	case continuousExportType:
+		_, err = writer.Write([]byte(
+			fmt.Sprintf(
+				".create-or-alter continuous-export %s\n%s<|",
+				quoteName(decl.name), exportClauses(decl))))
+		body = strings.TrimRightFunc(query(decl.body), unicode.IsSpace)
 	default:
 		panic(fmt.Sprintf("unhandled declarationType: %d", decl.declType))
 	}
@@ -140,10 +557,44 @@ func write(
 		return err
 	}
 
-	_, err = writer.Write([]byte(decl.body))
+	_, err = writer.Write([]byte(body))
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// columnDocstringsCommand returns the command that sets the docstrings of the columns of a table,
+// or an empty string if no column has a docstring.
+func columnDocstringsCommand(decl *declaration) string {
+	docs := []string{}
+	for _, col := range decl.columns {
+		if col.doc != "" {
+			docs = append(docs, fmt.Sprintf("%s:\"%s\"", quoteName(col.name), escapeString(col.doc)))
+		}
+	}
+	if len(docs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(".alter-merge table %s column-docstrings (%s)", quoteName(decl.name), strings.Join(docs, ", "))
+}
+
+// escapeString escapes s for use inside a double-quoted Kusto string literal.
+func escapeString(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	return strings.ReplaceAll(s, "\"", "\\\"")
+}
+
+// quoteName returns name as a Kusto identifier, quoting the name when it is required.
+//
+// Names that are not plain ASCII identifiers, i.e. ['my-func'], ['Request.Count'] or ['Café'], are quoted.
+func quoteName(name string) string {
+	for i, r := range name {
+		plain := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' || (i > 0 && r >= '0' && r <= '9')
+		if !plain {
+			return "['" + strings.ReplaceAll(strings.ReplaceAll(name, "\\", "\\\\"), "'", "\\'") + "']"
+		}
+	}
+	return name
+}
@@ -3,12 +3,14 @@ package ksd
 import (
 	"embed"
 	"fmt"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/bradleyjkemp/cupaloy/v2"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,6 +26,9 @@ func snapshotter() *cupaloy.Config {
 func TestBuild_Snapshots(t *testing.T) {
 	testBuild(t, "testdata/functions", "fn")
 	testBuild(t, "testdata/tables", "tb")
+	testBuild(t, "testdata/views", "mv")
+	testBuild(t, "testdata/externals", "ext")
+	testBuild(t, "testdata/exports", "ce")
 }
 
 func testBuild(t *testing.T, root string, prefix string) {
@@ -42,17 +47,311 @@ func testBuild(t *testing.T, root string, prefix string) {
 			require.NoError(t, err)
 			reader := strings.NewReader(string(bytes))
 
-			decl, err := parse(reader)
+			decls, err := parse(reader)
 			require.NoError(t, err, "parse error")
 
-			b := &strings.Builder{}
-			err = write(b, decl, filepath.Base(root))
-			require.NoError(t, err, "write error")
+			all := []string{}
+			for _, decl := range decls {
+				src := source{rel: filepath.Join(filepath.Base(root), e.Name()), decl: decl}
+				cmds, err := commands(decl, src.folder())
+				require.NoError(t, err, "write error")
+				all = append(all, cmds...)
+			}
 
 			err = snapshotter.SnapshotWithName(
 				fmt.Sprintf("%s-%s", prefix, e.Name()),
-				b.String())
+				strings.Join(all, "\n\n"))
 			require.NoError(t, err)
 		})
 	}
 }
+
+func TestBuild_Manifest(t *testing.T) {
+	srcRoot := t.TempDir()
+	files := map[string]string{
+		"functions/Find.csl":  "let Find = (s:string) { Log | where Message has s }",
+		"functions/Limit.csl": "let Limit = (n:int) { Find('') | take n }",
+		"tables/Log.csl":      "let Log = datatable(Message:string)[]",
+	}
+	for name, content := range files {
+		path := filepath.Join(srcRoot, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	}
+
+	outRoot := filepath.Join(srcRoot, OutDir)
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+	require.Equal(t, []manifestEntity{
+		{Name: "Log", Kind: "table", File: "tables/Log.csl", Folder: "tables",
+			Commands: []manifestCommand{{Line: 1, Lines: 1}}},
+		{Name: "Find", Kind: "function", File: "functions/Find.csl", Folder: "functions", DependsOn: []string{"Log"},
+			Commands: []manifestCommand{{Line: 1, Lines: 1}}},
+		{Name: "Limit", Kind: "function", File: "functions/Limit.csl", Folder: "functions", DependsOn: []string{"Find"},
+			Commands: []manifestCommand{{Line: 1, Lines: 1}}},
+	}, m.Entities)
+	for _, e := range m.Entities {
+		require.FileExists(t, filepath.Join(outRoot, e.File))
+	}
+}
+
+func TestBuild_DataCommands(t *testing.T) {
+	srcRoot := t.TempDir()
+	path := filepath.Join(srcRoot, "tables", "Region.csl")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	content := "// @data replace\nlet Region = datatable(Code:string, Name:string)\n[\n  'eu', 'Europe',\n  'us', 'United States',\n]"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+
+	outRoot := filepath.Join(srcRoot, OutDir)
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+	require.Len(t, m.Entities, 1)
+	require.Equal(t, []manifestCommand{{Line: 1, Lines: 1}, {Line: 3, Lines: 5}}, m.Entities[0].Commands)
+
+	cmds, err := readCommands(outRoot, m.Entities[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		".create-merge table Region(Code:string, Name:string) with (folder=\"tables\",docstring=\"\")",
+		".set-or-replace Region <| datatable(Code:string, Name:string)\n[\n    'eu', 'Europe',\n  'us', 'United States',\n]",
+	}, cmds)
+}
+
+func TestBuild_RootFolder(t *testing.T) {
+	srcRoot := t.TempDir()
+	writeSources(t, srcRoot, map[string]string{
+		"Log.csl": "let Log = datatable(a:int)[]",
+		"Get.csl": "let Get = () { Log }",
+	})
+	outRoot := filepath.Join(srcRoot, OutDir)
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+	cmds := []string{}
+	for _, e := range m.Entities {
+		assert.Equal(t, "", e.Folder)
+		entityCmds, err := readCommands(outRoot, e)
+		require.NoError(t, err)
+		cmds = append(cmds, entityCmds...)
+	}
+	// files at the source root are not in a folder
+	require.Equal(t, []string{
+		".create-merge table Log(a:int) with (folder=\"\",docstring=\"\")",
+		".create-or-alter function with (folder=\"\",docstring=\"\") Get () { Log }",
+	}, cmds)
+}
+
+func TestBuild_MultipleDeclarations(t *testing.T) {
+	srcRoot := t.TempDir()
+	path := filepath.Join(srcRoot, "functions", "Requests.csl")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	content := "let Main = () {\n  Helper()\n}\n\n// Helper\nlet Helper = () { print 1 }"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+
+	outRoot := filepath.Join(srcRoot, OutDir)
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+	require.Equal(t, []manifestEntity{
+		{Name: "Helper", Kind: "function", File: "functions/Requests.csl", Folder: "functions",
+			Commands: []manifestCommand{{Line: 5, Lines: 1}}},
+		{Name: "Main", Kind: "function", File: "functions/Requests.csl", Folder: "functions", DependsOn: []string{"Helper"},
+			Commands: []manifestCommand{{Line: 1, Lines: 3}}},
+	}, m.Entities)
+
+	cmds, err := readCommands(outRoot, m.Entities[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		`.create-or-alter function with (folder="functions",docstring="Helper") Helper () { print 1 }`,
+	}, cmds)
+}
+
+func TestBuild_UpdatePolicy(t *testing.T) {
+	srcRoot := t.TempDir()
+	files := map[string]string{
+		"functions/ParseEvents.csl": "let ParseEvents = () { RawEvents | project Name = tostring(Data.name) }",
+		"tables/Events.csl":         "// @updatePolicy Source=RawEvents Function=ParseEvents IsTransactional=true\nlet Events = datatable(Name:string)[]",
+		"tables/RawEvents.csl":      "let RawEvents = datatable(Data:dynamic)[]",
+	}
+	for name, content := range files {
+		path := filepath.Join(srcRoot, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	}
+
+	outRoot := filepath.Join(srcRoot, OutDir)
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+	names := []string{}
+	for _, e := range m.Entities {
+		names = append(names, e.Kind+" "+e.Name)
+	}
+	require.Equal(t, []string{
+		"table Events",
+		"table RawEvents",
+		"function ParseEvents",
+		"policy Events update",
+	}, names)
+	require.Equal(t, []string{"Events", "RawEvents", "ParseEvents"}, m.Entities[3].DependsOn)
+
+	cmds, err := readCommands(outRoot, m.Entities[3])
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		".alter table Events policy update ```" +
+			`[{"IsEnabled":true,"Source":"RawEvents","Query":"ParseEvents()","IsTransactional":true,"PropagateIngestionProperties":false}]` +
+			"```",
+	}, cmds)
+}
+
+func TestBuild_UpdatePolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		errMsg string
+	}{
+		{
+			"undeclaredFunction",
+			map[string]string{
+				"Events.csl": "// @updatePolicy Source=RawEvents Function=ParseEvents\nlet Events = datatable(Name:string)[]",
+				"Raw.csl":    "let RawEvents = datatable(Data:dynamic)[]",
+			},
+			"Events.csl:1:4: update policy function 'ParseEvents' is not declared",
+		},
+		{
+			"sourceNotTable",
+			map[string]string{
+				"Events.csl": "// doc\n// @updatePolicy Source=RawEvents Function=RawEvents\nlet Events = datatable(Name:string)[]",
+				"Raw.csl":    "let RawEvents = () { print 1 }",
+			},
+			"Events.csl:2:4: update policy source table 'RawEvents' is declared as a function",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcRoot := t.TempDir()
+			for name, content := range tt.files {
+				require.NoError(t, os.WriteFile(filepath.Join(srcRoot, name), []byte(content), 0666))
+			}
+
+			_, err := Build(srcRoot, filepath.Join(srcRoot, OutDir), BuildOptions{})
+			require.EqualError(t, err, tt.errMsg)
+		})
+	}
+}
+
+func TestBuild_ParseErrorPosition(t *testing.T) {
+	srcRoot := t.TempDir()
+	path := filepath.Join(srcRoot, "tables", "Log.csl")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	require.NoError(t, os.WriteFile(path, []byte("// Log\nlet Log = datatable(Timestamp:datatime)[]"), 0666))
+
+	_, err := Build(srcRoot, filepath.Join(srcRoot, OutDir), BuildOptions{})
+	require.EqualError(
+		t,
+		err,
+		filepath.Join("tables", "Log.csl")+":2:31: unknown type 'datatime'. Did you mean 'datetime'?")
+}
+
+func Test_quoteName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"Requests", "Requests"},
+		{"_private2", "_private2"},
+		{"my-func", "['my-func']"},
+		{"Request.Count", "['Request.Count']"},
+		{"my table", "['my table']"},
+		{"Café", "['Café']"},
+		{"2023", "['2023']"},
+		{"it's", "['it\\'s']"},
+		{`back\slash`, `['back\\slash']`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, quoteName(tt.name))
+			assert.Equal(t, []string{tt.name}, references(tt.expected, nil))
+		})
+	}
+}
+
+func TestBuild_QuotedNames(t *testing.T) {
+	srcRoot := t.TempDir()
+	files := map[string]string{
+		"functions/Find.csl": "let ['find-requests'] = () { ['Request.Count'] | where Name != '' }",
+		"tables/Count.csl":   "// @cachingPolicy Hot=1d\nlet ['Request.Count'] = datatable(Name:string)[]",
+	}
+	for name, content := range files {
+		path := filepath.Join(srcRoot, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	}
+
+	outRoot := filepath.Join(srcRoot, OutDir)
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+
+	commands := []string{}
+	for _, e := range m.Entities {
+		cmds, err := readCommands(outRoot, e)
+		require.NoError(t, err)
+		commands = append(commands, cmds...)
+	}
+	assert.Equal(t, []string{
+		".create-merge table ['Request.Count'](Name:string) with (folder=\"tables\",docstring=\"\")",
+		".create-or-alter function with (folder=\"functions\",docstring=\"\") ['find-requests'] () { ['Request.Count'] | where Name != '' }",
+		".alter table ['Request.Count'] policy caching hot = time(1.00:00:00)",
+	}, commands)
+	assert.Equal(t, []string{"Request.Count"}, m.Entities[1].DependsOn)
+}
+
+func TestBuild_OutDir(t *testing.T) {
+	srcRoot := t.TempDir()
+	writeSources(t, srcRoot, map[string]string{
+		"functions/A.csl": "let A = () { print 1 }",
+		"functions/B.csl": "let B = () { print 2 }",
+	})
+
+	// a directory that was not built by ksd is not cleaned
+	outRoot := filepath.Join(t.TempDir(), "dist")
+	writeSources(t, outRoot, map[string]string{"keep.txt": "keep"})
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.ErrorContains(t, err, "is not empty, and has no manifest.json")
+	assert.FileExists(t, filepath.Join(outRoot, "keep.txt"))
+
+	// only the files of the previous build are removed
+	require.NoError(t, os.Remove(filepath.Join(outRoot, "keep.txt")))
+	_, err = Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+	writeSources(t, outRoot, map[string]string{"functions/notes.txt": "keep"})
+	require.NoError(t, os.Remove(filepath.Join(srcRoot, "functions", "B.csl")))
+	_, err = Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(outRoot, "functions", "A.csl"))
+	assert.NoFileExists(t, filepath.Join(outRoot, "functions", "B.csl"))
+	assert.FileExists(t, filepath.Join(outRoot, "functions", "notes.txt"))
+}
+
+func Test_isWithin(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "a")
+	assert.True(t, isWithin(filepath.Join(root, "s"), filepath.Join(root, "s")))
+	assert.True(t, isWithin(filepath.Join(root, "s"), filepath.Join(root, "s", "src")))
+	assert.False(t, isWithin(filepath.Join(root, "s"), filepath.Join(root, "src")))
+	assert.False(t, isWithin(filepath.Join(root, "s", "src"), filepath.Join(root, "s")))
+	assert.False(t, isWithin(filepath.Join(root, "s"), filepath.Join(root, "..s")))
+}
@@ -38,6 +38,7 @@ type CredentialOptions struct {
 }
 
 type kustoClient interface {
+	Query(ctx context.Context, db string, query kusto.Statement, options ...kusto.QueryOption) (*kusto.RowIterator, error)
 	Mgmt(ctx context.Context, db string, query kusto.Statement, options ...kusto.MgmtOption) (*kusto.RowIterator, error)
 	Close() error
 }
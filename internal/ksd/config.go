@@ -0,0 +1,171 @@
+package ksd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the name of the configuration file at the root of a project.
+const ConfigFile = "ksd.yaml"
+
+// Config is the configuration of a project, read from ConfigFile.
+//
+//	root: src/kusto
+//	out: build/kout
+//	extensions: [.kql]
+//	environments:
+//	  prod:
+//	    endpoint: https://<cluster>.kusto.windows.net/<database>
+//	    clientId: <clientId>
+//	    tenantId: <tenantId>
+//	    credentialProvider: github
+//	lint:
+//	  rules:
+//	    pascal-case: "off"
+//	    take-without-order: error
+type Config struct {
+	// Dir is the directory of the configuration file. Paths in the configuration are relative to it.
+	Dir string `yaml:"-"`
+	// Root is the source root.
+	Root string `yaml:"root"`
+	// Out is the output directory.
+	Out string `yaml:"out"`
+	// Extensions are the file extensions of Kusto source files, i.e. .kql.
+	Extensions []string `yaml:"extensions"`
+	// Environments are the databases that the project is synced to, by name.
+	Environments map[string]Environment `yaml:"environments"`
+	// Lint configures the rules of Lint.
+	Lint LintConfig `yaml:"lint"`
+}
+
+// LintConfig configures the rules of Lint.
+type LintConfig struct {
+	// Rules sets the severity of the rules by name: error, warning, or off.
+	Rules map[string]string `yaml:"rules"`
+}
+
+// Environment is a database that a project is synced to, and how to authenticate with it.
+// Secrets are not part of an environment, and are passed by flags or environment variables instead.
+type Environment struct {
+	Endpoint           string `yaml:"endpoint"`
+	ClientId           string `yaml:"clientId"`
+	TenantId           string `yaml:"tenantId"`
+	CredentialProvider string `yaml:"credentialProvider"`
+}
+
+// FindConfig reads the ConfigFile in dir, or in the closest parent directory of dir that has one.
+// The search stops at the root of the git repository that contains dir. nil is returned if there is none.
+func FindConfig(dir string) (*Config, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for current := dir; ; {
+		path := filepath.Join(current, ConfigFile)
+		if _, err := os.Stat(path); err == nil {
+			return readConfig(path)
+		}
+
+		if _, err := os.Stat(filepath.Join(current, ".git")); err == nil {
+			return nil, nil
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return nil, nil
+		}
+		current = parent
+	}
+}
+
+// readConfig reads the configuration file at path.
+func readConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	config := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	// an empty file is an empty configuration
+	if err := dec.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+
+	for _, ext := range config.Extensions {
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			return nil, fmt.Errorf("invalid %s: invalid extension '%s'. Expected i.e. .kql", path, ext)
+		}
+	}
+
+	if _, err := lintSeverities(config.Lint.Rules); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+
+	config.Dir = filepath.Dir(path)
+	return config, nil
+}
+
+// SourceRoot returns the source root of the project, or dir if the configuration does not set one.
+func (c *Config) SourceRoot(dir string) string {
+	if c == nil || c.Root == "" {
+		return dir
+	}
+	return c.path(c.Root)
+}
+
+// OutRoot returns the output directory of the project,
+// or OutDir under the source root srcRoot if the configuration does not set one.
+func (c *Config) OutRoot(srcRoot string) string {
+	if c == nil || c.Out == "" {
+		return filepath.Join(srcRoot, OutDir)
+	}
+	return c.path(c.Out)
+}
+
+// SourceExtensions returns the file extensions of Kusto source files, or nil to use the defaults.
+func (c *Config) SourceExtensions() []string {
+	if c == nil {
+		return nil
+	}
+	return c.Extensions
+}
+
+// LintRules returns the severity of the lint rules by name, or nil to use the defaults.
+func (c *Config) LintRules() map[string]string {
+	if c == nil {
+		return nil
+	}
+	return c.Lint.Rules
+}
+
+// Environment returns the environment of the name.
+func (c *Config) Environment(name string) (Environment, error) {
+	if c == nil {
+		return Environment{}, fmt.Errorf("environment '%s' requires a %s file", name, ConfigFile)
+	}
+
+	env, has := c.Environments[name]
+	if !has {
+		return Environment{}, fmt.Errorf(
+			"environment '%s' is not defined in %s. Defined environments: %s",
+			name, filepath.Join(c.Dir, ConfigFile), strings.Join(sortedKeys(c.Environments), ", "))
+	}
+	return env, nil
+}
+
+// path returns the path p in the configuration, relative to the directory of the configuration file.
+func (c *Config) path(p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(c.Dir, filepath.FromSlash(p))
+}
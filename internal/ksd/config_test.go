@@ -0,0 +1,133 @@
+package ksd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindConfig(t *testing.T) {
+	project := t.TempDir()
+	writeSources(t, project, map[string]string{
+		".git/HEAD": "ref: refs/heads/main",
+		ConfigFile: `
+root: src/kusto
+out: build/kout
+extensions: [.kql, .kusto]
+environments:
+  dev:
+    endpoint: https://dev.kusto.windows.net/Logs
+  prod:
+    endpoint: https://prod.kusto.windows.net/Logs
+    clientId: client
+    tenantId: tenant
+    credentialProvider: github
+lint:
+  rules:
+    pascal-case: "off"
+`,
+		"src/kusto/functions/Get.kql": "let Get = () { 1 }",
+	})
+
+	config, err := FindConfig(filepath.Join(project, "src", "kusto", "functions"))
+	require.NoError(t, err)
+	require.NotNil(t, config)
+	assert.Equal(t, project, config.Dir)
+	assert.Equal(t, filepath.Join(project, "src", "kusto"), config.SourceRoot("ignored"))
+	assert.Equal(t, filepath.Join(project, "build", "kout"), config.OutRoot("ignored"))
+	assert.Equal(t, []string{".kql", ".kusto"}, config.SourceExtensions())
+	assert.Equal(t, map[string]string{"pascal-case": "off"}, config.LintRules())
+
+	prod, err := config.Environment("prod")
+	require.NoError(t, err)
+	assert.Equal(t, Environment{
+		Endpoint:           "https://prod.kusto.windows.net/Logs",
+		ClientId:           "client",
+		TenantId:           "tenant",
+		CredentialProvider: "github",
+	}, prod)
+
+	_, err = config.Environment("test")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "environment 'test' is not defined in")
+	assert.Contains(t, err.Error(), "Defined environments: dev, prod")
+}
+
+func TestFindConfig_None(t *testing.T) {
+	// the search stops at the root of the repository
+	parent := t.TempDir()
+	writeSources(t, parent, map[string]string{
+		ConfigFile:          "root: src",
+		"project/.git/HEAD": "ref: refs/heads/main",
+	})
+
+	dir := filepath.Join(parent, "project", "src")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	config, err := FindConfig(dir)
+	require.NoError(t, err)
+	assert.Nil(t, config)
+
+	// a missing config uses the defaults
+	assert.Equal(t, dir, config.SourceRoot(dir))
+	assert.Equal(t, filepath.Join(dir, OutDir), config.OutRoot(dir))
+	assert.Nil(t, config.SourceExtensions())
+	assert.Nil(t, config.LintRules())
+	_, err = config.Environment("prod")
+	assert.EqualError(t, err, "environment 'prod' requires a ksd.yaml file")
+}
+
+func TestFindConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"unknownField", "source: src", "field source not found"},
+		{"secret", "environments:\n  prod:\n    clientSecret: secret", "field clientSecret not found"},
+		{"extension", "extensions: [kql]", "invalid extension 'kql'. Expected i.e. .kql"},
+		{"lintRule", "lint:\n  rules:\n    no-tabs: error", "unknown lint rule 'no-tabs'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeSources(t, dir, map[string]string{".git/HEAD": "", ConfigFile: tt.content})
+
+			_, err := FindConfig(dir)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+
+	dir := t.TempDir()
+	writeSources(t, dir, map[string]string{".git/HEAD": "", ConfigFile: ""})
+	config, err := FindConfig(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &Config{Dir: dir}, config)
+}
+
+func Test_isSourceFile(t *testing.T) {
+	assert.True(t, isSourceFile(".csl", nil))
+	assert.False(t, isSourceFile(".txt", nil))
+	assert.True(t, isSourceFile(".txt", []string{".txt"}))
+	assert.False(t, isSourceFile(".csl", []string{".txt"}))
+}
+
+func TestBuild_Extensions(t *testing.T) {
+	srcRoot := t.TempDir()
+	outRoot := filepath.Join(t.TempDir(), OutDir)
+	writeSources(t, srcRoot, map[string]string{
+		"functions/Get.kql":  "let Get = () { 1 }",
+		"scratch/Draft.csl":  "let Draft = (",
+		"functions/List.kql": "let List = () { Get }",
+	})
+
+	diags, err := Build(srcRoot, outRoot, BuildOptions{Extensions: []string{".kql"}})
+	require.NoError(t, err)
+	assert.Empty(t, diags)
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+	assert.Len(t, m.Entities, 2)
+}
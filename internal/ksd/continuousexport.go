@@ -0,0 +1,250 @@
+package ksd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+)
+
+// exportOptions are the options of a continuous export declaration, set by annotations.
+type exportOptions struct {
+	// the interval between runs of the export, i.e. 1h
+	intervalBetweenRuns string
+	// the latency after which records are exported, i.e. 10m
+	forcedLatency string
+	// the size limit in bytes of a single exported file
+	sizeLimit string
+	// whether the export runs on all nodes, i.e. true or false
+	distributed string
+	// the fact tables of the query, whose records are exported exactly once
+	over []string
+}
+
+// parseContinuousExport parses the target external table and query of a continuous export
+// that start at the cursor, i.e.:
+//
+//	(ExternalTable) { query }
+func parseContinuousExport(s *scanner, decl *declaration) error {
+	if !s.accept('(') {
+		return s.errorf("expected '(' for target external table of continuous export, found %s", s.describe())
+	}
+
+	s.skipSpace()
+	target, err := s.identifier()
+	if err != nil {
+		return err
+	}
+	decl.source = target
+
+	s.skipSpace()
+	if !s.accept(')') {
+		return s.errorf("expected ')' after target external table '%s', found %s", target, s.describe())
+	}
+
+	s.skipSpace()
+	if err := parseBody(s, decl, "continuous export query"); err != nil {
+		return err
+	}
+
+	return s.expectEnd("continuous export query")
+}
+
+// checkContinuousExport verifies that the required annotations of a continuous export declaration are declared.
+func checkContinuousExport(decl *declaration) error {
+	if decl.export.intervalBetweenRuns == "" {
+		return newParseError(
+			decl.row, decl.col,
+			"continuous export '%s' must declare the interval between runs with '// @intervalBetweenRuns'", decl.name)
+	}
+	return nil
+}
+
+// checkExportTargets verifies that the target of each continuous export, when declared, is an external table.
+// An error is returned for each continuous export whose target is not.
+func checkExportTargets(sources []source) []*ParseError {
+	declared := map[string]*declaration{}
+	for _, src := range sources {
+		if src.decl.declType != policyType {
+			declared[src.decl.name] = src.decl
+		}
+	}
+
+	errs := []*ParseError{}
+	for _, src := range sources {
+		if src.decl.declType != continuousExportType {
+			continue
+		}
+
+		if target, has := declared[src.decl.source]; has && target.declType != externalTableType {
+			errs = append(errs, &ParseError{
+				file: src.rel,
+				row:  src.decl.row,
+				col:  src.decl.col,
+				msg: fmt.Sprintf(
+					"continuous export target '%s' is declared as a %s", src.decl.source, target.declType),
+			})
+		}
+	}
+	return errs
+}
+
+// exportClauses returns the clauses of the '.create-or-alter continuous-export' command between the name
+// and the query.
+func exportClauses(decl *declaration) string {
+	var b strings.Builder
+	if len(decl.export.over) > 0 {
+		tables := make([]string, 0, len(decl.export.over))
+		for _, t := range decl.export.over {
+			tables = append(tables, quoteName(t))
+		}
+		fmt.Fprintf(&b, "over (%s)\n", strings.Join(tables, ", "))
+	}
+	fmt.Fprintf(&b, "to table %s\n", quoteName(decl.source))
+
+	props := []string{"intervalBetweenRuns=" + decl.export.intervalBetweenRuns}
+	if decl.export.forcedLatency != "" {
+		props = append(props, "forcedLatency="+decl.export.forcedLatency)
+	}
+	if decl.export.sizeLimit != "" {
+		props = append(props, "sizeLimit="+decl.export.sizeLimit)
+	}
+	if decl.export.distributed != "" {
+		props = append(props, "distributed="+decl.export.distributed)
+	}
+	fmt.Fprintf(&b, "with (%s)\n", strings.Join(props, ","))
+	return b.String()
+}
+
+// query returns the query of a materialized view or continuous export, without the surrounding braces.
+func query(body string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(body, "{"), "}")
+}
+
+// exportQuery returns the query of the '.create-or-alter continuous-export' command.
+func exportQuery(cmd string) string {
+	_, q, _ := strings.Cut(cmd, "\n<|")
+	return q
+}
+
+// applyIntervalBetweenRunsAnnotation applies '// @intervalBetweenRuns 1h'.
+func applyIntervalBetweenRunsAnnotation(decl *declaration, a annotation) error {
+	if !timespanLiteral.MatchString(a.value) {
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@intervalBetweenRuns'. Expected a timespan, i.e. 1h", a.value)
+	}
+	decl.export.intervalBetweenRuns = a.value
+	return nil
+}
+
+// applyForcedLatencyAnnotation applies '// @forcedLatency 10m'.
+func applyForcedLatencyAnnotation(decl *declaration, a annotation) error {
+	if !timespanLiteral.MatchString(a.value) {
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@forcedLatency'. Expected a timespan, i.e. 10m", a.value)
+	}
+	decl.export.forcedLatency = a.value
+	return nil
+}
+
+// applySizeLimitAnnotation applies '// @sizeLimit 104857600'.
+func applySizeLimitAnnotation(decl *declaration, a annotation) error {
+	if n, err := strconv.ParseInt(a.value, 10, 64); err != nil || n <= 0 {
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@sizeLimit'. Expected a size in bytes", a.value)
+	}
+	decl.export.sizeLimit = a.value
+	return nil
+}
+
+// applyDistributedAnnotation applies '// @distributed true|false'.
+func applyDistributedAnnotation(decl *declaration, a annotation) error {
+	if a.value != "true" && a.value != "false" {
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@distributed'. Allowed values: true, false", a.value)
+	}
+	decl.export.distributed = a.value
+	return nil
+}
+
+// applyOverAnnotation applies '// @over Table1, Table2'.
+func applyOverAnnotation(decl *declaration, a annotation) error {
+	tables := []string{}
+	for _, v := range strings.Split(a.value, ",") {
+		s, err := newScanner(strings.TrimSpace(v), a.row, a.col)
+		var name string
+		if err == nil {
+			name, err = s.identifier()
+		}
+		if err != nil || !s.eof() {
+			return newParseError(
+				a.row, a.col, "invalid value '%s' for '@over'. Expected a comma-separated list of tables", a.value)
+		}
+		tables = append(tables, name)
+	}
+	decl.export.over = tables
+	return nil
+}
+
+// diffContinuousExport compares the declared continuous export against the export in the database.
+func diffContinuousExport(src source, export dbContinuousExport) []string {
+	details := []string{}
+	if export.ExternalTableName != src.decl.source {
+		details = append(details, fmt.Sprintf(
+			"target external table changed from '%s' to '%s'", export.ExternalTableName, src.decl.source))
+	}
+
+	if normalizeWhitespace(export.Query) != normalizeWhitespace(query(src.decl.body)) {
+		details = append(details, "query changed, the export will be replaced")
+	}
+
+	return details
+}
+
+// fetchContinuousExports retrieves the continuous exports in the database, by name.
+func fetchContinuousExports(ctx context.Context, client kustoClient, db string) (map[string]dbContinuousExport, error) {
+	exports := map[string]dbContinuousExport{}
+	err := mgmtRows(ctx, client, db, ".show continuous-exports", func(row *table.Row) error {
+		export := dbContinuousExport{}
+		if err := row.ToStruct(&export); err != nil {
+			return err
+		}
+		exports[export.Name] = export
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching continuous exports: %w", err)
+	}
+	return exports, nil
+}
+
+// exportDrifted returns true if the query of the deployed continuous export differs from the query of cmd,
+// the command that creates the export from source.
+func exportDrifted(exports map[string]dbContinuousExport, name string, cmd string) bool {
+	export, has := exports[name]
+	return has && normalizeWhitespace(export.Query) != normalizeWhitespace(exportQuery(cmd))
+}
+
+// replaceExport drops the continuous export of the name, and creates it from source with cmd,
+// after altering it with cmd was rejected with alterErr. execute executes a command.
+//
+// An error is returned if the export could not be dropped, or if it was dropped but could not be created,
+// in which case the export no longer exists.
+func replaceExport(name string, cmd string, alterErr error, execute func(cmd string) error) error {
+	if err := execute(dropExportCommand(name)); err != nil {
+		return fmt.Errorf("%w. Dropping the export to create it from source also failed: %v", alterErr, err)
+	}
+	if err := execute(cmd); err != nil {
+		return fmt.Errorf(
+			"the export was dropped, as altering its query failed: %v. Creating it from source failed, "+
+				"and the export no longer exists: %w", alterErr, err)
+	}
+	return nil
+}
+
+// dropExportCommand returns the command that drops the continuous export.
+func dropExportCommand(name string) string {
+	return fmt.Sprintf(".drop continuous-export %s ifexists", quoteName(name))
+}
@@ -0,0 +1,120 @@
+package ksd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_exportQuery(t *testing.T) {
+	decls, err := parse(strings.NewReader("// @intervalBetweenRuns 1h\nlet Export = continuous_export(Archive) {\n    Logs\n    | take 10\n}"))
+	require.NoError(t, err)
+
+	cmds, err := commands(decls[0], "exports")
+	require.NoError(t, err)
+	require.Len(t, cmds, 1)
+	assert.Equal(t, "\n    Logs\n    | take 10", exportQuery(cmds[0]))
+}
+
+func TestBuild_ContinuousExportTarget(t *testing.T) {
+	srcRoot := t.TempDir()
+	files := map[string]string{
+		"tables/Archive.csl": "let Archive = datatable(Message:string)[]",
+		"exports/Export.csl": "// @intervalBetweenRuns 1h\nlet Export = continuous_export(Archive) { Archive }",
+	}
+	for name, content := range files {
+		path := filepath.Join(srcRoot, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	}
+
+	_, err := Build(srcRoot, filepath.Join(srcRoot, OutDir), BuildOptions{})
+	require.EqualError(
+		t, err, filepath.Join("exports", "Export.csl")+":2:5: continuous export target 'Archive' is declared as a table")
+}
+
+func Test_syncEntity_driftedExport(t *testing.T) {
+	srcRoot := t.TempDir()
+	outRoot := filepath.Join(srcRoot, OutDir)
+	writeSources(t, srcRoot, map[string]string{
+		"exports/Export.csl": "// @intervalBetweenRuns 1h\nlet Export = continuous_export(Archive) { Logs }",
+	})
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		// the commands that are rejected
+		rejected map[string]bool
+		msg      string
+		err      string
+		commands []string
+	}{
+		{"altered", nil, "Synced continuous-export Export in exports/Export.csl", "", []string{"create"}},
+		{
+			"replaced",
+			map[string]bool{"create": true},
+			"Replaced continuous-export Export in exports/Export.csl: the deployed query differed from source",
+			"",
+			[]string{"create", "drop", "create"},
+		},
+		{
+			"dropped",
+			map[string]bool{"create": true, "recreate": true},
+			"",
+			"the export was dropped, as altering its query failed: rejected. " +
+				"Creating it from source failed, and the export no longer exists: rejected",
+			[]string{"create", "drop", "create"},
+		},
+		{
+			"notDropped",
+			map[string]bool{"create": true, "drop": true},
+			"",
+			"rejected. Dropping the export to create it from source also failed: rejected",
+			[]string{"create", "drop"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := []string{}
+			client := &fakeClient{mgmt: func(command string) error {
+				kind := "create"
+				if strings.HasPrefix(command, ".drop") {
+					kind = "drop"
+				}
+				rejected := tt.rejected[kind]
+				if kind == "create" && len(commands) > 0 {
+					rejected = tt.rejected["recreate"]
+				}
+				commands = append(commands, kind)
+				if rejected {
+					return errors.New("rejected")
+				}
+				return nil
+			}}
+			s := &syncer{client: client, db: "db", root: outRoot, throttle: newThrottle()}
+			s.exportsOnce.Do(func() {
+				s.exports = map[string]dbContinuousExport{"Export": {Name: "Export", Query: "Logs | take 1"}}
+			})
+
+			outcome := s.syncEntity(context.Background(), m.Entities[0])
+			require.NoError(t, outcome.fatal)
+			if tt.err == "" {
+				require.NoError(t, outcome.err)
+				assert.Equal(t, filepath.FromSlash(tt.msg), outcome.msg)
+			} else {
+				require.Error(t, outcome.err)
+				assert.Contains(t, outcome.err.Error(), tt.err)
+			}
+			assert.Equal(t, tt.commands, commands)
+		})
+	}
+}
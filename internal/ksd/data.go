@@ -0,0 +1,193 @@
+package ksd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// dataMode is how the literal rows of a table declaration are synced.
+type dataMode uint8
+
+const (
+	// rows are not synced
+	dataNone dataMode = iota
+	// rows replace the data in the table, using '.set-or-replace'
+	dataReplace
+	// rows are appended to the data in the table, using '.set-or-append'.
+	// Appending is not idempotent, and so the rows are only appended again when they changed
+	// since they were recorded in StateTable.
+	dataAppend
+)
+
+// applyDataAnnotation applies '// @data replace' or '// @data append'.
+func applyDataAnnotation(decl *declaration, a annotation) error {
+	switch a.value {
+	case "replace":
+		decl.dataMode = dataReplace
+	case "append":
+		decl.dataMode = dataAppend
+	default:
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@data'. Allowed values: replace, append", a.value)
+	}
+	return nil
+}
+
+// dataCommand returns the command that loads the rows of the table declaration,
+// or an empty string if the rows are not synced.
+func dataCommand(decl *declaration) string {
+	switch decl.dataMode {
+	case dataReplace:
+		return fmt.Sprintf(".set-or-replace %s <| datatable%s\n[\n    %s\n]", quoteName(decl.name), decl.signature, decl.rows)
+	case dataAppend:
+		if decl.rows == "" {
+			return ""
+		}
+		return fmt.Sprintf(".set-or-append %s <| datatable%s\n[\n    %s\n]", quoteName(decl.name), decl.signature, decl.rows)
+	default:
+		return ""
+	}
+}
+
+// isAppendCommand returns true if cmd is the '.set-or-append' command that appends the rows of a table.
+func isAppendCommand(cmd string) bool {
+	return strings.HasPrefix(cmd, ".set-or-append ")
+}
+
+// appendCommands returns the commands that append the rows of a table, of the commands of an entity.
+func appendCommands(cmds []string) []string {
+	var appends []string
+	for _, cmd := range cmds {
+		if isAppendCommand(cmd) {
+			appends = append(appends, cmd)
+		}
+	}
+	return appends
+}
+
+// withoutAppend returns the entity without the '.set-or-append' command that appends the rows of a table,
+// given the commands of the entity.
+func withoutAppend(e manifestEntity, cmds []string) manifestEntity {
+	if len(e.Commands) != len(cmds) {
+		return e
+	}
+
+	kept := make([]manifestCommand, 0, len(e.Commands))
+	for i, cmd := range cmds {
+		if !isAppendCommand(cmd) {
+			kept = append(kept, e.Commands[i])
+		}
+	}
+	e.Commands = kept
+	return e
+}
+
+// parseRows parses the literal values of a datatable, after the opening '[',
+// up to and including the closing ']'.
+//
+// Each value is verified to be a literal of the type of its column.
+// The number of values must be a multiple of the number of columns.
+func parseRows(s *scanner, columns []column) (values int, err error) {
+	for {
+		s.skipSpace()
+		if s.accept(']') {
+			break
+		}
+
+		if s.eof() {
+			return 0, s.errorf("unmatched brackets, missing ']' for end of table body")
+		}
+
+		row, col := s.row, s.col
+		start := s.pos
+		value := s.src[start:s.skipExpression(true)]
+		if value == "" {
+			return 0, s.errorf("expected value, found %s", s.describe())
+		}
+
+		if len(columns) > 0 {
+			column := columns[values%len(columns)]
+			if err := checkLiteral(value, column); err != nil {
+				return 0, newParseError(row, col, "%s", err.Error())
+			}
+		}
+		values++
+
+		s.skipSpace()
+		if !s.accept(',') && !s.tok().is("]") {
+			return 0, s.errorf("expected ',' or ']' after value, found %s", s.describe())
+		}
+	}
+
+	if len(columns) == 0 && values > 0 {
+		return 0, s.errorf("datatable without columns cannot have values")
+	}
+
+	if len(columns) > 0 && values%len(columns) != 0 {
+		return 0, s.errorf(
+			"datatable has %d values, which is not a multiple of the number of columns (%d)", values, len(columns))
+	}
+
+	return values, nil
+}
+
+var (
+	intLiteral      = regexp.MustCompile(`^[+-]?(\d+|0x[0-9a-fA-F]+)$`)
+	realLiteral     = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+	timespanLiteral = regexp.MustCompile(
+		`^[+-]?(\d+\.?\d*|\.\d+)(d|h|m|s|ms|microsecond|microseconds|tick|ticks|` +
+			`day|days|hour|hours|minute|minutes|second|seconds|millisecond|milliseconds)$`)
+	stringLiteral = regexp.MustCompile(`^[hH]?@?('|"|` + "```" + `)`)
+	typedLiteral  = regexp.MustCompile(`^([a-z]+)\s*\(`)
+)
+
+// checkLiteral verifies that value is a literal of the type of the column.
+func checkLiteral(value string, column column) error {
+	typ, _ := canonicalType(column.typ)
+	mismatch := func() error {
+		return fmt.Errorf("value %s does not match type '%s' of column '%s'", value, column.typ, column.name)
+	}
+
+	// typed literals, i.e. datetime(2023-01-01), int(null), dynamic({"a": 1})
+	if m := typedLiteral.FindStringSubmatch(value); m != nil && strings.HasSuffix(value, ")") {
+		literalType, ok := canonicalType(m[1])
+		if !ok {
+			return fmt.Errorf("value %s is not a literal. Only literal values are allowed in datatable", value)
+		}
+
+		if literalType != typ {
+			return mismatch()
+		}
+		return nil
+	}
+
+	switch {
+	case stringLiteral.MatchString(value):
+		if typ != "string" {
+			return mismatch()
+		}
+	case strings.EqualFold(value, "true") || strings.EqualFold(value, "false"):
+		if typ != "bool" {
+			return mismatch()
+		}
+	case intLiteral.MatchString(value):
+		if typ != "int" && typ != "long" && typ != "real" && typ != "decimal" {
+			return mismatch()
+		}
+	case realLiteral.MatchString(value):
+		if typ != "real" && typ != "decimal" {
+			return mismatch()
+		}
+	case timespanLiteral.MatchString(value):
+		if typ != "timespan" {
+			return mismatch()
+		}
+	case value == "null":
+		return fmt.Errorf("untyped null for column '%s'. Use a typed null instead, i.e. %s(null)", column.name, typ)
+	default:
+		return fmt.Errorf("value %s is not a literal. Only literal values are allowed in datatable", value)
+	}
+
+	return nil
+}
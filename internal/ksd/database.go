@@ -0,0 +1,240 @@
+package ksd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+)
+
+// dbFunction is a stored function, as returned by '.show functions'.
+type dbFunction struct {
+	Name       string
+	Parameters string
+	Body       string
+	Folder     string
+	DocString  string
+}
+
+// dbColumn is a column of a table in the database schema.
+type dbColumn struct {
+	Name      string
+	CslType   string
+	DocString string
+}
+
+// dbTable is a table, as returned by '.show database schema as json'.
+type dbTable struct {
+	Name           string
+	Folder         string
+	DocString      string
+	OrderedColumns []dbColumn
+}
+
+// dbMaterializedView is a materialized view, as returned by '.show database schema as json'.
+type dbMaterializedView struct {
+	Name        string
+	SourceTable string
+	Query       string
+	Folder      string
+	DocString   string
+}
+
+// dbExternalTable is an external table, as returned by '.show database schema as json'.
+type dbExternalTable struct {
+	Name           string
+	Folder         string
+	DocString      string
+	OrderedColumns []dbColumn
+}
+
+// dbContinuousExport is a continuous export, as returned by '.show continuous-exports'.
+type dbContinuousExport struct {
+	Name              string
+	ExternalTableName string
+	Query             string
+}
+
+// dbState is the state of the entities that ksd manages in a database.
+type dbState struct {
+	functions map[string]dbFunction
+	tables    map[string]dbTable
+	views     map[string]dbMaterializedView
+	externals map[string]dbExternalTable
+	exports   map[string]dbContinuousExport
+	// policies, as JSON, by the name of the policy declaration
+	policies map[string]string
+}
+
+// fetchState retrieves the functions, tables, materialized views, external tables and continuous exports
+// currently in the database.
+func fetchState(ctx context.Context, client kustoClient, db string) (*dbState, error) {
+	state := &dbState{
+		functions: map[string]dbFunction{},
+		tables:    map[string]dbTable{},
+		views:     map[string]dbMaterializedView{},
+		externals: map[string]dbExternalTable{},
+		exports:   map[string]dbContinuousExport{},
+		policies:  map[string]string{},
+	}
+
+	err := mgmtRows(ctx, client, db, ".show functions", func(row *table.Row) error {
+		fn := dbFunction{}
+		if err := row.ToStruct(&fn); err != nil {
+			return err
+		}
+		state.functions[fn.Name] = fn
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching functions: %w", err)
+	}
+
+	type schemaRow struct {
+		DatabaseSchema string
+	}
+	type databaseSchema struct {
+		Databases map[string]struct {
+			Tables            map[string]dbTable
+			MaterializedViews map[string]dbMaterializedView
+			ExternalTables    map[string]dbExternalTable
+		}
+	}
+
+	err = mgmtRows(ctx, client, db, ".show database schema as json", func(row *table.Row) error {
+		res := schemaRow{}
+		if err := row.ToStruct(&res); err != nil {
+			return err
+		}
+
+		schema := databaseSchema{}
+		if err := json.Unmarshal([]byte(res.DatabaseSchema), &schema); err != nil {
+			return fmt.Errorf("parsing schema: %w", err)
+		}
+
+		for _, database := range schema.Databases {
+			for name, table := range database.Tables {
+				state.tables[name] = table
+			}
+			for name, view := range database.MaterializedViews {
+				state.views[name] = view
+			}
+			for name, external := range database.ExternalTables {
+				state.externals[name] = external
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching schema: %w", err)
+	}
+
+	state.exports, err = fetchContinuousExports(ctx, client, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// fetchPolicies retrieves the policies of the tables and of the database into state.
+func fetchPolicies(ctx context.Context, client kustoClient, db string, state *dbState) error {
+	type policyRow struct {
+		EntityName string
+		Policy     string
+	}
+	fetch := func(command string, name func(entityName string) string) error {
+		return mgmtRows(ctx, client, db, command, func(row *table.Row) error {
+			res := policyRow{}
+			if err := row.ToStruct(&res); err != nil {
+				return err
+			}
+
+			if res.Policy != "" && res.Policy != "null" {
+				state.policies[name(res.EntityName)] = res.Policy
+			}
+			return nil
+		})
+	}
+
+	kinds := append([]policyKind{{kind: "update"}}, policyKinds...)
+	for _, k := range kinds {
+		k := k
+		err := fetch(fmt.Sprintf(".show table * policy %s", k.kind), func(entityName string) string {
+			return policyName(entityTable(entityName), k.kind)
+		})
+		if err != nil {
+			return fmt.Errorf("fetching %s policies: %w", k.kind, err)
+		}
+
+		if !k.database {
+			continue
+		}
+		err = fetch(fmt.Sprintf(".show database %s policy %s", quoteName(db), k.kind), func(string) string {
+			return policyName("", k.kind)
+		})
+		if err != nil {
+			return fmt.Errorf("fetching database %s policy: %w", k.kind, err)
+		}
+	}
+
+	return nil
+}
+
+// entityTable returns the table name of an entity name returned by '.show table policy', i.e. [db].[table].
+func entityTable(entityName string) string {
+	if i := strings.LastIndex(entityName, "].["); i != -1 {
+		entityName = entityName[i+3:]
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(entityName, "["), "]")
+}
+
+// mgmtRows runs the management command against the database, and calls f for each row returned.
+func mgmtRows(
+	ctx context.Context,
+	client kustoClient,
+	db string,
+	command string,
+	f func(row *table.Row) error) error {
+	query := kql.New("")
+	query.AddUnsafe(command)
+	iter, err := client.Mgmt(ctx, db, query)
+	if err != nil {
+		return err
+	}
+	defer iter.Stop()
+
+	return iter.DoOnRowOrError(func(row *table.Row, e *errors.Error) error {
+		if e != nil {
+			return e
+		}
+		return f(row)
+	})
+}
+
+// queryRows runs the query against the database, and calls f for each row returned.
+func queryRows(
+	ctx context.Context,
+	client kustoClient,
+	db string,
+	query string,
+	f func(row *table.Row) error) error {
+	stmt := kql.New("")
+	stmt.AddUnsafe(query)
+	iter, err := client.Query(ctx, db, stmt)
+	if err != nil {
+		return err
+	}
+	defer iter.Stop()
+
+	return iter.DoOnRowOrError(func(row *table.Row, e *errors.Error) error {
+		if e != nil {
+			return e
+		}
+		return f(row)
+	})
+}
@@ -0,0 +1,183 @@
+package ksd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Severity is the severity of a diagnostic.
+type Severity string
+
+const (
+	// SeverityError fails the build.
+	SeverityError Severity = "error"
+	// SeverityWarning is reported without failing the build, unless warnings are treated as errors.
+	SeverityWarning Severity = "warning"
+)
+
+// RuleBuild is the rule of the errors and warnings found by parsing and building source files.
+const RuleBuild = "build"
+
+// Diagnostic is an error or warning at a position in a source file.
+type Diagnostic struct {
+	Severity Severity
+	err      *ParseError
+	// the line of the source file at the position, shown as a snippet
+	line string
+}
+
+func newWarning(row int, col int, m string, args ...any) Diagnostic {
+	return Diagnostic{Severity: SeverityWarning, err: newParseError(row, col, m, args...)}
+}
+
+// File returns the path of the source file, relative to the source root.
+func (d Diagnostic) File() string {
+	return d.err.file
+}
+
+// Row returns the line of the position, starting at 1.
+func (d Diagnostic) Row() int {
+	return d.err.row
+}
+
+// Col returns the column of the position, starting at 1.
+func (d Diagnostic) Col() int {
+	return d.err.col
+}
+
+// Message returns the description of the diagnostic.
+func (d Diagnostic) Message() string {
+	return d.err.msg
+}
+
+// Rule returns the ID of the rule that reports the diagnostic, which is RuleBuild unless it is a lint rule.
+func (d Diagnostic) Rule() string {
+	if d.err.rule == "" {
+		return RuleBuild
+	}
+	return d.err.rule
+}
+
+// String returns the diagnostic as "file:row:col: severity: message", followed by " (rule)" for lint rules.
+func (d Diagnostic) String() string {
+	s := fmt.Sprintf("%s:%d:%d: %s: %s", d.err.file, d.err.row, d.err.col, d.Severity, d.err.msg)
+	if d.err.rule != "" {
+		s += " (" + d.err.rule + ")"
+	}
+	return s
+}
+
+// snippet returns the source line of the diagnostic, with a caret under the column.
+// An empty string is returned if the line is not known.
+func (d Diagnostic) snippet() string {
+	if d.line == "" {
+		return ""
+	}
+
+	// keep tabs in the indentation of the caret, so that it lines up with the line
+	var caret strings.Builder
+	col := 1
+	for _, r := range d.line {
+		if col >= d.err.col {
+			break
+		}
+		if r == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+		col++
+	}
+	caret.WriteRune('^')
+	return "    " + d.line + "\n    " + caret.String() + "\n"
+}
+
+// Diagnostics are the errors and warnings found in source files, in the order they were found.
+type Diagnostics []Diagnostic
+
+// Count returns the number of diagnostics with the severity.
+func (d Diagnostics) Count(severity Severity) int {
+	count := 0
+	for _, diag := range d {
+		if diag.Severity == severity {
+			count++
+		}
+	}
+	return count
+}
+
+// WriteText writes each diagnostic, followed by a snippet of the source line.
+func (d Diagnostics) WriteText(w io.Writer) error {
+	var b strings.Builder
+	for _, diag := range d {
+		b.WriteString(diag.String())
+		b.WriteString("\n")
+		b.WriteString(diag.snippet())
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// err returns the errors, joined, or nil if there are none.
+func (d Diagnostics) err() error {
+	errs := []error{}
+	for _, diag := range d {
+		if diag.Severity == SeverityError {
+			errs = append(errs, diag.err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// add appends err as an error diagnostic in the file rel if it is a ParseError.
+// Other errors are returned, as they are not caused by the contents of a source file.
+func (d *Diagnostics) add(rel string, err error) error {
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		return err
+	}
+
+	if parseErr.file == "" {
+		parseErr.file = rel
+	}
+	*d = append(*d, Diagnostic{Severity: SeverityError, err: parseErr})
+	return nil
+}
+
+// addErrors appends each error as an error diagnostic.
+func (d *Diagnostics) addErrors(errs []*ParseError) {
+	for _, err := range errs {
+		*d = append(*d, Diagnostic{Severity: SeverityError, err: err})
+	}
+}
+
+// addAll appends the diagnostics of the file rel.
+func (d *Diagnostics) addAll(rel string, diags Diagnostics) {
+	for _, diag := range diags {
+		diag.err.file = rel
+		*d = append(*d, diag)
+	}
+}
+
+// readLines sets the source line of each diagnostic, reading the files under srcRoot.
+func (d Diagnostics) readLines(srcRoot string) {
+	files := map[string][]string{}
+	for i, diag := range d {
+		lines, has := files[diag.File()]
+		if !has {
+			content, err := os.ReadFile(filepath.Join(srcRoot, diag.File()))
+			if err == nil {
+				lines = strings.Split(string(content), "\n")
+			}
+			files[diag.File()] = lines
+		}
+
+		if diag.Row() >= 1 && diag.Row() <= len(lines) {
+			d[i].line = strings.TrimRight(lines[diag.Row()-1], "\r")
+		}
+	}
+}
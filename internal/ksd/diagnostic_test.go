@@ -0,0 +1,143 @@
+package ksd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseFile_recover(t *testing.T) {
+	input := `let A = (a:int { a }
+
+// doc of B
+// @folder Shared
+let B = () { print 1 }
+
+let C = datatable(a:datatime)[]
+  let D = () { 1 } // not at the start of the line
+// @intervalBetweenRuns 1h
+let E = continuous_export(Archive) { T }`
+	decls, diags := parseFile(input)
+
+	names := []string{}
+	for _, decl := range decls {
+		names = append(names, decl.name)
+	}
+	assert.Equal(t, []string{"B", "E"}, names)
+	assert.Equal(t, "doc of B", decls[0].doc)
+	assert.Equal(t, "Shared", decls[0].folder)
+
+	positions := []string{}
+	for _, d := range diags {
+		positions = append(positions, d.String())
+	}
+	assert.Equal(t, []string{
+		":1:16: error: expected ',' or ')' after parameter 'a', found '{'",
+		":7:21: error: unknown type 'datatime'. Did you mean 'datetime'?",
+	}, positions)
+}
+
+func Test_parseFile_warning(t *testing.T) {
+	decls, diags := parseFile("let T = datatable(a:int)[1, 2]")
+	require.Len(t, decls, 1)
+	require.Len(t, diags, 1)
+	assert.Equal(t, SeverityWarning, diags[0].Severity)
+	assert.Equal(t, 1, diags[0].Row())
+	assert.Equal(t, 5, diags[0].Col())
+	assert.NoError(t, diags.err())
+}
+
+func writeSources(t *testing.T, srcRoot string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(srcRoot, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	}
+}
+
+func TestBuild_Diagnostics(t *testing.T) {
+	srcRoot := t.TempDir()
+	writeSources(t, srcRoot, map[string]string{
+		"functions/A.csl": "let A = (a:int) {\n\tprint b:strin\n}\nlet B = (x:strin) { x }",
+		"tables/T.csl":    "// @data merge\nlet T = datatable(a:int)[]",
+		"tables/U.csl":    "let U = datatable(a:int)[1]",
+	})
+
+	outRoot := filepath.Join(srcRoot, OutDir)
+	diags, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.Error(t, err)
+	assert.Equal(t, 2, diags.Count(SeverityError))
+	assert.Equal(t, 1, diags.Count(SeverityWarning))
+	assert.NoDirExists(t, outRoot)
+
+	b := &strings.Builder{}
+	require.NoError(t, diags.WriteText(b))
+	expected := filepath.Join("functions", "A.csl") + ":4:12: error: unknown type 'strin'. Did you mean 'string'?\n" +
+		"    let B = (x:strin) { x }\n" +
+		"               ^\n" +
+		filepath.Join("tables", "T.csl") + ":1:4: error: invalid value 'merge' for '@data'. Allowed values: replace, append\n" +
+		"    // @data merge\n" +
+		"       ^\n" +
+		filepath.Join("tables", "U.csl") + ":1:5: warning: rows within datatable are not synced unless the table is " +
+		"annotated with '// @data replace' or '// @data append', and are ignored\n" +
+		"    let U = datatable(a:int)[1]\n" +
+		"        ^\n"
+	assert.Equal(t, expected, b.String())
+}
+
+func TestBuild_CrossFileDiagnostics(t *testing.T) {
+	srcRoot := t.TempDir()
+	writeSources(t, srcRoot, map[string]string{
+		"tables/Events.csl":   "// @updatePolicy Source=Raw Function=Parse\nlet Events = datatable(a:int)[]",
+		"tables/Archive.csl":  "let Archive = datatable(a:int)[]",
+		"exports/Export.csl":  "// @intervalBetweenRuns 1h\nlet Export = continuous_export(Archive) { Events }",
+		"functions/A.csl":     "let A = () { B }",
+		"functions/B.csl":     "let B = () { A }",
+		"functions/Dup.csl":   "let Dup = () { print 1 }",
+		"functions/x/Dup.csl": "let Dup = () { print 2 }",
+	})
+
+	outRoot := filepath.Join(srcRoot, OutDir)
+	diags, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.Error(t, err)
+	assert.NoDirExists(t, outRoot)
+
+	messages := []string{}
+	for _, d := range diags {
+		messages = append(messages, d.String())
+	}
+	assert.Equal(t, []string{
+		filepath.Join("tables", "Events.csl") + ":1:4: error: update policy source table 'Raw' is not declared",
+		filepath.Join("tables", "Events.csl") + ":1:4: error: update policy function 'Parse' is not declared",
+		filepath.Join("exports", "Export.csl") + ":2:5: error: continuous export target 'Archive' is declared as a table",
+		filepath.Join("functions", "x", "Dup.csl") + ":1:5: error: Dup is declared in both " +
+			filepath.Join("functions", "Dup.csl") + " and " + filepath.Join("functions", "x", "Dup.csl"),
+		filepath.Join("functions", "A.csl") + ":1:5: error: dependency cycle between declarations: A (" +
+			filepath.Join("functions", "A.csl") + ") -> B (" + filepath.Join("functions", "B.csl") + ") -> A (" +
+			filepath.Join("functions", "A.csl") + ")",
+	}, messages)
+}
+
+func TestBuild_Strict(t *testing.T) {
+	srcRoot := t.TempDir()
+	writeSources(t, srcRoot, map[string]string{"U.csl": "let U = datatable(a:int)[1]"})
+
+	outRoot := filepath.Join(srcRoot, OutDir)
+	diags, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, diags.Count(SeverityWarning))
+
+	diags, err = Build(srcRoot, outRoot, BuildOptions{Strict: true})
+	require.Error(t, err)
+	assert.Equal(t, 1, diags.Count(SeverityError))
+	assert.Equal(t, 0, diags.Count(SeverityWarning))
+}
+
+func TestDiagnostic_snippetTabs(t *testing.T) {
+	d := Diagnostic{Severity: SeverityError, err: newParseError(1, 4, "msg"), line: "\t\tab"}
+	assert.Equal(t, "    \t\tab\n    \t\t ^\n", d.snippet())
+}
@@ -0,0 +1,321 @@
+package ksd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	storageKind = "storage"
+	sqlKind     = "sql"
+)
+
+// externalOptions are the options of an external table declaration, set by annotations.
+type externalOptions struct {
+	// the kind of external table, storage or sql
+	kind string
+	// the data format of the files in storage, i.e. parquet
+	dataFormat string
+	// the connection strings of the storage containers, or of the SQL database.
+	// Secrets are referenced by placeholders, i.e. ${env:STORAGE_KEY}.
+	connections []string
+	// the partitions of a storage table, i.e. Date:datetime = bin(Timestamp, 1d)
+	partitionBy string
+	// the path format of a partitioned storage table, i.e. "year=" datetime_pattern("yyyy", Date)
+	pathFormat string
+	// the file extension of the files in storage, i.e. .parquet
+	fileExtension string
+	// whether csv and tsv files have headers, i.e. All
+	includeHeaders string
+	// the table in the SQL database
+	sqlTable string
+}
+
+var dataFormats = []string{
+	"csv", "tsv", "tsve", "psv", "scsv", "sohsv", "txt", "raw",
+	"json", "multijson", "parquet", "avro", "apacheavro", "orc", "w3clogfile",
+}
+
+var (
+	// secretPlaceholder references a secret in a connection string, i.e. ${env:STORAGE_KEY}
+	secretPlaceholder = regexp.MustCompile(`\$\{env:([A-Za-z_][A-Za-z0-9_]*)\}`)
+	// sqlSecret matches SQL connection strings that contain a password
+	sqlSecret = regexp.MustCompile(`(?i)(password|pwd)\s*=\s*[^;\s]`)
+)
+
+// parseExternalTable parses the schema of an external table that starts at the cursor, i.e.:
+//
+//	(col:type, col:type)
+func parseExternalTable(s *scanner, decl *declaration) error {
+	start := s.pos
+	if !s.accept('(') {
+		return s.errorf("expected '(' for external table schema, found %s", s.describe())
+	}
+
+	columns, _, err := parseSchema(s, false)
+	if err != nil {
+		return err
+	}
+	decl.signature = s.src[start:s.pos]
+	decl.columns = columns
+	decl.external.kind = storageKind
+
+	return s.expectEnd("external table schema")
+}
+
+// checkExternalTable verifies that the annotations of an external table declaration are complete,
+// and apply to its kind.
+func checkExternalTable(decl *declaration) error {
+	opts := decl.external
+	if len(opts.connections) == 0 {
+		return newParseError(
+			decl.row, decl.col, "external table '%s' must declare a connection string with '// @connection'", decl.name)
+	}
+
+	// annotations that only apply to the other kind of external table
+	var invalid []string
+	switch opts.kind {
+	case storageKind:
+		if opts.dataFormat == "" {
+			return newParseError(
+				decl.row, decl.col, "external table '%s' must declare a data format with '// @dataFormat'", decl.name)
+		}
+		invalid = []string{"sqlTable"}
+	case sqlKind:
+		if opts.sqlTable == "" {
+			return newParseError(
+				decl.row, decl.col, "external table '%s' must declare the SQL table with '// @sqlTable'", decl.name)
+		}
+		if len(opts.connections) > 1 {
+			a := findAnnotations(decl, "connection")[1]
+			return newParseError(a.row, a.col, "a sql external table must declare a single connection string")
+		}
+		invalid = []string{"dataFormat", "partitionBy", "pathFormat", "fileExtension", "includeHeaders"}
+	}
+
+	for _, name := range invalid {
+		if found := findAnnotations(decl, name); len(found) > 0 {
+			return newParseError(
+				found[0].row, found[0].col, "'@%s' cannot be declared on a %s external table", name, opts.kind)
+		}
+	}
+
+	if opts.pathFormat != "" && opts.partitionBy == "" {
+		a := findAnnotations(decl, "pathFormat")[0]
+		return newParseError(a.row, a.col, "'@pathFormat' requires the partitions to be declared with '// @partitionBy'")
+	}
+
+	for i, a := range findAnnotations(decl, "connection") {
+		if containsSecret(opts.kind, opts.connections[i]) {
+			return newParseError(
+				a.row, a.col,
+				"connection string contains a secret. Reference the secret with a placeholder, i.e. ${env:STORAGE_KEY}")
+		}
+	}
+
+	return nil
+}
+
+// containsSecret returns true if the connection string of the kind of external table contains
+// a secret that is not referenced by a placeholder.
+func containsSecret(kind string, connection string) bool {
+	connection = secretPlaceholder.ReplaceAllString(connection, "")
+	if kind == sqlKind {
+		return sqlSecret.MatchString(connection)
+	}
+
+	// storage connection strings are a URI, followed by an optional ';' and the credentials,
+	// where a shared access signature is part of the URI
+	uri, credentials, _ := strings.Cut(connection, ";")
+	if strings.Contains(strings.ToLower(uri), "sig=") {
+		return true
+	}
+	credentials = strings.ToLower(credentials)
+	return credentials != "" && credentials != "impersonate" && !strings.HasPrefix(credentials, "managed_identity=")
+}
+
+// findAnnotations returns the annotations of the declaration with the given name.
+func findAnnotations(decl *declaration, name string) []annotation {
+	found := []annotation{}
+	for _, a := range decl.annotations {
+		if a.name == name {
+			found = append(found, a)
+		}
+	}
+	return found
+}
+
+// externalTableClauses returns the clauses of the '.create-or-alter external table' command
+// that follow the schema, up to the 'with' properties.
+func externalTableClauses(opts externalOptions) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "kind=%s\n", opts.kind)
+	if opts.kind == sqlKind {
+		fmt.Fprintf(&b, "table=%s\n", opts.sqlTable)
+	}
+	if opts.partitionBy != "" {
+		fmt.Fprintf(&b, "partition by (%s)\n", opts.partitionBy)
+	}
+	if opts.pathFormat != "" {
+		fmt.Fprintf(&b, "pathformat=(%s)\n", opts.pathFormat)
+	}
+	if opts.dataFormat != "" {
+		fmt.Fprintf(&b, "dataformat=%s\n", opts.dataFormat)
+	}
+
+	b.WriteString("(\n")
+	for i, c := range opts.connections {
+		if i > 0 {
+			b.WriteString(",\n")
+		}
+		// h@'' is an obfuscated string literal, which the service hides in its logs and traces
+		fmt.Fprintf(&b, "    h@'%s'", c)
+	}
+	b.WriteString("\n)\n")
+	return b.String()
+}
+
+// externalTableProperties returns the properties of the '.create-or-alter external table' command,
+// after folder and docstring.
+func externalTableProperties(opts externalOptions) string {
+	var b strings.Builder
+	if opts.fileExtension != "" {
+		fmt.Fprintf(&b, ",fileExtension=\"%s\"", escapeString(opts.fileExtension))
+	}
+	if opts.includeHeaders != "" {
+		fmt.Fprintf(&b, ",includeHeaders=\"%s\"", opts.includeHeaders)
+	}
+	return b.String()
+}
+
+// applyKindAnnotation applies '// @kind storage|sql'.
+func applyKindAnnotation(decl *declaration, a annotation) error {
+	if a.value != storageKind && a.value != sqlKind {
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@kind'. Allowed values: %s, %s", a.value, storageKind, sqlKind)
+	}
+	decl.external.kind = a.value
+	return nil
+}
+
+// applyDataFormatAnnotation applies '// @dataFormat parquet'.
+func applyDataFormatAnnotation(decl *declaration, a annotation) error {
+	format := strings.ToLower(a.value)
+	for _, f := range dataFormats {
+		if f == format {
+			decl.external.dataFormat = format
+			return nil
+		}
+	}
+	return newParseError(
+		a.row, a.col, "invalid value '%s' for '@dataFormat'. Allowed values: %s", a.value, strings.Join(dataFormats, ", "))
+}
+
+// applyConnectionAnnotation applies '// @connection https://account.blob.core.windows.net/container;${env:KEY}'.
+// A storage external table may declare more than one connection string.
+func applyConnectionAnnotation(decl *declaration, a annotation) error {
+	if a.value == "" {
+		return newParseError(a.row, a.col, "missing connection string for '@connection'")
+	}
+	if strings.Contains(a.value, "'") {
+		return newParseError(a.row, a.col, "connection string for '@connection' must not contain \"'\"")
+	}
+	if strings.Contains(secretPlaceholder.ReplaceAllString(a.value, ""), "${") {
+		return newParseError(
+			a.row, a.col, "invalid placeholder in connection string. Expected ${env:NAME}, where NAME is an environment variable")
+	}
+	decl.external.connections = append(decl.external.connections, a.value)
+	return nil
+}
+
+// applyPartitionByAnnotation applies '// @partitionBy Date:datetime = bin(Timestamp, 1d), Tenant:string'.
+func applyPartitionByAnnotation(decl *declaration, a annotation) error {
+	if a.value == "" {
+		return newParseError(
+			a.row, a.col, "missing partitions for '@partitionBy'. Expected Name:type [= expression], ...")
+	}
+	decl.external.partitionBy = a.value
+	return nil
+}
+
+// applyPathFormatAnnotation applies '// @pathFormat "year=" datetime_pattern("yyyy", Date)'.
+func applyPathFormatAnnotation(decl *declaration, a annotation) error {
+	if a.value == "" {
+		return newParseError(a.row, a.col, "missing path format for '@pathFormat'")
+	}
+	decl.external.pathFormat = a.value
+	return nil
+}
+
+// applyFileExtensionAnnotation applies '// @fileExtension .parquet'.
+func applyFileExtensionAnnotation(decl *declaration, a annotation) error {
+	if a.value == "" || strings.ContainsAny(a.value, " \t") {
+		return newParseError(a.row, a.col, "invalid value '%s' for '@fileExtension'. Expected i.e. .parquet", a.value)
+	}
+	decl.external.fileExtension = a.value
+	return nil
+}
+
+// applyIncludeHeadersAnnotation applies '// @includeHeaders All|FirstFile|None'.
+func applyIncludeHeadersAnnotation(decl *declaration, a annotation) error {
+	switch a.value {
+	case "All", "FirstFile", "None":
+		decl.external.includeHeaders = a.value
+		return nil
+	default:
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@includeHeaders'. Allowed values: All, FirstFile, None", a.value)
+	}
+}
+
+// applySqlTableAnnotation applies '// @sqlTable [dbo].[Orders]'.
+func applySqlTableAnnotation(decl *declaration, a annotation) error {
+	if a.value == "" || strings.ContainsAny(a.value, " \t") {
+		return newParseError(a.row, a.col, "invalid value '%s' for '@sqlTable'. Expected i.e. [dbo].[Orders]", a.value)
+	}
+	decl.external.sqlTable = a.value
+	return nil
+}
+
+// substituteSecrets replaces the secret placeholders in cmd with the values returned by lookup.
+// The substituted values are returned, so that they can be redacted from errors.
+func substituteSecrets(cmd string, lookup func(name string) (string, bool)) (string, []string, error) {
+	secrets := []string{}
+	var missing []string
+	result := secretPlaceholder.ReplaceAllStringFunc(cmd, func(placeholder string) string {
+		name := secretPlaceholder.FindStringSubmatch(placeholder)[1]
+		value, ok := lookup(name)
+		if !ok || value == "" {
+			missing = append(missing, name)
+			return placeholder
+		}
+		secrets = append(secrets, value)
+		return value
+	})
+
+	if len(missing) > 0 {
+		return "", nil, fmt.Errorf("environment variable %s for secret placeholder is not set", missing[0])
+	}
+	for _, s := range secrets {
+		if strings.Contains(s, "'") {
+			return "", nil, fmt.Errorf("secret placeholder value must not contain \"'\"")
+		}
+	}
+	return result, secrets, nil
+}
+
+// redactSecrets replaces the secrets in the message of err, as errors returned by the service
+// may include the command that failed.
+func redactSecrets(err error, secrets []string) error {
+	msg := err.Error()
+	redacted := msg
+	for _, s := range secrets {
+		redacted = strings.ReplaceAll(redacted, s, "***")
+	}
+	if redacted == msg {
+		return err
+	}
+	return errors.New(redacted)
+}
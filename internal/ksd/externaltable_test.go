@@ -0,0 +1,151 @@
+package ksd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkExternalTable_errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		errMsg string
+	}{
+		{
+			"missingConnection",
+			"// @dataFormat csv\nlet Logs = external_table(a:int)",
+			"[2,5] external table 'Logs' must declare a connection string with '// @connection'",
+		},
+		{
+			"missingDataFormat",
+			"// @connection https://a.blob.core.windows.net/c\nlet Logs = external_table(a:int)",
+			"[2,5] external table 'Logs' must declare a data format with '// @dataFormat'",
+		},
+		{
+			"missingSqlTable",
+			"// @kind sql\n// @connection Server=tcp:a;Database=b\nlet Orders = external_table(a:int)",
+			"[3,5] external table 'Orders' must declare the SQL table with '// @sqlTable'",
+		},
+		{
+			"sqlMultipleConnections",
+			"// @kind sql\n// @sqlTable Orders\n// @connection Server=a\n// @connection Server=b\nlet Orders = external_table(a:int)",
+			"[4,4] a sql external table must declare a single connection string",
+		},
+		{
+			"sqlDataFormat",
+			"// @kind sql\n// @sqlTable Orders\n// @dataFormat csv\n// @connection Server=a\nlet Orders = external_table(a:int)",
+			"[3,4] '@dataFormat' cannot be declared on a sql external table",
+		},
+		{
+			"storageSqlTable",
+			"// @sqlTable Orders\n// @dataFormat csv\n// @connection https://a\nlet Orders = external_table(a:int)",
+			"[1,4] '@sqlTable' cannot be declared on a storage external table",
+		},
+		{
+			"pathFormatWithoutPartitions",
+			"// @pathFormat Date\n// @dataFormat csv\n// @connection https://a\nlet Logs = external_table(a:int)",
+			"[1,4] '@pathFormat' requires the partitions to be declared with '// @partitionBy'",
+		},
+		{
+			"storageKey",
+			"// @dataFormat csv\n// @connection https://a.blob.core.windows.net/c;bXlrZXk=\nlet Logs = external_table(a:int)",
+			"[2,4] connection string contains a secret. Reference the secret with a placeholder, i.e. ${env:STORAGE_KEY}",
+		},
+		{
+			"storageSas",
+			"// @dataFormat csv\n// @connection https://a.blob.core.windows.net/c?sv=2021&sig=abc\nlet Logs = external_table(a:int)",
+			"[2,4] connection string contains a secret. Reference the secret with a placeholder, i.e. ${env:STORAGE_KEY}",
+		},
+		{
+			"sqlPassword",
+			"// @kind sql\n// @sqlTable Orders\n// @connection Server=a;User ID=b;Password=c\nlet Orders = external_table(a:int)",
+			"[3,4] connection string contains a secret. Reference the secret with a placeholder, i.e. ${env:STORAGE_KEY}",
+		},
+		{
+			"invalidPlaceholder",
+			"// @dataFormat csv\n// @connection https://a;${KEY}\nlet Logs = external_table(a:int)",
+			"[2,4] invalid placeholder in connection string. Expected ${env:NAME}, where NAME is an environment variable",
+		},
+		{
+			"quoteInConnection",
+			"// @dataFormat csv\n// @connection https://a/'c'\nlet Logs = external_table(a:int)",
+			"[2,4] connection string for '@connection' must not contain \"'\"",
+		},
+		{
+			"invalidKind",
+			"// @kind adls\nlet Logs = external_table(a:int)",
+			"[1,4] invalid value 'adls' for '@kind'. Allowed values: storage, sql",
+		},
+		{
+			"invalidDataFormat",
+			"// @dataFormat xml\nlet Logs = external_table(a:int)",
+			"[1,4] invalid value 'xml' for '@dataFormat'. Allowed values: csv, tsv, tsve, psv, scsv, sohsv, txt, raw, " +
+				"json, multijson, parquet, avro, apacheavro, orc, w3clogfile",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse(strings.NewReader(tt.input))
+			var parseErr *ParseError
+			require.ErrorAs(t, err, &parseErr)
+			assert.Equal(t, tt.errMsg, parseErr.Error())
+		})
+	}
+}
+
+func Test_containsSecret(t *testing.T) {
+	tests := []struct {
+		kind       string
+		connection string
+		expected   bool
+	}{
+		{storageKind, "https://a.blob.core.windows.net/c", false},
+		{storageKind, "https://a.blob.core.windows.net/c;impersonate", false},
+		{storageKind, "https://a.blob.core.windows.net/c;managed_identity=system", false},
+		{storageKind, "https://a.blob.core.windows.net/c;${env:KEY}", false},
+		{storageKind, "https://a.blob.core.windows.net/c?${env:SAS}", false},
+		{storageKind, "https://a.blob.core.windows.net/c;bXlrZXk=", true},
+		{storageKind, "https://a.blob.core.windows.net/c;token=abc", true},
+		{storageKind, "https://a.blob.core.windows.net/c?sv=2021&sig=abc", true},
+		{sqlKind, "Server=a;Database=b;Authentication=Active Directory Integrated", false},
+		{sqlKind, "Server=a;User ID=b;Password=${env:SQL_PASSWORD}", false},
+		{sqlKind, "Server=a;User ID=b;Password=c", true},
+		{sqlKind, "Server=a;User ID=b;pwd = c", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, containsSecret(tt.kind, tt.connection), tt.connection)
+	}
+}
+
+func Test_substituteSecrets(t *testing.T) {
+	env := map[string]string{"KEY": "s3cr3t", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	cmd, secrets, err := substituteSecrets("h@'https://a;${env:KEY}',\nh@'https://b;${env:KEY}'", lookup)
+	require.NoError(t, err)
+	assert.Equal(t, "h@'https://a;s3cr3t',\nh@'https://b;s3cr3t'", cmd)
+	assert.Equal(t, []string{"s3cr3t", "s3cr3t"}, secrets)
+
+	_, _, err = substituteSecrets("h@'https://a;${env:MISSING}'", lookup)
+	assert.EqualError(t, err, "environment variable MISSING for secret placeholder is not set")
+
+	_, _, err = substituteSecrets("h@'https://a;${env:EMPTY}'", lookup)
+	assert.EqualError(t, err, "environment variable EMPTY for secret placeholder is not set")
+}
+
+func Test_redactSecrets(t *testing.T) {
+	err := errors.New("bad request: .create-or-alter external table T (a:int) kind=storage (h@'https://a;s3cr3t')")
+	assert.EqualError(
+		t,
+		redactSecrets(err, []string{"s3cr3t"}),
+		"bad request: .create-or-alter external table T (a:int) kind=storage (h@'https://a;***')")
+
+	assert.Same(t, err, redactSecrets(err, []string{"other"}))
+}
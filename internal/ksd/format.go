@@ -0,0 +1,691 @@
+package ksd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// the indentation of each level of nesting
+	indentation = "    "
+	// the length of a function signature line, beyond which parameters are formatted one per line
+	maxSignatureLength = 100
+)
+
+// FormatOptions configures Format.
+type FormatOptions struct {
+	// Check only reports the files that are not formatted, without rewriting them.
+	Check bool
+	// OutRoot is the output directory, whose files are skipped.
+	OutRoot string
+	// Extensions are the file extensions of Kusto source files, i.e. .kql.
+	// Defaults to the extensions of IsKustoSourceFile.
+	Extensions []string
+}
+
+// Format formats the Kusto source files under srcRoot into the canonical layout, rewriting the files
+// that are not formatted. The paths of those files, relative to srcRoot, are returned.
+//
+// Files with errors are not formatted, and their errors are returned as diagnostics.
+// Files under opts.OutRoot, and any directory named OutDir, are skipped.
+func Format(srcRoot string, opts FormatOptions) ([]string, Diagnostics, error) {
+	srcRoot = filepath.Clean(srcRoot)
+	outRoot := ""
+	if opts.OutRoot != "" {
+		outRoot = filepath.Clean(opts.OutRoot)
+	}
+	changed := []string{}
+	diags := Diagnostics{}
+	err := filepath.WalkDir(srcRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if d.Name() == OutDir || path == outRoot {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !isSourceFile(filepath.Ext(path), opts.Extensions) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(srcRoot, path)
+		if err != nil {
+			return err
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		formatted, fileDiags, err := formatFile(string(content))
+		if err != nil {
+			return fmt.Errorf("formatting %s: %w", rel, err)
+		}
+		diags.addAll(rel, fileDiags)
+		if fileDiags.Count(SeverityError) > 0 || formatted == string(content) {
+			return nil
+		}
+
+		changed = append(changed, rel)
+		if opts.Check {
+			return nil
+		}
+		return os.WriteFile(path, []byte(formatted), d.Type().Perm())
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	diags.readLines(srcRoot)
+	return changed, diags, nil
+}
+
+// formatFile formats the contents of a Kusto source file into the canonical layout:
+//
+//   - declarations and groups of comments are separated by a single empty line
+//   - the comment block that precedes a declaration is kept with the declaration, unindented
+//   - the 'let' header is spaced as 'let Name = '
+//   - function parameters are listed on one line, or one per line when the signature is long or has comments
+//   - table columns are listed one per line, with trailing comments aligned
+//   - the rows of a table are listed one row per line, with values aligned
+//   - the lines of a body are indented by their nesting, so that pipes line up
+//
+// A declaration whose comments cannot be placed in the canonical layout is kept as written.
+// The contents are not formatted if they have errors, which are returned as diagnostics.
+// An error is returned if formatting would change the commands built from the file, other than in whitespace.
+func formatFile(content string) (string, Diagnostics, error) {
+	decls, diags := parseFile(content)
+	if diags.Count(SeverityError) > 0 {
+		return content, diags, nil
+	}
+
+	s, err := newScanner(content, 1, 1)
+	if err != nil {
+		return content, diags, err
+	}
+
+	chunks := []string{}
+	for {
+		start := s.i
+		comments := s.leadingComments()
+		groups := commentGroups(s.toks[start:s.i])
+		if s.eof() {
+			chunks = append(chunks, groups...)
+			break
+		}
+
+		// the last group is the comment block of the declaration, unless an empty line separates them
+		var block string
+		if len(comments) > 0 {
+			block = groups[len(groups)-1] + "\n"
+			groups = groups[:len(groups)-1]
+		}
+		chunks = append(chunks, groups...)
+
+		declStart := s.i
+		decl := &declaration{}
+		if err := parseDeclaration(s, decl); err != nil {
+			return content, diags, err
+		}
+		chunks = append(chunks, block+formatDeclaration(s.src, s.toks[declStart:s.i], decl))
+	}
+
+	formatted := strings.Join(chunks, "\n\n") + "\n"
+	after, afterDiags := parseFile(formatted)
+	if afterDiags.Count(SeverityError) > 0 || !sameCommands(decls, after) {
+		return content, diags, errors.New("formatting would change the declarations in the file")
+	}
+	return formatted, diags, nil
+}
+
+// commentGroups returns the groups of comment lines in toks, which only contain comments and whitespace.
+// Groups are separated by empty lines. Each comment is unindented, other than an indented '// @' line,
+// which is not an annotation and would become one if unindented.
+func commentGroups(toks []token) []string {
+	groups := []string{}
+	lines := []string{}
+	// an empty line is a line break that follows a line break, with only whitespace between them
+	newlines := 0
+	for i, t := range toks {
+		switch t.kind {
+		case tokenComment:
+			if newlines > 1 && len(lines) > 0 {
+				groups = append(groups, strings.Join(lines, "\n"))
+				lines = []string{}
+			}
+			_, annotation := parseAnnotation(t.text, t.row)
+			if annotation && i > 0 && toks[i-1].kind == tokenSpace {
+				lines = append(lines, toks[i-1].text+strings.TrimRight(t.text, " \t"))
+				newlines = 0
+				continue
+			}
+			lines = append(lines, formatComment(t.text))
+			newlines = 0
+		case tokenNewline:
+			newlines++
+		}
+	}
+	if len(lines) > 0 {
+		groups = append(groups, strings.Join(lines, "\n"))
+	}
+	return groups
+}
+
+// formatComment returns the comment with a space after '//', and without trailing whitespace.
+func formatComment(comment string) string {
+	comment = strings.TrimRight(comment, " \t")
+	text := strings.TrimPrefix(comment, "//")
+	if text != "" && !strings.HasPrefix(text, " ") && !strings.HasPrefix(text, "/") {
+		return "// " + text
+	}
+	return comment
+}
+
+// formatDeclaration formats the 'let' statement in toks. The declaration is kept as written
+// if it has comments that cannot be placed in the canonical layout.
+func formatDeclaration(src string, toks []token, decl *declaration) string {
+	f := &formatter{toks: toks}
+	formatted := f.declaration(decl)
+	if f.verbatim {
+		start, end := toks[0].pos, toks[len(toks)-1].end()
+		return strings.TrimRight(src[start:end], " \t\r\n")
+	}
+	return formatted
+}
+
+// formatter formats the tokens of a declaration.
+type formatter struct {
+	toks []token
+	i    int
+	// true if a comment was found that cannot be placed in the canonical layout
+	verbatim bool
+}
+
+// next returns the next token that is not whitespace, and advances past it.
+// A comment is unexpected, and so the declaration is kept as written.
+func (f *formatter) next() token {
+	for f.i < len(f.toks) && f.toks[f.i].trivia() {
+		if f.toks[f.i].kind == tokenComment {
+			f.verbatim = true
+		}
+		f.i++
+	}
+	if f.i == len(f.toks) {
+		return token{kind: tokenEOF}
+	}
+	f.i++
+	return f.toks[f.i-1]
+}
+
+// group returns the tokens between the bracket that was just read and its matching bracket,
+// and advances past the matching bracket.
+func (f *formatter) group() []token {
+	start := f.i
+	depth := 0
+	for ; f.i < len(f.toks); f.i++ {
+		t := f.toks[f.i]
+		switch {
+		case t.is("(") || t.is("[") || t.is("{"):
+			depth++
+		case t.is(")") || t.is("]") || t.is("}"):
+			if depth == 0 {
+				f.i++
+				return f.toks[start : f.i-1]
+			}
+			depth--
+		}
+	}
+	return f.toks[start:]
+}
+
+func (f *formatter) declaration(decl *declaration) string {
+	var b strings.Builder
+	f.next()
+	b.WriteString("let ")
+	name := f.next()
+	b.WriteString(name.text)
+	if name.is("[") {
+		b.WriteString(f.next().text)
+		b.WriteString(f.next().text)
+	}
+	f.next()
+	b.WriteString(" = ")
+
+	if decl.declType != functionType {
+		b.WriteString(f.next().text)
+	}
+	f.next()
+	inner := f.group()
+
+	switch decl.declType {
+	case functionType:
+		params := f.items(inner)
+		header := b.String()
+		single := "(" + joinItems(params, formatParameter) + ") {"
+		if len(header)+len(single) <= maxSignatureLength && !hasComments(params) {
+			b.WriteString("(" + joinItems(params, formatParameter) + ") ")
+		} else {
+			b.WriteString(formatList(params, formatParameter) + " ")
+		}
+		f.next()
+		b.WriteString(formatBody(f.group()))
+	case tableType:
+		columns := f.items(inner)
+		b.WriteString(formatList(columns, compact) + "\n")
+		f.next()
+		b.WriteString(f.rows(f.group(), len(decl.columns)))
+	case externalTableType:
+		b.WriteString(formatList(f.items(inner), compact))
+	case materializedViewType, continuousExportType:
+		b.WriteString("(" + compact(significant(inner)) + ") ")
+		f.next()
+		b.WriteString(formatBody(f.group()))
+	}
+
+	// an optional ';', and a trailing comment
+	for ; f.i < len(f.toks); f.i++ {
+		if t := f.toks[f.i]; t.kind == tokenComment {
+			b.WriteString(" " + strings.TrimRight(t.text, " \t"))
+		}
+	}
+	return b.String()
+}
+
+// item is a parameter, column or value in a comma-separated list.
+type item struct {
+	// the tokens of the item, from the first to the last token that is not whitespace
+	toks []token
+	// the comment lines before the item
+	leading []string
+	// the comment on the line of the item, before or after its ','
+	trailing string
+}
+
+// items splits toks into the items of a comma-separated list.
+// Comments within an item, other than trailing comments, cannot be placed in the canonical layout.
+func (f *formatter) items(toks []token) []item {
+	items := []item{}
+	current := item{}
+	// whether a line break follows the last token of the current item, or the ',' that follows it
+	newline := false
+	ended := false
+	depth := 0
+	for _, t := range toks {
+		switch {
+		case t.kind == tokenSpace || t.kind == tokenNewline:
+			// whitespace within an item separates its tokens
+			if len(current.toks) > 0 {
+				current.toks = append(current.toks, t)
+			}
+			newline = newline || t.kind == tokenNewline
+			continue
+		case t.kind == tokenComment:
+			switch {
+			case depth > 0:
+				f.verbatim = true
+			case len(current.toks) > 0 && !newline && current.trailing == "":
+				current.trailing = strings.TrimRight(t.text, " \t")
+			case ended && !newline && len(items) > 0 && items[len(items)-1].trailing == "":
+				items[len(items)-1].trailing = strings.TrimRight(t.text, " \t")
+			case len(current.toks) == 0 && (newline || len(items) == 0 && !ended):
+				current.leading = append(current.leading, strings.TrimRight(t.text, " \t"))
+			default:
+				f.verbatim = true
+			}
+			continue
+		case t.is(",") && depth == 0:
+			current.toks = trimTrivia(current.toks)
+			items = append(items, current)
+			current = item{}
+			newline = false
+			ended = true
+			continue
+		}
+
+		if current.trailing != "" {
+			// the item continues on the lines after its trailing comment
+			f.verbatim = true
+		}
+		switch {
+		case t.is("(") || t.is("[") || t.is("{"):
+			depth++
+		case t.is(")") || t.is("]") || t.is("}"):
+			depth--
+		}
+		current.toks = append(current.toks, t)
+		newline = false
+		ended = false
+	}
+
+	if len(current.toks) > 0 || len(current.leading) > 0 || len(items) > 0 {
+		if len(current.toks) == 0 && len(current.leading) > 0 {
+			// comments after the last item
+			f.verbatim = true
+		}
+		current.toks = trimTrivia(current.toks)
+		items = append(items, current)
+	}
+	return items
+}
+
+// trimTrivia removes the whitespace at the end of toks.
+func trimTrivia(toks []token) []token {
+	for len(toks) > 0 && toks[len(toks)-1].trivia() {
+		toks = toks[:len(toks)-1]
+	}
+	return toks
+}
+
+// rows formats the values of a table in toks, with columns values per row.
+func (f *formatter) rows(toks []token, columns int) string {
+	values := f.items(toks)
+	trailingComma := false
+	if len(values) > 0 && len(values[len(values)-1].toks) == 0 {
+		trailingComma = true
+		values = values[:len(values)-1]
+	}
+	if hasComments(values) {
+		f.verbatim = true
+	}
+	if len(values) == 0 || columns == 0 {
+		return "[]"
+	}
+
+	texts := make([]string, len(values))
+	widths := make([]int, columns)
+	for i, v := range values {
+		texts[i] = compact(v.toks)
+		if i < len(values)-1 || trailingComma {
+			texts[i] += ","
+		}
+		if w := len(texts[i]); w > widths[i%columns] {
+			widths[i%columns] = w
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("[\n")
+	for i, text := range texts {
+		if i%columns == 0 {
+			b.WriteString(indentation)
+		}
+		b.WriteString(text)
+		if i%columns == columns-1 || i == len(texts)-1 {
+			b.WriteString("\n")
+		} else {
+			b.WriteString(strings.Repeat(" ", widths[i%columns]-len(text)+1))
+		}
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// hasComments returns true if any of the items has a comment.
+func hasComments(items []item) bool {
+	for _, it := range items {
+		if len(it.leading) > 0 || it.trailing != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// joinItems formats the items on a single line.
+func joinItems(items []item, format func([]token) string) string {
+	texts := make([]string, 0, len(items))
+	for _, it := range items {
+		texts = append(texts, format(it.toks))
+	}
+	return strings.Join(texts, ", ")
+}
+
+// formatList formats the items one per line between parentheses, aligning the trailing comments.
+func formatList(items []item, format func([]token) string) string {
+	if len(items) == 0 {
+		return "()"
+	}
+
+	texts := make([]string, len(items))
+	width := 0
+	for i, it := range items {
+		texts[i] = format(it.toks)
+		if i < len(items)-1 {
+			texts[i] += ","
+		}
+		if it.trailing != "" && len(texts[i]) > width {
+			width = len(texts[i])
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("(\n")
+	for i, it := range items {
+		for _, c := range it.leading {
+			b.WriteString(indentation + c + "\n")
+		}
+		b.WriteString(indentation + texts[i])
+		if it.trailing != "" {
+			b.WriteString(strings.Repeat(" ", width-len(texts[i])+1) + it.trailing)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// formatParameter formats a parameter as 'name:type', followed by ' = default' if it has a default value.
+func formatParameter(toks []token) string {
+	depth := 0
+	for i, t := range toks {
+		switch {
+		case t.is("(") || t.is("[") || t.is("{"):
+			depth++
+		case t.is(")") || t.is("]") || t.is("}"):
+			depth--
+		case t.is("=") && depth == 0:
+			return compact(significant(toks[:i])) + " = " + collapse(toks[i+1:])
+		}
+	}
+	return compact(significant(toks))
+}
+
+// significant returns the tokens that are not whitespace or comments.
+func significant(toks []token) []token {
+	result := make([]token, 0, len(toks))
+	for _, t := range toks {
+		if !t.trivia() {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// compact joins the tokens of a name, type or schema without whitespace, other than a space after each ','.
+// Literal values keep a single space where the tokens were separated by whitespace.
+func compact(toks []token) string {
+	for _, t := range toks {
+		if !t.trivia() && !isSchemaToken(t) {
+			return collapse(toks)
+		}
+	}
+
+	var b strings.Builder
+	for _, t := range significant(toks) {
+		b.WriteString(t.text)
+		if t.is(",") {
+			b.WriteString(" ")
+		}
+	}
+	return b.String()
+}
+
+// isSchemaToken returns true if the token can be part of a name, type or schema.
+func isSchemaToken(t token) bool {
+	if t.kind == tokenIdentifier || t.kind == tokenString {
+		return true
+	}
+	for _, p := range []string{"(", ")", "[", "]", ":", ",", "*"} {
+		if t.is(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// collapse joins the tokens, replacing each run of whitespace between tokens with a single space.
+func collapse(toks []token) string {
+	var b strings.Builder
+	space := false
+	for _, t := range toks {
+		if t.trivia() {
+			space = b.Len() > 0
+			continue
+		}
+		if space {
+			b.WriteString(" ")
+			space = false
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+// formatBody formats the tokens of a body between its braces. Each line is indented by its nesting
+// within brackets, and runs of empty lines are reduced to a single empty line.
+func formatBody(toks []token) string {
+	type line struct {
+		text  string
+		level int
+	}
+	lines := []line{}
+	var b strings.Builder
+	depth, level := 0, 0
+	for i := 0; i <= len(toks); i++ {
+		if i == len(toks) || toks[i].kind == tokenNewline {
+			lines = append(lines, line{strings.TrimRight(b.String(), " \t\r"), level})
+			b.Reset()
+			continue
+		}
+
+		t := toks[i]
+		if b.Len() == 0 {
+			if t.kind == tokenSpace {
+				continue
+			}
+			level = depth
+			if (t.is(")") || t.is("]") || t.is("}")) && level > 0 {
+				level--
+			}
+		}
+		switch {
+		case t.is("(") || t.is("[") || t.is("{"):
+			depth++
+		case t.is(")") || t.is("]") || t.is("}"):
+			depth--
+		}
+		b.WriteString(t.text)
+	}
+
+	var out strings.Builder
+	empty := true
+	for i, l := range lines {
+		if l.text == "" {
+			// keep a single empty line between lines, other than at the start and end
+			if !empty && i+1 < len(lines) && lines[i+1].text != "" {
+				out.WriteString("\n")
+			}
+			continue
+		}
+		out.WriteString(strings.Repeat(indentation, 1+l.level) + l.text + "\n")
+		empty = false
+	}
+
+	if empty {
+		return "{}"
+	}
+	return "{\n" + out.String() + "}"
+}
+
+// sameCommands returns true if the declarations build the same commands, other than in whitespace.
+func sameCommands(before []*declaration, after []*declaration) bool {
+	if len(before) != len(after) {
+		return false
+	}
+
+	for i := range before {
+		a, err := declarationCommands(before[i])
+		if err != nil {
+			return false
+		}
+		b, err := declarationCommands(after[i])
+		if err != nil || len(a) != len(b) {
+			return false
+		}
+		for j := range a {
+			if !sameIgnoringWhitespace(a[j], b[j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// declarationCommands returns the commands built from the declaration, including its policies.
+func declarationCommands(decl *declaration) ([]string, error) {
+	cmds, err := commands(decl, "")
+	if err != nil || decl.declType != tableType {
+		return cmds, err
+	}
+
+	policies, err := policyDeclarations(decl)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		policyCmds, err := commands(p, "")
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, policyCmds...)
+	}
+	return cmds, nil
+}
+
+// sameIgnoringWhitespace returns true if a and b have the same tokens, other than whitespace.
+// Whitespace within comments is also ignored.
+func sameIgnoringWhitespace(a string, b string) bool {
+	tokens := func(s string) []string {
+		toks, _ := tokenize(s, 1, 1)
+		texts := []string{}
+		for _, t := range toks {
+			switch t.kind {
+			case tokenSpace, tokenNewline:
+			case tokenComment:
+				texts = append(texts, strings.Join(strings.Fields(t.text), ""))
+			default:
+				texts = append(texts, t.text)
+			}
+		}
+		return texts
+	}
+
+	ta, tb := tokens(a), tokens(b)
+	if len(ta) != len(tb) {
+		return false
+	}
+	for i := range ta {
+		if ta[i] != tb[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+package ksd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat_Snapshots(t *testing.T) {
+	snapshotter := snapshotter()
+	for _, root := range []string{"functions", "tables", "views", "externals", "exports"} {
+		ent, err := testData.ReadDir(path.Join("testdata", root))
+		require.NoError(t, err)
+
+		for _, e := range ent {
+			name := path.Join(root, e.Name())
+			t.Run(name, func(t *testing.T) {
+				content, err := testData.ReadFile(path.Join("testdata", name))
+				require.NoError(t, err)
+
+				formatted, diags, err := formatFile(string(content))
+				require.NoError(t, err)
+				require.Zero(t, diags.Count(SeverityError))
+
+				again, _, err := formatFile(formatted)
+				require.NoError(t, err)
+				assert.Equal(t, formatted, again, "formatting is not idempotent")
+
+				err = snapshotter.SnapshotWithName(fmt.Sprintf("fmt-%s-%s", root, e.Name()), formatted)
+				require.NoError(t, err)
+			})
+		}
+	}
+}
+
+func Test_formatFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			"header",
+			"let  x=(a:int){ok}",
+			"let x = (a:int) {\n    ok\n}\n",
+		},
+		{
+			"commentGroups",
+			"  // free\n\n\n//doc\nlet x = () { 1 };\n\n\n\nlet y = () { 2 } // note\n// end",
+			"// free\n\n// doc\nlet x = () {\n    1\n}\n\nlet y = () {\n    2\n} // note\n\n// end\n",
+		},
+		{
+			"indentedAnnotation",
+			"//@folder A\n  // @folder B\nlet x = () { 1 }",
+			"// @folder A\n  // @folder B\nlet x = () {\n    1\n}\n",
+		},
+		{
+			"pipes",
+			"let f = () {\nT\n  | where x in (\nU\n| project x\n   )\n\n\n\t| take 1\n\n}",
+			"let f = () {\n    T\n    | where x in (\n        U\n        | project x\n    )\n\n    | take 1\n}\n",
+		},
+		{
+			"longSignature",
+			"let f = (first:string, second:string = 'a longer default value', third:(a:int,b:string), fourth:dynamic) { 1 }",
+			"let f = (\n    first:string,\n    second:string = 'a longer default value',\n    third:(a:int, b:string),\n    fourth:dynamic\n) {\n    1\n}\n",
+		},
+		{
+			"signatureComments",
+			"let f = (a : int, // the a\n  // about b\n  bb:string = \"b\"// the b\n) { 1 }",
+			"let f = (\n    a:int,          // the a\n    // about b\n    bb:string = \"b\" // the b\n) {\n    1\n}\n",
+		},
+		{
+			"commentInDefault",
+			"let f = (a:int = 1 // c\n  + 2) { a }",
+			"let f = (a:int = 1 // c\n  + 2) { a }\n",
+		},
+		{
+			"multilineString",
+			"let f = () {\n  print ```\n  keep\n    this```\n}",
+			"let f = () {\n    print ```\n  keep\n    this```\n}\n",
+		},
+		{
+			"crlf",
+			"// doc\r\nlet f = () {\r\n  T\r\n  | take 1\r\n}\r\n",
+			"// doc\nlet f = () {\n    T\n    | take 1\n}\n",
+		},
+		{
+			"rows",
+			"// @data replace\nlet T = datatable(a:string, b:datetime)['a', datetime(null), 'bcd', datetime(2020-01-01  00:00)]",
+			"// @data replace\nlet T = datatable(\n    a:string,\n    b:datetime\n)\n[\n    'a',   datetime(null),\n    'bcd', datetime(2020-01-01 00:00)\n]\n",
+		},
+		{
+			"rowsTrailingComma",
+			"// @data append\nlet T = datatable(a:int)[1,2,]",
+			"// @data append\nlet T = datatable(\n    a:int\n)\n[\n    1,\n    2,\n]\n",
+		},
+		{
+			"emptyTable",
+			"let T = datatable() [ ]",
+			"let T = datatable()\n[]\n",
+		},
+		{
+			"view",
+			"let V = materialized_view( T ){T|summarize count() by a}",
+			"let V = materialized_view(T) {\n    T|summarize count() by a\n}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatted, diags, err := formatFile(tt.input)
+			require.NoError(t, err)
+			require.Empty(t, diags)
+			assert.Equal(t, tt.expected, formatted)
+
+			again, _, err := formatFile(formatted)
+			require.NoError(t, err)
+			assert.Equal(t, formatted, again, "formatting is not idempotent")
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	srcRoot := t.TempDir()
+	writeSources(t, srcRoot, map[string]string{
+		"functions/Formatted.csl":   "let Formatted = () {\n    1\n}\n",
+		"functions/Unformatted.csl": "let Unformatted=(){1}",
+		"tables/Broken.csl":         "let Broken = datatable(a:strin)[]",
+		OutDir + "/Built.csl":       "let Built=(){1}",
+	})
+
+	changed, diags, err := Format(srcRoot, FormatOptions{Check: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("functions", "Unformatted.csl")}, changed)
+	require.Len(t, diags, 1)
+	assert.Equal(t, filepath.Join("tables", "Broken.csl"), diags[0].File())
+
+	content, err := os.ReadFile(filepath.Join(srcRoot, "functions", "Unformatted.csl"))
+	require.NoError(t, err)
+	assert.Equal(t, "let Unformatted=(){1}", string(content), "check must not rewrite files")
+
+	changed, _, err = Format(srcRoot, FormatOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("functions", "Unformatted.csl")}, changed)
+
+	content, err = os.ReadFile(filepath.Join(srcRoot, "functions", "Unformatted.csl"))
+	require.NoError(t, err)
+	assert.Equal(t, "let Unformatted = () {\n    1\n}\n", string(content))
+
+	changed, _, err = Format(srcRoot, FormatOptions{Check: true})
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+}
+
+func TestFormat_Options(t *testing.T) {
+	srcRoot := t.TempDir()
+	writeSources(t, srcRoot, map[string]string{
+		"functions/Get.kql":   "let Get=(){1}",
+		"functions/Other.csl": "let Other=(){1}",
+		"build/Built.kql":     "let Built=(){1}",
+	})
+
+	changed, _, err := Format(srcRoot, FormatOptions{
+		Check:      true,
+		OutRoot:    filepath.Join(srcRoot, "build"),
+		Extensions: []string{".kql"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("functions", "Get.kql")}, changed)
+}
+
+func FuzzFormat(f *testing.F) {
+	for _, dir := range []string{"testdata/functions", "testdata/tables"} {
+		ent, err := testData.ReadDir(dir)
+		require.NoError(f, err)
+		for _, e := range ent {
+			content, err := testData.ReadFile(path.Join(dir, e.Name()))
+			require.NoError(f, err)
+			f.Add(string(content))
+		}
+	}
+	f.Add("// @data replace\nlet T = datatable(a:string, // doc\n b:int)['a', 1]")
+	f.Fuzz(func(t *testing.T, content string) {
+		formatted, diags, err := formatFile(content)
+		if diags.Count(SeverityError) > 0 {
+			return
+		}
+		require.NoError(t, err)
+
+		again, _, err := formatFile(formatted)
+		require.NoError(t, err)
+		require.Equal(t, formatted, again, "formatting is not idempotent")
+	})
+}
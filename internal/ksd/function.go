@@ -0,0 +1,52 @@
+package ksd
+
+import (
+	"strings"
+)
+
+// functionOptions are the options of a function declaration, set by annotations.
+type functionOptions struct {
+	// true to create the function as a view, which is included in wildcard queries
+	view bool
+	// true to skip validation of the function body when it is created
+	skipValidation bool
+}
+
+// functionProperties returns the properties of the '.create-or-alter function' command,
+// after folder and docstring.
+func functionProperties(opts functionOptions) string {
+	var b strings.Builder
+	if opts.view {
+		b.WriteString(",view=true")
+	}
+	if opts.skipValidation {
+		b.WriteString(",skipvalidation=true")
+	}
+	return b.String()
+}
+
+// applyViewAnnotation applies '// @view' or '// @view true|false'.
+func applyViewAnnotation(decl *declaration, a annotation) error {
+	var err error
+	decl.function.view, err = boolAnnotation(a)
+	return err
+}
+
+// applySkipValidationAnnotation applies '// @skipvalidation' or '// @skipvalidation true|false'.
+func applySkipValidationAnnotation(decl *declaration, a annotation) error {
+	var err error
+	decl.function.skipValidation, err = boolAnnotation(a)
+	return err
+}
+
+// applyFolderAnnotation applies '// @folder Shared/Utils', which overrides the folder
+// taken from the directory of the source file.
+func applyFolderAnnotation(decl *declaration, a annotation) error {
+	folder := strings.Trim(strings.ReplaceAll(a.value, "\\", "/"), "/")
+	if folder == "" || strings.Contains(folder, "\"") {
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@folder'. Expected a folder, i.e. Shared/Utils", a.value)
+	}
+	decl.folder = folder
+	return nil
+}
@@ -0,0 +1,275 @@
+package ksd
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// references returns the names of the entities referenced in text,
+// in order of first occurrence.
+//
+// Only names used as tables or functions are references, since the names of columns may match
+// the names of declarations. A name is a reference when it is:
+//   - at the start of a statement or of a parenthesized subquery, i.e. { T | ... } or (T | ...)
+//   - the value of a let statement, i.e. let x = T
+//   - an operand of join, lookup or union, i.e. join kind=inner (T) or union T, U
+//   - invoked, i.e. F(1)
+//   - an argument of a call to one of functions, the declared functions, i.e. Clean(T)
+//
+// Both plain identifiers and quoted identifiers, i.e. ['name'], are returned,
+// as are the names of external tables, i.e. external_table('name').
+// Identifiers within string literals and comments are ignored,
+// as are identifiers that follow a '.', such as property accesses.
+func references(text string, functions map[string]bool) []string {
+	refs := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			refs = append(refs, name)
+		}
+	}
+
+	// the references of the tokens before an unterminated string literal
+	all, _ := tokenize(text, 1, 1)
+	toks := make([]token, 0, len(all))
+	for _, t := range all {
+		if !t.trivia() {
+			toks = append(toks, t)
+		}
+	}
+
+	// name returns the name at i and the index after it, or an empty name if there is none
+	name := func(i int) (string, int) {
+		switch {
+		case i < 0:
+		case i+2 < len(toks) && toks[i].is("[") && toks[i+1].kind == tokenString && toks[i+2].is("]"):
+			return unquoteString(toks[i+1].text), i + 3
+		// $left and $right are the sides of a join
+		case i < len(toks) && toks[i].kind == tokenIdentifier &&
+			!strings.HasPrefix(toks[i].text, "$") && !(i > 0 && toks[i-1].is(".")):
+			return toks[i].text, i + 1
+		}
+		return "", i
+	}
+	is := func(i int, p string) bool {
+		return i < len(toks) && toks[i].is(p)
+	}
+
+	// tabular is true if a name at the cursor is used as a table.
+	// operands is true if names separated by ',' are used as tables, i.e. in union T, U,
+	// and is saved for each enclosing '('.
+	tabular, operands := true, false
+	saved := []bool{}
+	for i := 0; i < len(toks); {
+		n, next := name(i)
+		if n == "" {
+			t := toks[i]
+			switch {
+			case t.is("{"), t.is(";"):
+				tabular, operands = true, false
+			case t.is("("):
+				saved = append(saved, operands)
+				operands = false
+				// a subquery, i.e. toscalar(T | count)
+				if m, after := name(i + 1); m != "" && is(after, "|") {
+					tabular = true
+				}
+				// the arguments of a declared function, i.e. Clean(T)
+				if f, _ := name(i - 1); functions[f] {
+					tabular, operands = true, true
+				}
+			case t.is(")"):
+				if len(saved) > 0 {
+					operands = saved[len(saved)-1]
+					saved = saved[:len(saved)-1]
+				}
+				tabular = false
+			case t.is(","):
+				tabular = operands
+			case t.is("="):
+				tabular = i >= 2 && toks[i-2].kind == tokenIdentifier && toks[i-2].text == "let"
+			case t.is("|"):
+				tabular, operands = false, false
+			default:
+				tabular = false
+			}
+			i++
+			continue
+		}
+
+		switch {
+		case n == "let" && toks[i].kind == tokenIdentifier:
+			tabular = false
+		case (n == "join" || n == "lookup" || n == "union") && toks[i].kind == tokenIdentifier:
+			tabular, operands = true, n == "union"
+		case tabular && (is(next, "=") || is(next, ".")):
+			// an option of join, lookup or union, i.e. kind=inner or hint.strategy=broadcast
+			for next < len(toks) && !toks[next].is("=") {
+				next++
+			}
+			next += 2
+		case n == "external_table" && is(next, "(") && next+1 < len(toks) && toks[next+1].kind == tokenString:
+			// external tables are referenced by name, i.e. external_table('Logs')
+			add(unquoteString(toks[next+1].text))
+			tabular = false
+		case tabular || is(next, "("):
+			add(n)
+			tabular = false
+		default:
+			tabular = false
+		}
+		i = next
+	}
+
+	return refs
+}
+
+func isIdentifierStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
+
+func isIdentifierPart(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// sortSources orders sources so that each declaration comes after the declarations it references.
+// The dependencies of each source are set as part of sorting.
+//
+// Declarations without dependencies between them keep their relative order.
+// An error is returned for each name that is declared more than once, and for each cycle of references.
+// Sorting continues after errors, so that all of them are returned.
+func sortSources(sources []source) ([]source, []*ParseError) {
+	errs := []*ParseError{}
+	byName := map[string]int{}
+	for i, src := range sources {
+		// policies cannot be referenced by other declarations
+		if src.decl.declType == policyType {
+			continue
+		}
+		if j, has := byName[src.decl.name]; has {
+			errs = append(errs, &ParseError{
+				file: src.rel,
+				row:  src.decl.row,
+				col:  src.decl.col,
+				msg:  fmt.Sprintf("%s is declared in both %s and %s", src.decl.name, sources[j].rel, src.rel),
+			})
+			continue
+		}
+		byName[src.decl.name] = i
+	}
+
+	functions := declaredFunctions(sources)
+	// edges[i] are the sources that source i depends on
+	edges := make([][]int, len(sources))
+	// dependents[i] are the sources that depend on source i
+	dependents := make([][]int, len(sources))
+	for i := range sources {
+		src := &sources[i]
+		src.dependsOn = nil
+		for _, ref := range src.decl.references(functions) {
+			j, has := byName[ref]
+			if !has || j == i {
+				continue
+			}
+			src.dependsOn = append(src.dependsOn, ref)
+			edges[i] = append(edges[i], j)
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+
+	// Kahn's algorithm, always choosing the earliest source that is ready
+	// to keep the original order where possible.
+	remaining := make([]int, len(sources))
+	for i := range sources {
+		remaining[i] = len(edges[i])
+	}
+	done := make([]bool, len(sources))
+	finish := func(i int) {
+		done[i] = true
+		for _, d := range dependents[i] {
+			remaining[d]--
+		}
+	}
+	sorted := make([]source, 0, len(sources))
+	for finished := 0; finished < len(sources); finished++ {
+		next := -1
+		for i := range sources {
+			if !done[i] && remaining[i] == 0 {
+				next = i
+				break
+			}
+		}
+
+		// the sources of a cycle are reported, and then left out so that sorting can continue
+		if next == -1 {
+			cycle := findCycle(edges, done)
+			errs = append(errs, cycleError(sources, cycle))
+			for _, i := range cycle[1:] {
+				finish(i)
+			}
+			finished += len(cycle) - 2
+			continue
+		}
+
+		finish(next)
+		sorted = append(sorted, sources[next])
+	}
+
+	return sorted, errs
+}
+
+// declaredFunctions returns the names of the functions declared by sources.
+func declaredFunctions(sources []source) map[string]bool {
+	functions := map[string]bool{}
+	for _, src := range sources {
+		if src.decl.declType == functionType {
+			functions[src.decl.name] = true
+		}
+	}
+	return functions
+}
+
+// findCycle returns a cycle of references between the sources that are not done,
+// as the indexes of the sources, starting and ending with the same source.
+func findCycle(edges [][]int, done []bool) []int {
+	start := 0
+	for done[start] {
+		start++
+	}
+
+	// every source that is not done depends on another source that is not done,
+	// and so following those dependencies always leads to a cycle.
+	visited := map[int]int{}
+	path := []int{}
+	current := start
+	for {
+		if at, seen := visited[current]; seen {
+			return append(path[at:], current)
+		}
+		visited[current] = len(path)
+		path = append(path, current)
+		for _, dep := range edges[current] {
+			if !done[dep] {
+				current = dep
+				break
+			}
+		}
+	}
+}
+
+// cycleError describes the cycle of references, at the position of the first source of the cycle.
+func cycleError(sources []source, cycle []int) *ParseError {
+	names := make([]string, 0, len(cycle))
+	for _, i := range cycle {
+		names = append(names, fmt.Sprintf("%s (%s)", sources[i].decl.name, sources[i].rel))
+	}
+	first := sources[cycle[0]]
+	return &ParseError{
+		file: first.rel,
+		row:  first.decl.row,
+		col:  first.decl.col,
+		msg:  fmt.Sprintf("dependency cycle between declarations: %s", strings.Join(names, " -> ")),
+	}
+}
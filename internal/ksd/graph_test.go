@@ -0,0 +1,195 @@
+package ksd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_references(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"pipeline", "{ T | where x > a }", []string{"T"}},
+		{"quoted", "{ ['My Table'] | union [\"Other\"] }", []string{"My Table", "Other"}},
+		{"strings", `{ print 'Hidden', "Hidden2", @'c:\Hidden3', "it\"s" }`, []string{"print"}},
+		{"multiline", "{ print ```Hidden\nHidden``` }", []string{"print"}},
+		{"comments", "{\n// Hidden\nT\n}", []string{"T"}},
+		{"properties", "{ T | extend x = d.Prop, r = range(1..Prop2) }", []string{"T", "range"}},
+		{"joinSides", "{ T | join (U) on $left.a == $right.b }", []string{"T", "U"}},
+		{"joinOptions", "{ T | join kind=leftouter hint.strategy=broadcast U on a | lookup (V | take 1) on b }", []string{"T", "U", "V"}},
+		{"union", "{ union kind=outer withsource=Source A, (B | where x), ['C'] | where Source == 'A' }", []string{"A", "B", "C"}},
+		{"let", "{ let x = T; let n = 10; x | take n }", []string{"T", "x"}},
+		{"calls", "{ T | extend y = Normalize(Level), z = toscalar(U | count) }", []string{"T", "Normalize", "toscalar", "U"}},
+		{"declaredFunctionArguments", "{ Clean(T, Level) | where Level == 'E' }", []string{"Clean", "T", "Level"}},
+		{"columns", "{ T | where Level == 'E' | project Level, Errors | summarize count() by bin(Errors, 1h) }", []string{"T", "count", "bin"}},
+		{"obfuscated", "{ print h'Hidden', H@\"Hidden2\" }", []string{"print"}},
+		{"externalTable", "{ external_table('Raw Logs') | union external_table (\"Archive\") }", []string{"Raw Logs", "Archive"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, references(tt.input, map[string]bool{"Clean": true}))
+		})
+	}
+}
+
+func Test_sortSources(t *testing.T) {
+	sources := []source{
+		parseSource(t, "a/A.csl", "let A = () { B | union C }"),
+		parseSource(t, "b/B.csl", "let B = () { C }"),
+		parseSource(t, "c/C.csl", "let C = datatable(x:int)[]"),
+		parseSource(t, "d/D.csl", "let D = () { print 'A' }"),
+	}
+
+	sorted, errs := sortSources(sources)
+	require.Empty(t, errs)
+
+	names := []string{}
+	for _, src := range sorted {
+		names = append(names, src.decl.name)
+	}
+	assert.Equal(t, []string{"C", "B", "A", "D"}, names)
+	assert.Equal(t, []string{"C"}, sorted[1].dependsOn)
+	assert.Equal(t, []string{"B", "C"}, sorted[2].dependsOn)
+	assert.Empty(t, sorted[3].dependsOn)
+}
+
+func Test_sortSources_materializedView(t *testing.T) {
+	sources := []source{
+		parseSource(t, "views/Daily.csl",
+			"// @dimensionTables Region\nlet Daily = materialized_view(Requests) { Requests | extend r = Normalize(Region) | summarize count() by r }"),
+		parseSource(t, "functions/Normalize.csl", "let Normalize = (s:string) { tolower(s) }"),
+		parseSource(t, "tables/Region.csl", "let Region = datatable(Code:string)[]"),
+		parseSource(t, "tables/Requests.csl", "let Requests = datatable(Region:string)[]"),
+	}
+
+	sorted, errs := sortSources(sources)
+	require.Empty(t, errs)
+
+	names := []string{}
+	for _, src := range sorted {
+		names = append(names, src.decl.name)
+	}
+	assert.Equal(t, []string{"Normalize", "Region", "Requests", "Daily"}, names)
+	assert.Equal(t, []string{"Requests", "Normalize", "Region"}, sorted[3].dependsOn)
+}
+
+func Test_sortSources_continuousExport(t *testing.T) {
+	sources := []source{
+		parseSource(t, "exports/Export.csl",
+			"// @intervalBetweenRuns 1h\nlet Export = continuous_export(Archive) { Clean(Logs) }"),
+		parseSource(t, "functions/Clean.csl", "let Clean = (T:(*)) { T | where isnotempty(Message) }"),
+		parseSource(t, "externals/Archive.csl",
+			"// @dataFormat csv\n// @connection https://a.blob.core.windows.net/c;${env:KEY}\nlet Archive = external_table(Message:string)"),
+		parseSource(t, "tables/Logs.csl", "let Logs = datatable(Message:string)[]"),
+	}
+
+	sorted, errs := sortSources(sources)
+	require.Empty(t, errs)
+
+	names := []string{}
+	for _, src := range sorted {
+		names = append(names, src.decl.name)
+	}
+	assert.Equal(t, []string{"Clean", "Archive", "Logs", "Export"}, names)
+	assert.Equal(t, []string{"Archive", "Clean", "Logs"}, sorted[3].dependsOn)
+}
+
+func Test_sortSources_columnNames(t *testing.T) {
+	sources := []source{
+		parseSource(t, "tables/Requests.csl", "let Requests = datatable(Region:string)[]"),
+		parseSource(t, "functions/Region.csl", "let Region = () { Requests | distinct Region }"),
+		parseSource(t, "functions/Top.csl", "let Top = (Requests:(Region:string), n:long = toscalar(Limit())) { Requests | take n }"),
+		parseSource(t, "functions/Limit.csl", "let Limit = () { print 10 }"),
+	}
+
+	sorted, errs := sortSources(sources)
+	require.Empty(t, errs)
+
+	names := []string{}
+	for _, src := range sorted {
+		names = append(names, src.decl.name)
+	}
+	assert.Equal(t, []string{"Requests", "Region", "Limit", "Top"}, names)
+	assert.Empty(t, sorted[0].dependsOn)
+	assert.Equal(t, []string{"Requests"}, sorted[1].dependsOn)
+	assert.Equal(t, []string{"Limit"}, sorted[3].dependsOn)
+}
+
+func Test_sortSources_columnNamedAfterFunction(t *testing.T) {
+	sources := []source{
+		parseSource(t, "tables/T.csl", "let T = datatable(Level:string)[]"),
+		parseSource(t, "functions/Level.csl", "let Level = () { Errors | count }"),
+		parseSource(t, "functions/Errors.csl", `let Errors = () { T | where Level == "E" | project Level }`),
+	}
+
+	sorted, errs := sortSources(sources)
+	require.Empty(t, errs)
+
+	names := []string{}
+	for _, src := range sorted {
+		names = append(names, src.decl.name)
+	}
+	assert.Equal(t, []string{"T", "Errors", "Level"}, names)
+	assert.Equal(t, []string{"T"}, sorted[1].dependsOn)
+	assert.Equal(t, []string{"Errors"}, sorted[2].dependsOn)
+}
+
+func Test_sortSources_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []string
+		errs    []string
+		sorted  []string
+	}{
+		{
+			"cycle",
+			[]string{"let A = () { B }", "let B = () { C }", "let C = () { A }", "let D = () { A }"},
+			[]string{"0.csl:1:5: dependency cycle between declarations: A (0.csl) -> B (1.csl) -> C (2.csl) -> A (0.csl)"},
+			[]string{"D"},
+		},
+		{
+			"cycles",
+			[]string{"let A = () { B }", "let B = () { A }", "let C = () { print 1 }", "let D = () { E }", "let E = () { D }"},
+			[]string{
+				"0.csl:1:5: dependency cycle between declarations: A (0.csl) -> B (1.csl) -> A (0.csl)",
+				"3.csl:1:5: dependency cycle between declarations: D (3.csl) -> E (4.csl) -> D (3.csl)",
+			},
+			[]string{"C"},
+		},
+		{
+			"duplicate",
+			[]string{"let A = () { print 1 }", "let A = () { print 2 }", "let B = () { print 1 }", "\nlet B = () { print 2 }"},
+			[]string{
+				"1.csl:1:5: A is declared in both 0.csl and 1.csl",
+				"3.csl:2:5: B is declared in both 2.csl and 3.csl",
+			},
+			[]string{"A", "A", "B", "B"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := []source{}
+			for i, content := range tt.sources {
+				sources = append(sources, parseSource(t, fmt.Sprintf("%d.csl", i), content))
+			}
+
+			sorted, errs := sortSources(sources)
+			msgs := []string{}
+			for _, err := range errs {
+				msgs = append(msgs, err.Error())
+			}
+			assert.Equal(t, tt.errs, msgs)
+
+			names := []string{}
+			for _, src := range sorted {
+				names = append(names, src.decl.name)
+			}
+			assert.Equal(t, tt.sorted, names)
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package ksd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ignoreDirective suppresses diagnostics of the listed rules, or of all rules if none are listed, i.e.:
+//
+//	// ksd-ignore unused-parameter, project-star
+//
+// A directive on its own line applies to the next line. A directive after code applies to its own line.
+const ignoreDirective = "ksd-ignore"
+
+// severityOff turns a lint rule off.
+const severityOff = "off"
+
+// lintRule checks the declarations of the source files for a problem.
+type lintRule struct {
+	name string
+	// what the rule reports, i.e. in SARIF output
+	description string
+	// the severity of the diagnostics of the rule, unless configured. Empty if the rule is off by default.
+	severity Severity
+	// check returns the problems in the declaration of src
+	check func(l *linter, src source) []*ParseError
+}
+
+// lintRules are the rules of Lint, in the order they are documented.
+var lintRules = []lintRule{
+	{"missing-docstring", "Declarations should have a docstring.", SeverityWarning, checkDocstring},
+	{"file-name", "A file with a single declaration should be named after it.", SeverityWarning, checkFileName},
+	{"pascal-case", "Declaration names should be PascalCase.", SeverityWarning, checkPascalCase},
+	{"unused-parameter", "Function parameters should be used in the body.", SeverityWarning, checkUnusedParameters},
+	{"take-without-order", "'take' and 'limit' should follow 'order by'.", SeverityWarning, checkTakeWithoutOrder},
+	{"project-star", "'project' should list columns without wildcards.", SeverityWarning, checkProjectStar},
+	{"unused-function", "Functions should be used by another declaration.", "", checkUnusedFunction},
+	{"missing-retention", "Tables should have a retention policy.", "", checkRetention},
+}
+
+// LintRuleNames returns the names of the lint rules.
+func LintRuleNames() []string {
+	names := make([]string, 0, len(lintRules))
+	for _, r := range lintRules {
+		names = append(names, r.name)
+	}
+	return names
+}
+
+// LintOptions configures Lint.
+type LintOptions struct {
+	// Strict treats warnings as errors.
+	Strict bool
+	// OutRoot is the output directory, whose files are skipped. Defaults to OutDir under the source root.
+	OutRoot string
+	// Extensions are the file extensions of Kusto source files, i.e. .kql.
+	// Defaults to the extensions of IsKustoSourceFile.
+	Extensions []string
+	// Rules sets the severity of the rules by name: error, warning, or off to turn a rule off.
+	// Rules that are not set keep their default severity.
+	Rules map[string]string
+}
+
+// Lint checks the declarations of the Kusto source files under srcRoot against the lint rules, configured by
+// opts.Rules. The problems found are returned as diagnostics, sorted by file and
+// position, with the name of their rule.
+//
+// Files are parsed as in Build, and the errors of files that cannot be built are returned as diagnostics.
+// The rules are only checked when there are no such errors.
+func Lint(srcRoot string, opts LintOptions) (Diagnostics, error) {
+	srcRoot = filepath.Clean(srcRoot)
+	severities, err := lintSeverities(opts.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	outRoot := opts.OutRoot
+	if outRoot == "" {
+		outRoot = filepath.Join(srcRoot, OutDir)
+	}
+	sources, diags, err := parseSources(srcRoot, filepath.Clean(outRoot), opts.Extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	if diags.Count(SeverityError) == 0 {
+		l := newLinter(sources)
+		ignores := map[string]ignores{}
+		for _, src := range sources {
+			if src.decl.declType == policyType {
+				continue
+			}
+			if _, has := ignores[src.rel]; !has {
+				ignores[src.rel] = readIgnores(filepath.Join(srcRoot, src.rel))
+			}
+
+			for _, rule := range lintRules {
+				severity := severities[rule.name]
+				if severity == "" {
+					continue
+				}
+				for _, p := range rule.check(l, src) {
+					if ignores[src.rel].ignored(p.row, rule.name) {
+						continue
+					}
+					p.file = src.rel
+					p.rule = rule.name
+					diags = append(diags, Diagnostic{Severity: severity, err: p})
+				}
+			}
+		}
+		sort.SliceStable(diags, func(i, j int) bool {
+			a, b := diags[i], diags[j]
+			if a.File() != b.File() {
+				return a.File() < b.File()
+			}
+			if a.Row() != b.Row() {
+				return a.Row() < b.Row()
+			}
+			return a.Col() < b.Col()
+		})
+	}
+
+	if opts.Strict {
+		for i := range diags {
+			diags[i].Severity = SeverityError
+		}
+	}
+	diags.readLines(srcRoot)
+	return diags, nil
+}
+
+// lintSeverities returns the severity of each rule, as configured by rules.
+// Rules that are off have an empty severity.
+func lintSeverities(rules map[string]string) (map[string]Severity, error) {
+	severities := map[string]Severity{}
+	for _, r := range lintRules {
+		severities[r.name] = r.severity
+	}
+
+	for name, value := range rules {
+		if _, has := severities[name]; !has {
+			return nil, fmt.Errorf(
+				"unknown lint rule '%s'. Allowed rules: %s", name, strings.Join(LintRuleNames(), ", "))
+		}
+
+		switch value {
+		case string(SeverityError), string(SeverityWarning):
+			severities[name] = Severity(value)
+		case severityOff:
+			severities[name] = ""
+		default:
+			return nil, fmt.Errorf(
+				"invalid value '%s' for lint rule '%s'. Allowed values: error, warning, off", value, name)
+		}
+	}
+	return severities, nil
+}
+
+// ignores are the rules ignored on each line of a file. A nil list of rules ignores all rules.
+type ignores map[int][]string
+
+func (ig ignores) ignored(row int, rule string) bool {
+	rules, has := ig[row]
+	if !has {
+		return false
+	}
+	if rules == nil {
+		return true
+	}
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// readIgnores returns the lines of the file at path with an ignore directive.
+// A file that cannot be read has none, as its errors are reported by parsing.
+func readIgnores(path string) ignores {
+	ig := ignores{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ig
+	}
+	toks, _ := tokenize(string(content), 1, 1)
+
+	// whether the line has a token other than whitespace before the cursor
+	code := false
+	for _, t := range toks {
+		switch t.kind {
+		case tokenNewline:
+			code = false
+			continue
+		case tokenSpace:
+			continue
+		case tokenComment:
+			if rules, ok := parseIgnore(t.text); ok {
+				row := t.row
+				if !code {
+					row++
+				}
+				if existing, has := ig[row]; has && existing == nil || rules == nil {
+					ig[row] = nil
+				} else {
+					ig[row] = append(existing, rules...)
+				}
+			}
+		}
+		code = true
+	}
+	return ig
+}
+
+// parseIgnore parses the comment as an ignore directive, returning false if it is not one.
+// The rules are nil if the directive applies to all rules.
+func parseIgnore(comment string) ([]string, bool) {
+	text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(comment), "//"))
+	rest, ok := strings.CutPrefix(text, ignoreDirective)
+	if !ok || rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return nil, false
+	}
+
+	rules := strings.FieldsFunc(rest, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	if len(rules) == 0 {
+		return nil, true
+	}
+	return rules, true
+}
+
+// linter holds what the rules know about all declarations.
+type linter struct {
+	// the number of declarations in each file, other than policies
+	declarations map[string]int
+	// the names referenced by each declaration
+	referenced map[string]bool
+	// the tables with a retention policy
+	retention map[string]bool
+	// true if the database has a retention policy, which applies to tables without one
+	databaseRetention bool
+}
+
+func newLinter(sources []source) *linter {
+	l := &linter{
+		declarations: map[string]int{},
+		referenced:   map[string]bool{},
+		retention:    map[string]bool{},
+	}
+	functions := declaredFunctions(sources)
+	for _, src := range sources {
+		if src.decl.declType == policyType {
+			if src.decl.policy.kind == "retention" {
+				if src.decl.policy.table == "" {
+					l.databaseRetention = true
+				}
+				l.retention[src.decl.policy.table] = true
+			}
+			continue
+		}
+
+		l.declarations[src.rel]++
+		for _, ref := range src.decl.references(functions) {
+			if ref != src.decl.name {
+				l.referenced[ref] = true
+			}
+		}
+	}
+	return l
+}
+
+// checkDocstring reports declarations without a docstring. Continuous exports have no docstring.
+func checkDocstring(_ *linter, src source) []*ParseError {
+	decl := src.decl
+	if decl.doc != "" || decl.declType == continuousExportType {
+		return nil
+	}
+	return []*ParseError{newParseError(decl.row, decl.col, "%s '%s' has no docstring", decl.declType, decl.name)}
+}
+
+// checkFileName reports a file with a single declaration that is not named after the declaration.
+func checkFileName(l *linter, src source) []*ParseError {
+	decl := src.decl
+	if l.declarations[src.rel] != 1 {
+		return nil
+	}
+
+	base := filepath.Base(src.rel)
+	if strings.TrimSuffix(base, filepath.Ext(base)) == decl.name {
+		return nil
+	}
+	return []*ParseError{newParseError(
+		decl.row, decl.col, "file name '%s' does not match the name of %s '%s'", base, decl.declType, decl.name)}
+}
+
+var pascalCase = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+
+// checkPascalCase reports declaration names that are not PascalCase.
+func checkPascalCase(_ *linter, src source) []*ParseError {
+	decl := src.decl
+	if pascalCase.MatchString(decl.name) {
+		return nil
+	}
+	return []*ParseError{newParseError(decl.row, decl.col, "name of %s '%s' is not PascalCase", decl.declType, decl.name)}
+}
+
+// checkUnusedParameters reports function parameters that are not used in the body of the function.
+func checkUnusedParameters(_ *linter, src source) []*ParseError {
+	decl := src.decl
+	if decl.declType != functionType {
+		return nil
+	}
+
+	used := map[string]bool{}
+	toks := bodyTokens(decl)
+	for i, t := range toks {
+		switch {
+		case t.kind == tokenIdentifier:
+			used[t.text] = true
+		case t.kind == tokenString && i > 0 && toks[i-1].is("["):
+			used[unquoteString(t.text)] = true
+		}
+	}
+
+	problems := []*ParseError{}
+	for _, p := range decl.params {
+		if !used[p.name] {
+			problems = append(problems, newParseError(
+				p.row, p.col, "parameter '%s' is not used in the body of function '%s'", p.name, decl.name))
+		}
+	}
+	return problems
+}
+
+// bodyTokens returns the tokens of the body of the declaration, other than whitespace and comments,
+// positioned in the source file.
+func bodyTokens(decl *declaration) []token {
+	toks, _ := tokenize(decl.body, decl.bodyRow, decl.bodyCol)
+	return significant(toks)
+}
+
+// checkTakeWithoutOrder reports 'take' and 'limit' operators that are not preceded by 'order by', 'sort by'
+// or 'top' in the same query, which return arbitrary rows.
+func checkTakeWithoutOrder(_ *linter, src source) []*ParseError {
+	decl := src.decl
+	if decl.body == "" {
+		return nil
+	}
+
+	problems := []*ParseError{}
+	// whether the query at each nesting of brackets is sorted
+	sorted := []bool{false}
+	toks := bodyTokens(decl)
+	for i, t := range toks {
+		switch {
+		case t.is("(") || t.is("[") || t.is("{"):
+			sorted = append(sorted, false)
+		case (t.is(")") || t.is("]") || t.is("}")) && len(sorted) > 1:
+			sorted = sorted[:len(sorted)-1]
+		case t.is(";"):
+			sorted[len(sorted)-1] = false
+		case t.is("|") && i+1 < len(toks):
+			switch op := toks[i+1]; op.text {
+			case "order", "sort", "top":
+				sorted[len(sorted)-1] = true
+			case "take", "limit":
+				if !sorted[len(sorted)-1] {
+					problems = append(problems, newParseError(
+						op.row, op.col, "'%s' without 'order by' returns arbitrary rows", op.text))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// checkProjectStar reports wildcards in the columns of 'project' operators, i.e. '*' or 'Prefix*',
+// which change the output of the query when the columns of its input change.
+func checkProjectStar(_ *linter, src source) []*ParseError {
+	decl := src.decl
+	problems := []*ParseError{}
+	toks := bodyTokens(decl)
+	for i := 0; i+1 < len(toks); i++ {
+		if !toks[i].is("|") || toks[i+1].text != "project" || i+2 < len(toks) && toks[i+2].is("-") {
+			continue
+		}
+
+		// the columns end at the next operator, or the end of the enclosing brackets
+		depth := 0
+		for j := i + 2; j < len(toks); j++ {
+			t := toks[j]
+			if depth == 0 && (t.is("|") || t.is(";") || t.is(")") || t.is("]") || t.is("}")) {
+				break
+			}
+			switch {
+			case t.is("(") || t.is("[") || t.is("{"):
+				depth++
+			case t.is(")") || t.is("]") || t.is("}"):
+				depth--
+			case t.is("*") && depth == 0 && isWildcard(toks, j):
+				problems = append(problems, newParseError(
+					t.row, t.col, "wildcard in 'project' changes the output when the input columns change"))
+			}
+		}
+	}
+	return problems
+}
+
+// isWildcard returns true if the '*' at toks[i] is a wildcard in a list of columns, rather than a multiplication.
+func isWildcard(toks []token, i int) bool {
+	glued := func(a token, b token) bool {
+		return a.end() == b.pos && (a.kind == tokenIdentifier || b.kind == tokenIdentifier)
+	}
+
+	prev := toks[i-1]
+	if !prev.is(",") && prev.text != "project" && !glued(prev, toks[i]) {
+		return false
+	}
+	if i+1 == len(toks) {
+		return true
+	}
+	next := toks[i+1]
+	return next.is(",") || next.is("|") || next.is(";") || next.is(")") || next.is("]") || next.is("}") ||
+		glued(toks[i], next)
+}
+
+// checkUnusedFunction reports functions that are not used by any other declaration.
+func checkUnusedFunction(l *linter, src source) []*ParseError {
+	decl := src.decl
+	if decl.declType != functionType || l.referenced[decl.name] {
+		return nil
+	}
+	return []*ParseError{newParseError(decl.row, decl.col, "function '%s' is not used by any declaration", decl.name)}
+}
+
+// checkRetention reports tables without a retention policy, declared on the table, in a policy file,
+// or for the database.
+func checkRetention(l *linter, src source) []*ParseError {
+	decl := src.decl
+	if decl.declType != tableType || l.retention[decl.name] || l.databaseRetention {
+		return nil
+	}
+	return []*ParseError{newParseError(decl.row, decl.col, "table '%s' has no retention policy", decl.name)}
+}
@@ -0,0 +1,197 @@
+package ksd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lintAll enables all rules as warnings, so that each rule is tested regardless of its default.
+var lintAll = map[string]string{
+	"missing-docstring": "warning", "file-name": "warning", "pascal-case": "warning",
+	"unused-parameter": "warning", "take-without-order": "warning", "project-star": "warning",
+	"unused-function": "warning", "missing-retention": "warning",
+}
+
+func lintSources(t *testing.T, files map[string]string, opts LintOptions) []string {
+	srcRoot := t.TempDir()
+	writeSources(t, srcRoot, files)
+
+	diags, err := Lint(srcRoot, opts)
+	require.NoError(t, err)
+
+	problems := []string{}
+	for _, d := range diags {
+		// paths are compared with forward slashes, on all platforms
+		problems = append(problems, filepath.ToSlash(d.String()))
+	}
+	return problems
+}
+
+func TestLint_Rules(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected []string
+	}{
+		{
+			"missingDocstring",
+			map[string]string{
+				"Log.csl":  "// @retentionPolicy SoftDeletePeriod=30d\nlet Log = datatable(a:int)[]",
+				"Keep.csl": "// Reads Log.\n// ksd-ignore unused-function\nlet Keep = () { Log }",
+			},
+			[]string{"Log.csl:2:5: warning: table 'Log' has no docstring (missing-docstring)"},
+		},
+		{
+			"fileName",
+			map[string]string{
+				"functions/Get.csl": "// Doc.\nlet GetLogs = () { print 1 }",
+				"functions/All.csl": "// Doc.\nlet A = () { B }\n// Doc.\nlet B = () { A }",
+			},
+			[]string{
+				"functions/Get.csl:2:5: warning: file name 'Get.csl' does not match the name of function 'GetLogs' (file-name)",
+				"functions/Get.csl:2:5: warning: function 'GetLogs' is not used by any declaration (unused-function)",
+			},
+		},
+		{
+			"pascalCase",
+			map[string]string{
+				"get_logs.csl": "// Doc.\nlet get_logs = () { print 1 }",
+				"Main.csl":     "// Doc.\nlet Main = () { get_logs }",
+			},
+			[]string{
+				"Main.csl:2:5: warning: function 'Main' is not used by any declaration (unused-function)",
+				"get_logs.csl:2:5: warning: name of function 'get_logs' is not PascalCase (pascal-case)",
+			},
+		},
+		{
+			"unusedParameter",
+			map[string]string{
+				"F.csl": "// Doc.\nlet F = (a:int, b:string, T:(*), ['c d']:int) {\n    T | where a > 0 and ['c d'] > 0\n}",
+				"G.csl": "// Doc.\nlet G = () { F(1, '', print 1, 1) }",
+			},
+			[]string{
+				"F.csl:2:17: warning: parameter 'b' is not used in the body of function 'F' (unused-parameter)",
+				"G.csl:2:5: warning: function 'G' is not used by any declaration (unused-function)",
+			},
+		},
+		{
+			"takeWithoutOrder",
+			map[string]string{
+				"F.csl": "// Doc.\n// ksd-ignore unused-function\nlet F = () {\n" +
+					"    T | take 10;\n" +
+					"    T | order by a | take 10;\n" +
+					"    T | top 10 by a | limit 5;\n" +
+					"    T | where a in ((U | sort by a | take 1)) | limit 1\n" +
+					"}",
+			},
+			[]string{
+				"F.csl:4:9: warning: 'take' without 'order by' returns arbitrary rows (take-without-order)",
+				"F.csl:7:49: warning: 'limit' without 'order by' returns arbitrary rows (take-without-order)",
+			},
+		},
+		{
+			"projectStar",
+			map[string]string{
+				"F.csl": "// Doc.\n// ksd-ignore unused-function\nlet F = () {\n" +
+					"    T | project *;\n" +
+					"    T | project a, Prefix*, b = a * 2, c = a*2;\n" +
+					"    T | project-away a*\n" +
+					"}",
+			},
+			[]string{
+				"F.csl:4:17: warning: wildcard in 'project' changes the output when the input columns change (project-star)",
+				"F.csl:5:26: warning: wildcard in 'project' changes the output when the input columns change (project-star)",
+			},
+		},
+		{
+			"missingRetention",
+			map[string]string{
+				"tables/Log.csl":            "// Doc.\nlet Log = datatable(a:int)[]",
+				"tables/Audit.csl":          "// Doc.\n// @retentionPolicy SoftDeletePeriod=30d\nlet Audit = datatable(a:int)[]",
+				"tables/kept/Kept.csl":      "// Doc.\nlet Kept = datatable(a:int)[]",
+				"tables/kept/policies.json": `{"tables": {"retentionPolicy": "SoftDeletePeriod=30d"}}`,
+			},
+			[]string{"tables/Log.csl:2:5: warning: table 'Log' has no retention policy (missing-retention)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, lintSources(t, tt.files, LintOptions{Rules: lintAll}))
+		})
+	}
+}
+
+func TestLint_DatabaseRetention(t *testing.T) {
+	problems := lintSources(t, map[string]string{
+		"Log.csl":      "// Doc.\nlet Log = datatable(a:int)[]",
+		PolicyFile:     `{"database": {"retentionPolicy": "SoftDeletePeriod=30d"}}`,
+		"tables/T.csl": "// Doc.\nlet T = datatable(a:int)[]",
+	}, LintOptions{Rules: map[string]string{"missing-retention": "error"}})
+	assert.Empty(t, problems)
+}
+
+func TestLint_Defaults(t *testing.T) {
+	files := map[string]string{
+		"functions/Get.csl": "let get = (a:int) { T | take 1 }",
+		"tables/Log.csl":    "// Doc.\nlet Log = datatable(a:int)[]",
+	}
+	assert.Equal(t, []string{
+		"functions/Get.csl:1:5: warning: function 'get' has no docstring (missing-docstring)",
+		"functions/Get.csl:1:5: warning: file name 'Get.csl' does not match the name of function 'get' (file-name)",
+		"functions/Get.csl:1:5: warning: name of function 'get' is not PascalCase (pascal-case)",
+		"functions/Get.csl:1:12: warning: parameter 'a' is not used in the body of function 'get' (unused-parameter)",
+		"functions/Get.csl:1:25: warning: 'take' without 'order by' returns arbitrary rows (take-without-order)",
+	}, lintSources(t, files, LintOptions{}))
+
+	rules := map[string]string{"file-name": "off", "pascal-case": "off", "unused-parameter": "error"}
+	assert.Equal(t, []string{
+		"functions/Get.csl:1:5: error: function 'get' has no docstring (missing-docstring)",
+		"functions/Get.csl:1:12: error: parameter 'a' is not used in the body of function 'get' (unused-parameter)",
+		"functions/Get.csl:1:25: error: 'take' without 'order by' returns arbitrary rows (take-without-order)",
+	}, lintSources(t, files, LintOptions{Strict: true, Rules: rules}))
+}
+
+func TestLint_Ignore(t *testing.T) {
+	problems := lintSources(t, map[string]string{
+		// the directive is not part of the docstring
+		"Get.csl": "// Gets logs.\n// ksd-ignore pascal-case, file-name\nlet get = (a:int, b:int) { // ksd-ignore missing-docstring\n" +
+			"    T | take a // ksd-ignore\n" +
+			"}",
+		"T.csl": "// ksd-ignore\nlet T = datatable(a:int)[]",
+	}, LintOptions{})
+	assert.Equal(t, []string{
+		"Get.csl:3:19: warning: parameter 'b' is not used in the body of function 'get' (unused-parameter)",
+	}, problems)
+
+	decls, diags := parseFile("// Gets logs.\n// ksd-ignore pascal-case\nlet get = () { 1 }")
+	require.Empty(t, diags)
+	assert.Equal(t, "Gets logs.", decls[0].doc)
+}
+
+func TestLint_Errors(t *testing.T) {
+	problems := lintSources(t, map[string]string{
+		"Get.csl": "let get = (a:strin) { 1 }",
+	}, LintOptions{})
+	assert.Equal(t, []string{"Get.csl:1:14: error: unknown type 'strin'. Did you mean 'string'?"}, problems)
+
+	tests := []struct {
+		name  string
+		rules map[string]string
+		err   string
+	}{
+		{"unknownRule", map[string]string{"no-tabs": "error"}, "unknown lint rule 'no-tabs'"},
+		{"invalidSeverity", map[string]string{"file-name": "fatal"}, "invalid value 'fatal' for lint rule 'file-name'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcRoot := t.TempDir()
+			writeSources(t, srcRoot, map[string]string{"A.csl": "let A = () { 1 }"})
+			_, err := Lint(srcRoot, LintOptions{Rules: tt.rules})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
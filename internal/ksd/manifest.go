@@ -0,0 +1,178 @@
+package ksd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The name of the file, under the output directory, that describes the built declarations.
+const ManifestFile = "manifest.json"
+
+// manifest describes the declarations built into an output directory.
+//
+// Entities are listed in the order they are synced,
+// where each entity is listed after the entities it depends on.
+type manifest struct {
+	Entities []manifestEntity `json:"entities"`
+}
+
+// manifestEntity is a declared function, table, materialized view, external table or policy.
+type manifestEntity struct {
+	Name string `json:"name"`
+	// The kind of entity, i.e. function, table or materialized-view.
+	Kind string `json:"kind"`
+	// The command script file, relative to the output directory.
+	File string `json:"file"`
+	// The database folder of the entity.
+	Folder string `json:"folder"`
+	// The names of the entities that this entity references.
+	DependsOn []string `json:"dependsOn,omitempty"`
+	// The commands in File that sync the entity, in the order they are executed.
+	Commands []manifestCommand `json:"commands,omitempty"`
+}
+
+// manifestCommand is the location of a command in a command script file.
+type manifestCommand struct {
+	// The first line of the command, starting at 1.
+	Line int `json:"line"`
+	// The number of lines of the command.
+	Lines int `json:"lines"`
+}
+
+func newManifestEntity(src source) manifestEntity {
+	return manifestEntity{
+		Name:      src.decl.name,
+		Kind:      src.decl.declType.String(),
+		File:      filepath.ToSlash(src.out()),
+		Folder:    src.folder(),
+		DependsOn: src.dependsOn,
+	}
+}
+
+func writeManifest(outRoot string, m *manifest) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(outRoot, ManifestFile), content, 0666)
+	if err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	return nil
+}
+
+func readManifest(outRoot string) (*manifest, error) {
+	content, err := os.ReadFile(filepath.Join(outRoot, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf(
+			"%s not found in %s. Run 'ksd build' to rebuild the output directory", ManifestFile, outRoot)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+	return m, nil
+}
+
+// checkOutDir verifies that outRoot is an output directory that Build may clean:
+// either it does not exist, it is empty, or it holds a manifest of a previous build.
+func checkOutDir(outRoot string) error {
+	entries, err := os.ReadDir(outRoot)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading output directory: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(outRoot, ManifestFile)); err != nil {
+		return fmt.Errorf(
+			"output directory %s is not empty, and has no %s from a previous build. "+
+				"Use an empty or dedicated directory for the output, as it is cleaned on every build",
+			outRoot, ManifestFile)
+	}
+	return nil
+}
+
+// cleanOutDir removes the files of the previous build from outRoot, as listed in its manifest,
+// along with any directory that is left empty. Other files are kept.
+func cleanOutDir(outRoot string) error {
+	m, err := readManifest(outRoot)
+	if err != nil {
+		// nothing was built, as verified by checkOutDir
+		return nil
+	}
+
+	dirs := map[string]bool{}
+	for _, e := range m.Entities {
+		path := filepath.Join(outRoot, filepath.FromSlash(e.File))
+		// the manifest may have been edited, and must not remove files outside of outRoot
+		if !isWithin(outRoot, path) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for dir := filepath.Dir(path); dir != outRoot && isWithin(outRoot, dir); dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	if err := os.Remove(filepath.Join(outRoot, ManifestFile)); err != nil {
+		return err
+	}
+
+	// remove the deepest directories first, so that their parents can be removed when they are left empty
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, dir := range sorted {
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readCommands reads the commands of the entity from its command script file under outRoot.
+func readCommands(outRoot string, e manifestEntity) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(outRoot, filepath.FromSlash(e.File)))
+	if err != nil {
+		return nil, fmt.Errorf("reading file %s: %w", e.File, err)
+	}
+	script := strings.ReplaceAll(string(content), "\r\n", "\n")
+
+	if len(e.Commands) == 0 {
+		return []string{script}, nil
+	}
+
+	lines := strings.Split(script, "\n")
+	cmds := make([]string, 0, len(e.Commands))
+	for _, c := range e.Commands {
+		start := c.Line - 1
+		end := start + c.Lines
+		if start < 0 || end > len(lines) || c.Lines < 1 {
+			return nil, fmt.Errorf(
+				"file %s does not match %s. Run 'ksd build' to rebuild the output directory", e.File, ManifestFile)
+		}
+		cmds = append(cmds, strings.Join(lines[start:end], "\n"))
+	}
+
+	return cmds, nil
+}
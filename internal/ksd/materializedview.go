@@ -0,0 +1,123 @@
+package ksd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// viewOptions are the options of a materialized view declaration, set by annotations.
+type viewOptions struct {
+	// true to backfill the view with the existing records of the source table
+	backfill bool
+	// with backfill, only records ingested after this datetime are materialized, i.e. datetime(2023-01-01)
+	effectiveDateTime string
+	// the lookback period of the view, i.e. 6h
+	lookback string
+	// the dimension tables that the view query joins with
+	dimensionTables []string
+}
+
+// parseMaterializedView parses the source table and query of a materialized view that start at the cursor, i.e.:
+//
+//	(SourceTable) { query }
+func parseMaterializedView(s *scanner, decl *declaration) error {
+	if !s.accept('(') {
+		return s.errorf("expected '(' for source table of materialized view, found %s", s.describe())
+	}
+
+	s.skipSpace()
+	source, err := s.identifier()
+	if err != nil {
+		return err
+	}
+	decl.source = source
+
+	s.skipSpace()
+	if !s.accept(')') {
+		return s.errorf("expected ')' after source table '%s', found %s", source, s.describe())
+	}
+
+	s.skipSpace()
+	if err := parseBody(s, decl, "materialized view query"); err != nil {
+		return err
+	}
+
+	return s.expectEnd("materialized view query")
+}
+
+// viewProperties returns the properties of the '.create-or-alter materialized-view' command,
+// after folder and docstring.
+func viewProperties(opts viewOptions) string {
+	var b strings.Builder
+	if opts.backfill {
+		b.WriteString(",backfill=true")
+	}
+	if opts.effectiveDateTime != "" {
+		fmt.Fprintf(&b, ",effectiveDateTime=%s", opts.effectiveDateTime)
+	}
+	if opts.lookback != "" {
+		fmt.Fprintf(&b, ",lookback=%s", opts.lookback)
+	}
+	if len(opts.dimensionTables) > 0 {
+		tables := make([]string, 0, len(opts.dimensionTables))
+		for _, t := range opts.dimensionTables {
+			tables = append(tables, "\""+escapeString(t)+"\"")
+		}
+		fmt.Fprintf(&b, ",dimensionTables=dynamic([%s])", strings.Join(tables, ","))
+	}
+	return b.String()
+}
+
+var dateLiteral = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}([T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?Z?)?$`)
+
+// applyBackfillAnnotation applies '// @backfill' or '// @backfill true|false'.
+func applyBackfillAnnotation(decl *declaration, a annotation) error {
+	var err error
+	decl.view.backfill, err = boolAnnotation(a)
+	return err
+}
+
+// applyEffectiveDateTimeAnnotation applies '// @effectiveDateTime 2023-01-01'.
+func applyEffectiveDateTimeAnnotation(decl *declaration, a annotation) error {
+	value := a.value
+	if strings.HasPrefix(value, "datetime(") && strings.HasSuffix(value, ")") {
+		value = strings.TrimSpace(value[len("datetime(") : len(value)-1])
+	}
+
+	if !dateLiteral.MatchString(value) {
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@effectiveDateTime'. Expected a datetime, i.e. 2023-01-01", a.value)
+	}
+	decl.view.effectiveDateTime = "datetime(" + value + ")"
+	return nil
+}
+
+// applyLookbackAnnotation applies '// @lookback 6h'.
+func applyLookbackAnnotation(decl *declaration, a annotation) error {
+	if !timespanLiteral.MatchString(a.value) {
+		return newParseError(
+			a.row, a.col, "invalid value '%s' for '@lookback'. Expected a timespan, i.e. 6h", a.value)
+	}
+	decl.view.lookback = a.value
+	return nil
+}
+
+// applyDimensionTablesAnnotation applies '// @dimensionTables Table1, Table2'.
+func applyDimensionTablesAnnotation(decl *declaration, a annotation) error {
+	tables := []string{}
+	for _, v := range strings.Split(a.value, ",") {
+		s, err := newScanner(strings.TrimSpace(v), a.row, a.col)
+		var name string
+		if err == nil {
+			name, err = s.identifier()
+		}
+		if err != nil || !s.eof() {
+			return newParseError(
+				a.row, a.col, "invalid value '%s' for '@dimensionTables'. Expected a comma-separated list of tables", a.value)
+		}
+		tables = append(tables, name)
+	}
+	decl.view.dimensionTables = tables
+	return nil
+}
@@ -1,464 +1,196 @@
 package ksd
 
 import (
-	"bufio"
-	"errors"
 	"fmt"
 	"io"
 	"strings"
-	"unicode"
 )
 
-type lexer struct {
-	r        *bufio.Reader
-	token    string
-	tokenBuf strings.Builder
-
-	err error
-	row int
-	col int
+type ParseError struct {
+	// the file that contains the error, relative to the source root
+	file string
+	row  int
+	col  int
+	msg  string
+	// the lint rule that reports the error. Empty for errors found by parsing and building.
+	rule string
 }
 
-func newLexer(reader *bufio.Reader) *lexer {
-	return &lexer{
-		r: reader,
+func (e *ParseError) Error() string {
+	if e.file != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.file, e.row, e.col, e.msg)
 	}
+	return fmt.Sprintf("[%d,%d] %s", e.row, e.col, e.msg)
 }
 
-// advances the cursor to past the newline character.
-//
-// the line, including newline character, is saved to tokenBuf.
-func (l *lexer) readLine() (hasMore bool) {
-	line, err := l.r.ReadString('\n')
-	if line == "" && err == io.EOF {
-		return false
+func newParseError(row int, col int, m string, args ...any) *ParseError {
+	return &ParseError{
+		row: row,
+		col: col,
+		msg: fmt.Sprintf(m, args...),
 	}
+}
 
-	if err != io.EOF && err != nil {
-		l.err = err
-		return false
+// parse parses the declarations in a Kusto source file, in the order they are declared.
+// The errors of all declarations are returned, joined.
+func parse(reader io.Reader) ([]*declaration, error) {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
 	}
 
-	l.row += 1
-	l.col = 0
-	l.tokenBuf.WriteString(line)
-	return true
+	decls, diags := parseFile(string(content))
+	return decls, diags.err()
 }
 
-// advances the cursor to past the newline character.
+// parseFile parses the declarations in the contents of a Kusto source file, in the order they are declared.
 //
-// the tokenBuf is consumed as token, and tokenBuf is reset.
-func (l *lexer) consumeLine() (hasMore bool) {
-	hasMore = l.readLine()
-	l.token = l.tokenBuf.String()
-	l.tokenBuf.Reset()
-	return hasMore
-}
-
-// advances the cursor to the first non-space character.
+// Each declaration is a 'let' statement, preceded by an optional block of '//' comments
+// that contains its docstring and annotations.
 //
-// whitespace is discarded.
-// the first non-space character is saved into the tokenBuf.
-func (l *lexer) skipSpace() (hasMore bool) {
-	for {
-		r, _, err := l.r.ReadRune()
-		if err == io.EOF {
-			return false
-		} else if err != nil {
-			l.err = err
-			return false
-		}
-
-		if r == '\n' {
-			l.row += 1
-			l.col = 1
-		} else {
-			l.col += 1
-		}
-
-		if !unicode.IsSpace(r) {
-			_, err := l.tokenBuf.WriteRune(r)
-			if err != nil {
-				l.err = err
-				return false
-			}
-
-			break
-		}
-	}
-
-	return true
-}
-
-// advances the cursor to the first space character.
-// the tokenBuf is consumed as token, and tokenBuf is reset.
-func (l *lexer) consumeToken() (hasMore bool) {
-	more := l.readToken()
-
-	if l.tokenBuf.Len() > 0 {
-		l.token = l.tokenBuf.String()
-		l.tokenBuf.Reset()
+// Parsing continues after a declaration with an error, at the next 'let' statement at the start of a line,
+// so that the errors in every declaration are reported. Only declarations without errors are returned.
+func parseFile(content string) ([]*declaration, Diagnostics) {
+	diags := Diagnostics{}
+	s, err := newScanner(content, 1, 1)
+	if err != nil {
+		_ = diags.add("", err)
+		return nil, diags
 	}
 
-	return more
-}
-
-// advances the cursor to the first space character.
-// the character is written to tokenBuf.
-func (l *lexer) readToken() (hasMore bool) {
+	decls := []*declaration{}
+	declared := map[string]*declaration{}
 	for {
-		r, _, err := l.r.ReadRune()
-		if err == io.EOF {
-			return false
-		} else if err != nil {
-			l.err = err
-			return false
-		}
-
-		if r == '\n' {
-			l.row += 1
-			l.col = 1
-		} else {
-			l.col += 1
-		}
-
-		if unicode.IsSpace(r) {
+		comments := s.leadingComments()
+		if s.eof() {
 			break
 		}
 
-		_, err = l.tokenBuf.WriteRune(r)
-		if err != nil {
-			l.err = err
-			return false
+		decl := &declaration{}
+		decl.doc, decl.annotations = parseComments(comments)
+		if err := parseDeclaration(s, decl); err != nil {
+			_ = diags.add("", err)
+			s.recover()
+			continue
 		}
-	}
-
-	return true
-}
 
-// advances the cursor to one-past the first occurence of delim byte.
-//
-// the presence of the delim byte inside a quoted string,
-// single-quote or double-quote, is considered an escape
-// character and is ignored.
-//
-// all bytes read (including whitespace and delim) are saved to
-// token, and the tokenBuf is cleared.
-func (l *lexer) consumeTill(s byte) (hasMore bool) {
-	inString := false
-	for {
-		r, _, err := l.r.ReadRune()
-		if err == io.EOF {
-			return false
-		} else if err != nil {
-			l.err = err
-			return false
+		if prev, has := declared[decl.name]; has {
+			_ = diags.add("", newParseError(
+				decl.row, decl.col, "'%s' is already declared on line %d", decl.name, prev.row))
+			continue
 		}
+		declared[decl.name] = decl
 
-		if r == '\n' {
-			l.row += 1
-			l.col = 1
-		} else {
-			l.col += 1
+		if err := applyAnnotations(decl); err != nil {
+			_ = diags.add("", err)
+			continue
 		}
 
-		if r == '\'' || r == '"' {
-			inString = !inString
+		if check, has := declChecks[decl.declType]; has {
+			if err := check(decl); err != nil {
+				_ = diags.add("", err)
+				continue
+			}
 		}
 
-		_, err = l.tokenBuf.WriteRune(r)
-		if err != nil {
-			l.err = err
-			return false
-		}
-
-		if !inString && byte(r) == s {
-			break
+		if decl.declType == tableType && decl.rows != "" && decl.dataMode == dataNone {
+			diags = append(diags, newWarning(
+				decl.row, decl.col,
+				"rows within datatable are not synced unless the table is annotated with '// @data replace' "+
+					"or '// @data append', and are ignored"))
 		}
+		decls = append(decls, decl)
 	}
 
-	l.token = l.tokenBuf.String()
-	l.tokenBuf.Reset()
-	return true
-}
-
-var errNonDelimWhitespaceFound = errors.New("non-whitespace, non-delim char found")
-
-// advances the cursor to one-past the first occurence of delim byte.
-//
-// whitespace is ignored and discarded when advancing the cursor.
-// if non-whitespace, non-delim char is found, errNonDelimWhitespaceFound is returned.
-//
-// the delim byte is saved into tokenBuf.
-func (l *lexer) readSpaced(s rune) (hasMore bool) {
-	hasMore = l.readSpacedFunc(func(r rune) bool {
-		return r == s
-	})
-	return
+	if len(decls) == 0 && len(diags) == 0 {
+		_ = diags.add("", s.errorf("parsing file: missing 'let' statement in file"))
+	}
+	return decls, diags
 }
 
-// delimFunc is used in functions like readSpaceFunc
-// that returns true if the rune present is a
-// delimiter.
-type delimFunc func(s rune) bool
-
-// advances the cursor to one-past the first occurence of the delimiter
-// as specified by delimFunc.
-//
-// whitespace is ignored and discarded when advancing the cursor.
-// if non-whitespace, non-delim char is found, errNonDelimWhitespaceFound is returned.
-//
-// the delimiter is saved into tokenBuf.
-func (l *lexer) readSpacedFunc(f delimFunc) (hasMore bool) {
-	for {
-		r, _, err := l.r.ReadRune()
-		if err == io.EOF {
-			return false
-		} else if err != nil {
-			l.err = err
-			return false
-		}
-
-		if r == '\n' {
-			l.row += 1
-			l.col = 1
-		} else {
-			l.col += 1
+// parseComments returns the docstring and annotations in the comment block that precedes a declaration.
+func parseComments(comments []commentLine) (doc string, annotations []annotation) {
+	annotations = []annotation{}
+	lines := []string{}
+	for _, c := range comments {
+		if a, ok := parseAnnotation(c.text, c.row); ok {
+			annotations = append(annotations, a)
+			continue
 		}
-
-		if unicode.IsSpace(r) {
+		// lint directives are not documentation
+		if _, ok := parseIgnore(c.text); ok {
 			continue
-		} else if f(r) {
-			_, err = l.tokenBuf.WriteRune(r)
-			if err != nil {
-				l.err = err
-				return false
-			}
-			return true
 		}
 
-		l.err = errNonDelimWhitespaceFound
-		return false
+		comment := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(c.text), "//"))
+		lines = append(lines, comment)
 	}
-}
-
-type ParseError struct {
-	row int
-	col int
-	msg string
-}
 
-func (e *ParseError) Error() string {
-	return fmt.Sprintf("[%d,%d] %s", e.row, e.col, e.msg)
+	return strings.Join(lines, " "), annotations
 }
 
-func (l *lexer) Errorf(m string, args ...any) error {
-	return &ParseError{
-		row: l.row,
-		col: l.col,
-		msg: fmt.Sprintf(m, args...),
-	}
-}
-
-func parse(reader io.ReadSeeker) (*declaration, error) {
-	lexer := newLexer(bufio.NewReader(reader))
-	letFound := false
-	comments := make([]string, 0, 20)
-	offset := int64(0)
-	for lexer.consumeLine() {
-		line := lexer.token
-		if strings.HasPrefix(strings.TrimLeftFunc(line, unicode.IsSpace), "let") {
-			letFound = true
-			break
-		}
-
-		comments = append(comments, line)
-		offset += int64(len(line))
-	}
-
-	if !letFound {
-		return nil, lexer.Errorf("parsing file: missing 'let' statement in file")
-	}
-
-	start := len(comments) - 1
-	for start >= 0 && strings.HasPrefix(comments[start], "//") {
-		start--
-	}
-
-	var docs strings.Builder
-	var docstring string
-	if start < len(comments)-1 {
-		for i := start + 1; i < len(comments); i++ {
-			comment := strings.TrimSpace(comments[i][2:])
-			// escape all double-quotes
-			comment = strings.ReplaceAll(comment, "\"", "\\\"")
-			docs.WriteString(comment)
-			docs.WriteString(" ")
-		}
-		docstring = docs.String()[:docs.Len()-1]
-	}
-
-	_, err := reader.Seek(offset, io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("seeking file: %w", err)
-	}
-	lexer.row -= 1
-	lexer.col = 0
-	lexer.r.Reset(reader)
-	lexer.token = ""
-	lexer.tokenBuf.Reset()
-
-	decl := &declaration{doc: docstring}
-	err = parseDeclaration(lexer, decl)
+// parseDeclaration parses the 'let' statement at the cursor.
+//
+// We parse five kinds of declaration:
+//
+//	functions:          let {name} = ({signature}) { {body} }
+//	tables:             let {name} = datatable ({schema}) [ {rows} ]
+//	materialized views: let {name} = materialized_view ({source table}) { {query} }
+//	external tables:    let {name} = external_table ({schema})
+//	continuous exports: let {name} = continuous_export ({external table}) { {query} }
+func parseDeclaration(s *scanner, decl *declaration) error {
+	row, col := s.row, s.col
+	if s.tok().kind != tokenIdentifier {
+		return s.errorf("expected 'let' statement, found %s", s.describe())
+	}
+	if keyword, _ := s.identifier(); keyword != "let" {
+		return newParseError(row, col, "expected 'let' statement, found '%s'", keyword)
+	}
+
+	s.skipSpace()
+	decl.row, decl.col = s.row, s.col
+	name, err := s.identifier()
 	if err != nil {
-		return nil, fmt.Errorf("parsing declaration: %w", err)
-	}
-	return decl, nil
-}
-
-func parseDeclaration(
-	lex *lexer,
-	decl *declaration) error {
-	// We parse two kinds of declaration:
-	// functions:
-	// let \s+ {name} \s*  = \s* ({signature}) \s* {
-	// tables:
-	// let \s+ {name} \s*  = \s* datatable \s* ({signature}) \s+ {
-	for {
-		switch decl.parseState {
-		case 0: // \s*let
-			lex.skipSpace()
-			lex.consumeToken()
-			if lex.token != "let" {
-				return lex.Errorf("expected 'let' statement, found %s", lex.token)
-			}
-		case 1: // \s+name\s*'='
-			lex.skipSpace()
-			lex.consumeTill('=')
-			if lex.err != nil {
-				return lex.err
-			}
-
-			if !strings.HasSuffix(lex.token, "=") {
-				return lex.Errorf("expected variable assignment '=' after identifier")
-			}
-
-			// letters, digits, underscores (_), spaces, dots (.), and dashes (-).
-			// Identifiers consisting only of letters, digits, and underscores don't require quoting when the identifier is being referenced.
-			//Identifiers containing at least one of (spaces, dots, or dashes) do require quoting (see below).
-			isIdentifier := func(r rune) bool {
-				return unicode.IsLetter(r) ||
-					unicode.IsDigit(r) ||
-					r == '_'
-			}
-			var name strings.Builder
-			for _, v := range lex.token[:len(lex.token)-1] {
-				if isIdentifier(v) {
-					name.WriteRune(v)
-					continue
-				}
-
-				if !unicode.IsSpace(v) {
-					return lex.Errorf("unexpected character '%s'", string(v))
-				}
-			}
-
-			decl.name = name.String()
-		case 2: // \s*[datatable]\s*({signature})
-			found := lex.readSpacedFunc(func(s rune) bool {
-				return string(s) == "d" || string(s) == "("
-			})
-			if lex.err == errNonDelimWhitespaceFound {
-				return lex.Errorf("expected '(' for function declaration, or 'datatable' for table declaration")
-			} else if lex.err != nil {
-				return lex.err
-			} else if !found {
-				return lex.Errorf("expected '(' for function declaration, or 'datatable' for table declaration")
-			}
-
-			switch lex.tokenBuf.String() {
-			case "d":
-				decl.declType = tableType
-				lex.consumeTill('(')
-				if lex.err != nil {
-					return lex.err
-				}
-
-				if !strings.HasPrefix(lex.token, "datatable") {
-					return lex.Errorf("invalid keyword. expected 'datatable' for table declaration")
-				}
-
-				start := len("datatable")
-				for i, v := range lex.token[start : len(lex.token)-1] {
-					if !unicode.IsSpace(v) {
-						lex.col = lex.col + (i - len(lex.token))
-						return lex.Errorf("invalid character '%s'", string(v))
-					}
-				}
-
-				_, err := lex.tokenBuf.WriteString("(")
-				if err != nil {
-					return err
-				}
-			case "(":
-				decl.declType = functionType
-				// we currently do not parse the signature due to language complications,
-				// instead, everything is allowed through
-				// and stored as the body of the function.
-				for lex.readLine() {
-				}
-				if lex.err != nil {
-					return lex.err
-				}
-
-				lex.consumeToken()
-				decl.body = lex.token
-				return nil
-			}
-
-			found = lex.consumeTill(')')
-			if lex.err != nil {
-				return lex.err
-			} else if !found {
-				return lex.Errorf("unmatched parenthesis, missing ')' in declaration signature")
-			}
-
-			decl.signature = lex.token
-		// Table: \s*[\s*]
-		case 3:
-			switch decl.declType {
-			case tableType:
-				found := lex.readSpaced('[')
-				if lex.err == errNonDelimWhitespaceFound {
-					return lex.Errorf("unexpected character found. expected '[' for beginning of table body")
-				} else if lex.err != nil {
-					return lex.err
-				} else if !found {
-					return lex.Errorf("expected '[' for beginning of table body")
-				}
-
-				found = lex.consumeTill(']')
-				if lex.err != nil {
-					return lex.err
-				} else if !found {
-					return lex.Errorf("unmatched brackets, missing ']' for end of table body")
-				}
-
-				for i, v := range lex.token {
-					// a non-space character found inbetween brackets
-					if v != '[' && v != ']' && !unicode.IsSpace(v) {
-						fmt.Printf("WARNING: Syncing data within datatable syntax is not currently supported. The following contents will be ignored:\n%s\n", lex.token[i:len(lex.token)-1])
-						break
-					}
-				}
-				decl.body = ""
-				return nil
-			default:
-				panic(fmt.Sprintf("unsupported declaration type: %d", decl.declType))
-			}
-		default:
-			return nil
-		}
-		decl.parseState += 1
+		return err
+	}
+	decl.name = name
+
+	s.skipSpace()
+	if !s.accept('=') {
+		return s.errorf("expected variable assignment '=' after identifier '%s', found %s", name, s.describe())
+	}
+
+	s.skipSpace()
+	if s.tok().is("(") {
+		decl.declType = functionType
+		return parseFunction(s, decl)
+	}
+
+	row, col = s.row, s.col
+	keyword, err := s.identifier()
+	switch {
+	case err == nil && keyword == "datatable":
+		decl.declType = tableType
+		s.skipSpace()
+		return parseTable(s, decl)
+	case err == nil && keyword == "materialized_view":
+		decl.declType = materializedViewType
+		s.skipSpace()
+		return parseMaterializedView(s, decl)
+	case err == nil && keyword == "external_table":
+		decl.declType = externalTableType
+		s.skipSpace()
+		return parseExternalTable(s, decl)
+	case err == nil && keyword == "continuous_export":
+		decl.declType = continuousExportType
+		s.skipSpace()
+		return parseContinuousExport(s, decl)
+	default:
+		return newParseError(
+			row, col,
+			"expected '(' for function declaration, 'datatable' for table declaration, "+
+				"'materialized_view' for materialized view declaration, "+
+				"'external_table' for external table declaration, "+
+				"or 'continuous_export' for continuous export declaration")
 	}
 }
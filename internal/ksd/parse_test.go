@@ -13,20 +13,22 @@ func Test_parse_decl(t *testing.T) {
 		name  string
 		input string
 	}{
-		{"fn", "let x=(any){ok}"},
-		{"fn_spaced", "let x = (any){ok}"},
-		{"fn_spaced_newline", "let\nx\n=\n(any){ok}"},
-		{"fn_comments", "//c1\n//c2\n//c3\nlet x=(any){ok}"},
-
-		{"table", "let x=datatable(any)[ok]"},
-		{"table_spaced", "let x = datatable(any) [ ok ]"},
-		{"table_spaced_newline", "let\nx\n=\ndatatable(\nany\n)[\nok\n]"},
-		{"table_comments", "//c1\n//c2\n//c3\nlet x=datatable(any)[ok]"},
+		{"fn", "let x=(a:int){ok}"},
+		{"fn_spaced", "let x = (a:int) {ok}"},
+		{"fn_spaced_newline", "let\nx\n=\n(a:int)\n{ok}"},
+		{"fn_comments", "//c1\n//c2\n//c3\nlet x=(a:int){ok}"},
+
+		{"table", "let x=datatable(a:int)[]"},
+		{"table_spaced", "let x = datatable(a:int) [ ]"},
+		{"table_spaced_newline", "let\nx\n=\ndatatable(\na:int\n)[\n\n]"},
+		{"table_comments", "//c1\n//c2\n//c3\nlet x=datatable(a:int)[]"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			decl, err := parse(strings.NewReader(tt.input))
+			decls, err := parse(strings.NewReader(tt.input))
 			require.NoError(t, err)
+			require.Len(t, decls, 1)
+			decl := decls[0]
 			declType := declType(functionType)
 			if strings.HasPrefix(tt.name, "table") {
 				declType = tableType
@@ -35,8 +37,10 @@ func Test_parse_decl(t *testing.T) {
 			assert.Equal(t, "x", decl.name)
 			assert.Equal(t, declType, decl.declType)
 			if declType == functionType {
-				assert.Equal(t, "(any){ok}", decl.body)
+				assert.Equal(t, "(a:int)", decl.signature)
+				assert.Equal(t, "{ok}", decl.body)
 			} else {
+				assert.Equal(t, []column{{name: "a", typ: "int", row: decl.columns[0].row, col: decl.columns[0].col}}, decl.columns)
 				assert.Empty(t, decl.body)
 			}
 
@@ -54,17 +58,30 @@ func Test_parse_syntax(t *testing.T) {
 		name  string
 		input string
 	}{
-		{"fn", "let x=("},
-		{"fn_spaced", "let x = ( any    ) { ok }"},
-		{"fn_spaced_newline", "let\nx\n=\n(\nany\n)\n{\nok\n}"},
-		{"fn_filled", "let x=(anythinghereisokay"},
-		{"fn_comments", "//c1\n//c2\n//c3\nlet x=("},
+		{"fn", "let x=(){}"},
+		{"fn_spaced", "let x = ( a : int    ) { ok }"},
+		{"fn_spaced_newline", "let\nx\n=\n(\na\n:\nint\n)\n{\nok\n}"},
+		{"fn_filled", "let x=(a:int, T:(*), ['b']:string='),{'){ T | take a }"},
+		{"fn_comments", "//c1\n//c2\n//c3\nlet x=(){}"},
+		{"fn_signature_comments", "let x=(\n// the count\na:int // trailing\n){}"},
+		{"fn_trailing_semicolon", "let x=(){};\n"},
 
 		{"table", "let x=datatable()[]"},
-		{"table_spaced", "let x = datatable ( any ) [ ok ] "},
-		{"table_spaced_newline", "let\nx\n=\ndatatable\n(\nany\n)[\n\n]"},
-		{"table_filled", "let x = datatable(a,b,c,d)[any]"},
+		{"table_spaced", "let x = datatable ( a : int ) [ ] "},
+		{"table_spaced_newline", "let\nx\n=\ndatatable\n(\na\n:\nint\n)[\n\n]"},
+		{"table_filled", "let x = datatable(a:int,['b']:string,c:double,d:boolean)[]"},
+		{"table_types", "let x = datatable(a:bool,b:datetime,c:date,d:decimal,e:dynamic,f:guid,g:uniqueid,h:int,i:long,j:real,k:string,l:timespan,m:time)[]"},
 		{"table_comments", "//c1\n//c2\n//c3\nlet x=datatable()[]"},
+		{"table_rows", "let x = datatable(a:int, b:string, c:real)[1, 'one', 1.0, -2, @'two', 2e3,]"},
+		{"table_rows_typed", "let x = datatable(a:datetime, b:dynamic, c:long, d:timespan)[datetime(2023-01-01), dynamic({'k': [1]}), long(null), 1d]"},
+		{"table_data_replace", "// @data replace\nlet x = datatable(a:int)[1, 2]"},
+		{"table_data_append", "// doc\n// @data append\nlet x = datatable(a:int)[1]"},
+		{"view", "let x = materialized_view(T) { T | summarize count() by a }"},
+		{"view_quoted", "let x=materialized_view(['my table']){['my table'] | summarize take_any(*) by a}"},
+		{"view_options", "// @backfill\n// @effectiveDateTime 2023-01-01\n// @lookback 6h\n// @dimensionTables A, ['B c']\nlet x = materialized_view(T) { T | summarize arg_max(t, *) by a }"},
+		{"table_updatePolicy", "// @updatePolicy Source=Raw Function=Transform\nlet x = datatable(a:int)[]"},
+		{"table_updatePolicies", "// @updatePolicy Source=Raw Function=Transform IsTransactional=true PropagateIngestionProperties=false\n// @updatePolicy Source=['Other raw'] Function=Other\nlet x = datatable(a:int)[]"},
+		{"multiple", "let x=(){};\nlet y=datatable()[]\n\n// doc\nlet z=(){} // trailing\n// trailing\n"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -90,6 +107,81 @@ func Test_parse_syntax_errors(t *testing.T) {
 		{"missingTableSig", "// comment\nlet x=datatable"},
 		{"missingTableClose", "// comment\nlet x=datatable("},
 		{"missingTableClose", "// comment\nlet x=datatable("},
+
+		{"missingFnSigClose", "// comment\nlet x=("},
+		{"missingFnParamType", "// comment\nlet x=(any){}"},
+		{"invalidFnParamName", "// comment\nlet x=(1a:int){}"},
+		{"missingFnParamComma", "// comment\nlet x=(a:int b:int){}"},
+		{"missingFnDefault", "// comment\nlet x=(a:int=){}"},
+		{"invalidFnSchema", "// comment\nlet x=(T:(*, a:int)){}"},
+		{"missingFnBody", "// comment\nlet x=(a:int)"},
+		{"missingFnBodyClose", "// comment\nlet x=(a:int){ T | where a == '}'"},
+		{"trailingFnContent", "// comment\nlet x=(){}\nx()"},
+
+		{"invalidTableSchema", "// comment\nlet x=datatable(a)[]"},
+		{"invalidTableType", "// comment\nlet x=datatable(a:datatime)[]"},
+		{"invalidTableWildcard", "// comment\nlet x=datatable(a:int, *)[]"},
+		{"duplicateTableColumn", "// comment\nlet x=datatable(a:int, a:string)[]"},
+		{"missingTableBody", "// comment\nlet x=datatable(a:int)"},
+		{"missingTableBodyClose", "// comment\nlet x=datatable(a:int)["},
+		{"invalidFnParamType", "// comment\nlet x=(a:integer){}"},
+		{"invalidFnSchemaType", "// comment\nlet x=(T:(a:strin)){}"},
+
+		{"tableRowsCount", "// comment\nlet x=datatable(a:int, b:int)[1, 2, 3]"},
+		{"tableRowsType", "// comment\nlet x=datatable(a:int)['one']"},
+		{"tableRowsTypedLiteral", "// comment\nlet x=datatable(a:int)[datetime(null)]"},
+		{"tableRowsUntypedNull", "// comment\nlet x=datatable(a:int)[null]"},
+		{"tableRowsExpression", "// comment\nlet x=datatable(a:int)[1 + 2]"},
+		{"tableRowsNoColumns", "// comment\nlet x=datatable()[1]"},
+		{"invalidDataMode", "// @data merge\nlet x=datatable(a:int)[1]"},
+		{"duplicateAnnotation", "// @data replace\n// @data append\nlet x=datatable(a:int)[1]"},
+		{"unknownAnnotation", "// @data replace\nlet x=(){}"},
+		{"misspelledAnnotation", "// @views\nlet x=(){}"},
+		{"invalidFnView", "// @view yes\nlet x=(){}"},
+		{"invalidFnSkipValidation", "// @skipvalidation 1\nlet x=(){}"},
+		{"emptyFnFolder", "// @folder /\nlet x=(){}"},
+		{"duplicateFnFolder", "// @folder A\n// @folder B\nlet x=(){}"},
+
+		{"missingViewSource", "// comment\nlet x=materialized_view(){ T }"},
+		{"missingViewSourceClose", "// comment\nlet x=materialized_view(T { T }"},
+		{"missingViewQuery", "// comment\nlet x=materialized_view(T)"},
+		{"invalidViewBackfill", "// @backfill yes\nlet x=materialized_view(T){ T }"},
+		{"invalidViewEffectiveDateTime", "// @effectiveDateTime yesterday\nlet x=materialized_view(T){ T }"},
+		{"invalidViewLookback", "// @lookback 6 hours\nlet x=materialized_view(T){ T }"},
+		{"invalidViewDimensionTables", "// @dimensionTables A B\nlet x=materialized_view(T){ T }"},
+		{"viewDataAnnotation", "// @data replace\nlet x=materialized_view(T){ T }"},
+		{"tableViewAnnotation", "// @lookback 6h\nlet x=datatable(a:int)[]"},
+
+		{"updatePolicyMissingSource", "// @updatePolicy Function=Transform\nlet x=datatable(a:int)[]"},
+		{"updatePolicyMissingFunction", "// @updatePolicy Source=Raw\nlet x=datatable(a:int)[]"},
+		{"updatePolicyUnknownProperty", "// @updatePolicy Source=Raw Function=Transform Enabled=true\nlet x=datatable(a:int)[]"},
+		{"updatePolicyInvalidProperty", "// @updatePolicy Source=Raw Function=Transform IsTransactional\nlet x=datatable(a:int)[]"},
+		{"updatePolicyInvalidBool", "// @updatePolicy Source=Raw Function=Transform IsTransactional=yes\nlet x=datatable(a:int)[]"},
+		{"updatePolicyInvalidName", "// @updatePolicy Source=Raw() Function=Transform\nlet x=datatable(a:int)[]"},
+		{"updatePolicyOnFunction", "// @updatePolicy Source=Raw Function=Transform\nlet x=(){}"},
+
+		{"missingExternalSchema", "// @dataFormat csv\n// @connection https://a.blob.core.windows.net/c\nlet x=external_table"},
+		{"externalRows", "// @dataFormat csv\n// @connection https://a.blob.core.windows.net/c\nlet x=external_table(a:int)[]"},
+		{"externalTableAnnotation", "// @data replace\nlet x=external_table(a:int)"},
+
+		{"missingExportTarget", "// @intervalBetweenRuns 1h\nlet x=continuous_export(){ T }"},
+		{"missingExportQuery", "// @intervalBetweenRuns 1h\nlet x=continuous_export(E)"},
+		{"missingExportInterval", "let x=continuous_export(E){ T }"},
+		{"invalidExportInterval", "// @intervalBetweenRuns hourly\nlet x=continuous_export(E){ T }"},
+		{"invalidExportForcedLatency", "// @intervalBetweenRuns 1h\n// @forcedLatency soon\nlet x=continuous_export(E){ T }"},
+		{"invalidExportSizeLimit", "// @intervalBetweenRuns 1h\n// @sizeLimit 1GB\nlet x=continuous_export(E){ T }"},
+		{"invalidExportDistributed", "// @intervalBetweenRuns 1h\n// @distributed yes\nlet x=continuous_export(E){ T }"},
+		{"invalidExportOver", "// @intervalBetweenRuns 1h\n// @over A B\nlet x=continuous_export(E){ T }"},
+
+		{"unterminatedQuotedName", "let ['x = (){}"},
+		{"missingQuotedNameClose", "let ['x' = (){}"},
+		{"emptyQuotedName", "let [''] = (){}"},
+		{"unquotedDashName", "let my-func = (){}"},
+		{"duplicateQuotedDecl", "let ['x']=(){}\nlet x=datatable(a:int)[]"},
+
+		{"duplicateDecl", "let x=(){}\nlet x=datatable(a:int)[]"},
+		{"sameLineDecl", "let x=(){} let y=(){}"},
+		{"trailingContentBetweenDecls", "let x=(){}\nx()\nlet y=(){}"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -98,3 +190,393 @@ func Test_parse_syntax_errors(t *testing.T) {
 		})
 	}
 }
+
+func Test_parse_signature(t *testing.T) {
+	input := `let Fn = (
+    start:datetime = datetime(1990-01-01 00:00:00.0),
+    ['match regex']:string = '^(\s+){abc}(\s+)$',
+    T:(['Timestamp']:datetime, Value:int),
+    Any:(*),
+    Some:(Value:int, *),
+    a:dynamic = dynamic({"b": [1, 2]})) {
+    T
+}`
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	decl := decls[0]
+
+	assert.Equal(t, []parameter{
+		{name: "start", typ: "datetime", defaultValue: "datetime(1990-01-01 00:00:00.0)", row: 2, col: 5},
+		{name: "match regex", typ: "string", defaultValue: `'^(\s+){abc}(\s+)$'`, row: 3, col: 5},
+		{name: "T", tabular: true, columns: []column{{name: "Timestamp", typ: "datetime", row: 4, col: 8}, {name: "Value", typ: "int", row: 4, col: 32}}, row: 4, col: 5},
+		{name: "Any", tabular: true, columns: []column{}, wildcard: true, row: 5, col: 5},
+		{name: "Some", tabular: true, columns: []column{{name: "Value", typ: "int", row: 6, col: 11}}, wildcard: true, row: 6, col: 5},
+		{name: "a", typ: "dynamic", defaultValue: `dynamic({"b": [1, 2]})`, row: 7, col: 5},
+	}, decl.params)
+	assert.Equal(t, "{\n    T\n}", decl.body)
+}
+
+func Test_parse_signature_errorPosition(t *testing.T) {
+	_, err := parse(strings.NewReader("// comment\nlet x = (\n  a:int,\n  b int) {}"))
+	require.Error(t, err)
+
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, 4, parseErr.row)
+	assert.Equal(t, 5, parseErr.col)
+}
+
+func Test_parse_table_typeError(t *testing.T) {
+	_, err := parse(strings.NewReader("// Metrics\nlet Metrics = datatable (\n    ['Timestamp']:datatime,\n    Value:int)\n[]"))
+	require.Error(t, err)
+
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, 3, parseErr.row)
+	assert.Equal(t, 19, parseErr.col)
+	assert.Equal(t, "unknown type 'datatime'. Did you mean 'datetime'?", parseErr.msg)
+}
+
+func Test_parse_table_data(t *testing.T) {
+	decls, err := parse(strings.NewReader("// Regions\n// @data replace\nlet Region = datatable(Code:string)\n[\n    'eu',\n    'us'\n]"))
+	require.NoError(t, err)
+	decl := decls[0]
+
+	assert.Equal(t, "Regions", decl.doc)
+	assert.Equal(t, dataReplace, decl.dataMode)
+	assert.Equal(t, "'eu',\n    'us'", decl.rows)
+}
+
+func Test_parse_table_rowsError(t *testing.T) {
+	_, err := parse(strings.NewReader("// @data replace\nlet Region = datatable(Code:string, Id:int)\n[\n    'eu', 1,\n    'us', 'two'\n]"))
+	require.Error(t, err)
+
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, 5, parseErr.row)
+	assert.Equal(t, 11, parseErr.col)
+	assert.Equal(t, "value 'two' does not match type 'int' of column 'Id'", parseErr.msg)
+}
+
+func Test_parse_multiple(t *testing.T) {
+	input := `// Unrelated comment
+
+// Helper
+let Helper = (a:int) { a + 1 };
+
+// Main
+// function
+let Main = () {
+    print Helper(1)
+}
+let Table = datatable(a:int)[]
+`
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Len(t, decls, 3)
+
+	assert.Equal(t, "Helper", decls[0].name)
+	assert.Equal(t, "Helper", decls[0].doc)
+	assert.Equal(t, 4, decls[0].row)
+	assert.Equal(t, 5, decls[0].col)
+
+	assert.Equal(t, "Main", decls[1].name)
+	assert.Equal(t, "Main function", decls[1].doc)
+	assert.Equal(t, "{\n    print Helper(1)\n}", decls[1].body)
+	assert.Equal(t, 8, decls[1].row)
+
+	assert.Equal(t, "Table", decls[2].name)
+	assert.Equal(t, declType(tableType), decls[2].declType)
+	assert.Empty(t, decls[2].doc)
+}
+
+func Test_parse_multiple_errorPosition(t *testing.T) {
+	_, err := parse(strings.NewReader("let A = () { print 1 }\n\nlet B = (x:strin) { print x }"))
+	require.Error(t, err)
+
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, 3, parseErr.row)
+	assert.Equal(t, 12, parseErr.col)
+
+	_, err = parse(strings.NewReader("let A = () { print 1 }\n\nlet A = () { print 2 }"))
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, 3, parseErr.row)
+	assert.Equal(t, 5, parseErr.col)
+	assert.Equal(t, "'A' is already declared on line 1", parseErr.msg)
+}
+
+func Test_parse_materializedView(t *testing.T) {
+	input := `// Daily request counts
+// @backfill
+// @effectiveDateTime datetime(2023-01-01)
+// @lookback 6h
+// @dimensionTables Region, ['Service Map']
+let DailyRequests = materialized_view(Requests) {
+    Requests
+    | summarize count() by bin(Timestamp, 1d)
+}`
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	decl := decls[0]
+
+	assert.Equal(t, declType(materializedViewType), decl.declType)
+	assert.Equal(t, "DailyRequests", decl.name)
+	assert.Equal(t, "Requests", decl.source)
+	assert.Equal(t, "Daily request counts", decl.doc)
+	assert.Equal(t, viewOptions{
+		backfill:          true,
+		effectiveDateTime: "datetime(2023-01-01)",
+		lookback:          "6h",
+		dimensionTables:   []string{"Region", "Service Map"},
+	}, decl.view)
+}
+
+func Test_parse_updatePolicy(t *testing.T) {
+	input := `// Parsed events
+// @updatePolicy Source=RawEvents Function=ParseEvents IsTransactional=true
+// @updatePolicy Source=['Legacy Events'] Function=ParseLegacyEvents PropagateIngestionProperties=true
+let Events = datatable(Timestamp:datetime, Name:string)[]`
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Len(t, decls, 1)
+
+	assert.Equal(t, "Parsed events", decls[0].doc)
+	assert.Equal(t, []updatePolicy{
+		{source: "RawEvents", function: "ParseEvents", transactional: true, row: 2, col: 4},
+		{source: "Legacy Events", function: "ParseLegacyEvents", propagateIngestProps: true, row: 3, col: 4},
+	}, decls[0].updatePolicies)
+
+	policies, err := policyDeclarations(decls[0])
+	require.NoError(t, err)
+	require.Len(t, policies, 1)
+
+	policy := policies[0]
+	assert.Equal(t, declType(policyType), policy.declType)
+	assert.Equal(t, "Events update", policy.name)
+	assert.Equal(t, "Events", policy.policy.table)
+	assert.Equal(t, []string{"RawEvents", "ParseEvents", "Legacy Events", "ParseLegacyEvents"}, policy.policy.refs)
+	assert.JSONEq(t, `[
+		{"IsEnabled": true, "Source": "RawEvents", "Query": "ParseEvents()", "IsTransactional": true, "PropagateIngestionProperties": false},
+		{"IsEnabled": true, "Source": "Legacy Events", "Query": "ParseLegacyEvents()", "IsTransactional": false, "PropagateIngestionProperties": true}
+	]`, policy.policy.value)
+}
+
+func Test_parse_externalTable(t *testing.T) {
+	input := `// Raw logs
+// @dataFormat Parquet
+// @connection https://logs.blob.core.windows.net/raw;${env:LOGS_KEY}
+// @connection https://logs.blob.core.windows.net/archive;managed_identity=system
+// @partitionBy Date:datetime = bin(Timestamp, 1d)
+// @pathFormat datetime_pattern("yyyy/MM/dd", Date)
+// @includeHeaders All
+let ['Raw Logs'] = external_table(Timestamp:datetime, Message:string)`
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	decl := decls[0]
+
+	assert.Equal(t, declType(externalTableType), decl.declType)
+	assert.Equal(t, "Raw Logs", decl.name)
+	assert.Equal(t, "Raw logs", decl.doc)
+	assert.Equal(t, "(Timestamp:datetime, Message:string)", decl.signature)
+	assert.Equal(t, externalOptions{
+		kind:       storageKind,
+		dataFormat: "parquet",
+		connections: []string{
+			"https://logs.blob.core.windows.net/raw;${env:LOGS_KEY}",
+			"https://logs.blob.core.windows.net/archive;managed_identity=system",
+		},
+		partitionBy:    "Date:datetime = bin(Timestamp, 1d)",
+		pathFormat:     `datetime_pattern("yyyy/MM/dd", Date)`,
+		includeHeaders: "All",
+	}, decl.external)
+}
+
+func Test_parse_continuousExport(t *testing.T) {
+	input := `// @intervalBetweenRuns 1h
+// @forcedLatency 10m
+// @sizeLimit 1048576
+// @distributed true
+// @over Logs, ['Raw Logs']
+let ExportLogs = continuous_export(Archive) {
+    Logs
+    | union ['Raw Logs']
+}`
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	decl := decls[0]
+
+	assert.Equal(t, declType(continuousExportType), decl.declType)
+	assert.Equal(t, "ExportLogs", decl.name)
+	assert.Equal(t, "Archive", decl.source)
+	assert.Equal(t, "{\n    Logs\n    | union ['Raw Logs']\n}", decl.body)
+	assert.Equal(t, exportOptions{
+		intervalBetweenRuns: "1h",
+		forcedLatency:       "10m",
+		sizeLimit:           "1048576",
+		distributed:         "true",
+		over:                []string{"Logs", "Raw Logs"},
+	}, decl.export)
+}
+
+func Test_parse_table_columnDocstrings(t *testing.T) {
+	input := `let Requests = datatable(
+    Timestamp:datetime, // time received
+    // not a column docstring
+    ['Status Code']:int // status, i.e. '200'
+    , Path:string
+)[]`
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	decl := decls[0]
+
+	assert.Equal(t, []column{
+		{name: "Timestamp", typ: "datetime", doc: "time received", row: 2, col: 5},
+		{name: "Status Code", typ: "int", doc: "status, i.e. '200'", row: 4, col: 5},
+		{name: "Path", typ: "string", row: 5, col: 7},
+	}, decl.columns)
+	assert.Equal(t, "(\n    Timestamp:datetime,\n    ['Status Code']:int\n    , Path:string\n)", decl.signature)
+}
+
+func Test_parse_functionAnnotations(t *testing.T) {
+	input := `// Shared helper
+// @view
+// @skipvalidation true
+// @folder /Shared\Utils/
+let Helper = () { print 1 }`
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	decl := decls[0]
+
+	assert.Equal(t, "Shared helper", decl.doc)
+	assert.Equal(t, functionOptions{view: true, skipValidation: true}, decl.function)
+	assert.Equal(t, "Shared/Utils", decl.folder)
+	assert.Equal(t, "Shared/Utils", source{rel: "functions/Helper.csl", decl: decl}.folder())
+}
+
+func Test_parse_quotedNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		declType declType
+	}{
+		{"function", "let ['my-func'] = () { print 1 }", "my-func", functionType},
+		{"functionDoubleQuoted", `let ["Request.Count"] = () { print 1 }`, "Request.Count", functionType},
+		{"functionEscaped", `let ['it\'s'] = () { print 1 }`, "it's", functionType},
+		{"functionNonASCII", "let Café = () { print 1 }", "Café", functionType},
+		{"table", "let ['my table'] = datatable(['my column']:int)[]", "my table", tableType},
+		{"view", "let ['my-view'] = materialized_view(T) { T | summarize count() }", "my-view", materializedViewType},
+		{"external", "// @dataFormat csv\n// @connection https://a\nlet ['my.external'] = external_table(a:int)", "my.external", externalTableType},
+		{"export", "// @intervalBetweenRuns 1h\nlet ['my export'] = continuous_export(E) { T }", "my export", continuousExportType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decls, err := parse(strings.NewReader(tt.input))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, decls[0].name)
+			assert.Equal(t, tt.declType, decls[0].declType)
+		})
+	}
+}
+
+func Test_parse_literals(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		signature string
+		body      string
+	}{
+		{"quoteInString", `let x = (a:string = "it's") { print a }`, `(a:string = "it's")`, "{ print a }"},
+		{"bracketInDefault", `let x = (a:string = ')') { print a }`, `(a:string = ')')`, "{ print a }"},
+		{"escapedQuote", `let x = (a:string = 'it\'s )') { print a }`, `(a:string = 'it\'s )')`, "{ print a }"},
+		{"verbatimBackslash", `let x = (a:string = @'c:\') { print a }`, `(a:string = @'c:\')`, "{ print a }"},
+		{"obfuscated", `let x = (a:string = h'}') { print a }`, `(a:string = h'}')`, "{ print a }"},
+		{"braceInString", "let x = () { print '}', \"{\" }", "()", "{ print '}', \"{\" }"},
+		{"braceInComment", "let x = () {\n    // }\n    print 1\n}", "()", "{\n    // }\n    print 1\n}"},
+		{"multilineString", "let x = () { print ```\n}'\n``` }", "()", "{ print ```\n}'\n``` }"},
+		{"commentInSignature", "let x = (\n    a:int, // the a's\n    b:int // ) the b\n) { a }", "(\n    a:int, // the a's\n    b:int // ) the b\n)", "{ a }"},
+		{"crlf", "// doc\r\nlet x = (\r\n    a:int\r\n) {\r\n    a\r\n}\r\n", "(\r\n    a:int\r\n)", "{\r\n    a\r\n}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decls, err := parse(strings.NewReader(tt.input))
+			require.NoError(t, err)
+			require.Len(t, decls, 1)
+			assert.Equal(t, tt.signature, decls[0].signature)
+			assert.Equal(t, tt.body, decls[0].body)
+		})
+	}
+}
+
+func Test_parse_literals_defaultValue(t *testing.T) {
+	input := "let x = (\n    a:string = 'it\\'s', // comment\n    b:int = 1 // comment\n) { a }"
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+
+	assert.Equal(t, `'it\'s'`, decls[0].params[0].defaultValue)
+	assert.Equal(t, "1", decls[0].params[1].defaultValue)
+}
+
+func Test_parse_crlf(t *testing.T) {
+	input := "// Requests\r\n// @data replace\r\nlet Requests = datatable(\r\n    Code:int, // status\r\n    Path:string\r\n)\r\n[\r\n    200, '/'\r\n]\r\n"
+	decls, err := parse(strings.NewReader(input))
+	require.NoError(t, err)
+	decl := decls[0]
+
+	assert.Equal(t, "Requests", decl.doc)
+	assert.Equal(t, dataReplace, decl.dataMode)
+	assert.Equal(t, []column{
+		{name: "Code", typ: "int", doc: "status", row: 4, col: 5},
+		{name: "Path", typ: "string", row: 5, col: 5},
+	}, decl.columns)
+	assert.Equal(t, "(\r\n    Code:int,\r\n    Path:string\r\n)", decl.signature)
+	assert.Equal(t, "200, '/'", decl.rows)
+}
+
+func Test_parse_unterminatedString(t *testing.T) {
+	_, err := parse(strings.NewReader("let x = () {\n    print 'a\n}"))
+	require.Error(t, err)
+
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, 2, parseErr.row)
+	assert.Equal(t, 11, parseErr.col)
+	assert.Equal(t, "unterminated string literal", parseErr.msg)
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add("print 'it\\'s }'")
+	f.Add("T | where a == @\"c:\\\" // }\n| project ```\n}\n```")
+	f.Add("print h'{', \"}\"\r\n")
+	f.Fuzz(func(t *testing.T, body string) {
+		// parsing never panics
+		_, _ = parse(strings.NewReader(body))
+
+		toks, err := tokenize(body, 1, 1)
+		if err != nil {
+			return
+		}
+		depth := 0
+		for _, tok := range toks {
+			switch {
+			case tok.is("{") || tok.is("(") || tok.is("["):
+				depth++
+			case tok.is("}") || tok.is(")") || tok.is("]"):
+				depth--
+			}
+			if depth < 0 {
+				return
+			}
+		}
+		if depth != 0 || len(toks) > 1 && toks[len(toks)-2].kind == tokenComment {
+			return
+		}
+
+		// a body with balanced brackets is declared exactly as written
+		decls, err := parse(strings.NewReader("let f = () {" + body + "}"))
+		require.NoError(t, err)
+		require.Len(t, decls, 1)
+		assert.Equal(t, "{"+body+"}", decls[0].body)
+	})
+}
@@ -0,0 +1,440 @@
+package ksd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Action is the action that sync would take for an entity.
+type Action string
+
+const (
+	// The entity is declared in source, but does not exist in the database.
+	ActionCreate Action = "create"
+	// The entity is declared in source, and differs from the database.
+	ActionAlter Action = "alter"
+	// The entity is declared in source, and matches the database.
+	ActionNone Action = "unchanged"
+	// The entity exists in the database, but is not declared in source.
+	ActionDatabaseOnly Action = "databaseOnly"
+)
+
+// Change describes the difference between a declared entity and the database.
+type Change struct {
+	Action Action `json:"action"`
+	// The kind of entity, i.e. function, table or materialized-view.
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// The source file of the declaration, relative to the source root.
+	File string `json:"file,omitempty"`
+	// Human-readable details of the difference.
+	Details []string `json:"details,omitempty"`
+}
+
+// Plan is the set of changes that sync would apply to a database.
+type Plan struct {
+	Database string   `json:"database"`
+	Changes  []Change `json:"changes"`
+}
+
+// Count returns the number of changes with the given action.
+func (p *Plan) Count(action Action) int {
+	count := 0
+	for _, c := range p.Changes {
+		if c.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+// Pending returns true if sync would create or alter any entity.
+func (p *Plan) Pending() bool {
+	return p.Count(ActionCreate) > 0 || p.Count(ActionAlter) > 0
+}
+
+var actionSymbols = map[Action]string{
+	ActionCreate:       "+",
+	ActionAlter:        "~",
+	ActionNone:         "=",
+	ActionDatabaseOnly: "?",
+}
+
+var actionDescriptions = map[Action]string{
+	ActionCreate:       "create",
+	ActionAlter:        "alter",
+	ActionNone:         "unchanged",
+	ActionDatabaseOnly: "database only",
+}
+
+// WriteText writes the plan in a human-readable format.
+func (p *Plan) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Database: %s\n\n", p.Database)
+	for _, c := range p.Changes {
+		fmt.Fprintf(&b, "  %s %s %s %s", actionSymbols[c.Action], actionDescriptions[c.Action], c.Kind, c.Name)
+		if c.File != "" {
+			fmt.Fprintf(&b, " (%s)", filepath.ToSlash(c.File))
+		}
+		b.WriteString("\n")
+		for _, d := range c.Details {
+			fmt.Fprintf(&b, "      - %s\n", d)
+		}
+	}
+	if len(p.Changes) > 0 {
+		b.WriteString("\n")
+	}
+
+	fmt.Fprintf(&b,
+		"Plan: %d to create, %d to alter, %d unchanged, %d only in database.\n",
+		p.Count(ActionCreate),
+		p.Count(ActionAlter),
+		p.Count(ActionNone),
+		p.Count(ActionDatabaseOnly))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteJSON writes the plan as JSON.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// PlanOptions configures ComputePlan.
+type PlanOptions struct {
+	// OutRoot is the output directory, whose files are skipped. Defaults to OutDir under the source root.
+	OutRoot string
+	// Extensions are the file extensions of Kusto source files, i.e. .kql.
+	// Defaults to the extensions of IsKustoSourceFile.
+	Extensions []string
+}
+
+// ComputePlan parses the Kusto source files under srcRoot, and compares the declarations
+// against the functions and tables in the database targeted by endpoint.
+func ComputePlan(
+	srcRoot string,
+	endpoint string,
+	cred CredentialOptions,
+	httpClient *http.Client,
+	opts PlanOptions) (*Plan, error) {
+	conn, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	srcRoot = filepath.Clean(srcRoot)
+	outRoot := opts.OutRoot
+	if outRoot == "" {
+		outRoot = filepath.Join(srcRoot, OutDir)
+	}
+	sources, diags, err := parseSources(srcRoot, filepath.Clean(outRoot), opts.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	if err := diags.err(); err != nil {
+		return nil, err
+	}
+
+	client, err := newKustoClient(conn.endpoint, cred, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	state, err := fetchState(ctx, client, conn.db)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fetchPolicies(ctx, client, conn.db, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return diff(conn.db, sources, state), nil
+}
+
+// diff compares the declarations in sources against the database state.
+func diff(db string, sources []source, state *dbState) *Plan {
+	plan := &Plan{Database: db, Changes: []Change{}}
+	declared := map[string]bool{}
+	for _, src := range sources {
+		decl := src.decl
+		declared[decl.name] = true
+		change := Change{
+			Action: ActionNone,
+			Kind:   decl.declType.String(),
+			Name:   decl.name,
+			File:   src.rel,
+		}
+
+		switch decl.declType {
+		case functionType:
+			fn, has := state.functions[decl.name]
+			if !has {
+				change.Action = ActionCreate
+				break
+			}
+
+			change.Details = diffFunction(src, fn)
+			if len(change.Details) > 0 {
+				change.Action = ActionAlter
+			}
+		case tableType:
+			table, has := state.tables[decl.name]
+			if !has {
+				change.Action = ActionCreate
+				break
+			}
+
+			var altered bool
+			change.Details, altered = diffTable(src, table)
+			if altered {
+				change.Action = ActionAlter
+			}
+		case materializedViewType:
+			view, has := state.views[decl.name]
+			if !has {
+				change.Action = ActionCreate
+				break
+			}
+
+			change.Details = diffMaterializedView(src, view)
+			if len(change.Details) > 0 {
+				change.Action = ActionAlter
+			}
+		case externalTableType:
+			external, has := state.externals[decl.name]
+			if !has {
+				change.Action = ActionCreate
+				break
+			}
+
+			change.Details = diffExternalTable(src, external)
+			if len(change.Details) > 0 {
+				change.Action = ActionAlter
+			}
+		case continuousExportType:
+			export, has := state.exports[decl.name]
+			if !has {
+				change.Action = ActionCreate
+				break
+			}
+
+			change.Details = diffContinuousExport(src, export)
+			if len(change.Details) > 0 {
+				change.Action = ActionAlter
+			}
+		case policyType:
+			policy, has := state.policies[decl.name]
+			if !has {
+				change.Action = ActionCreate
+				break
+			}
+
+			change.Details = diffPolicy(decl, policy)
+			if len(change.Details) > 0 {
+				change.Action = ActionAlter
+			}
+		default:
+			panic(fmt.Sprintf("unhandled declarationType: %d", decl.declType))
+		}
+
+		plan.Changes = append(plan.Changes, change)
+	}
+
+	for _, name := range sortedKeys(state.functions) {
+		if !declared[name] {
+			plan.Changes = append(plan.Changes, Change{
+				Action: ActionDatabaseOnly,
+				Kind:   declType(functionType).String(),
+				Name:   name,
+			})
+		}
+	}
+
+	for _, name := range sortedKeys(state.tables) {
+		if !declared[name] && name != StateTable {
+			plan.Changes = append(plan.Changes, Change{
+				Action: ActionDatabaseOnly,
+				Kind:   declType(tableType).String(),
+				Name:   name,
+			})
+		}
+	}
+
+	for _, name := range sortedKeys(state.views) {
+		if !declared[name] {
+			plan.Changes = append(plan.Changes, Change{
+				Action: ActionDatabaseOnly,
+				Kind:   declType(materializedViewType).String(),
+				Name:   name,
+			})
+		}
+	}
+
+	for _, name := range sortedKeys(state.externals) {
+		if !declared[name] {
+			plan.Changes = append(plan.Changes, Change{
+				Action: ActionDatabaseOnly,
+				Kind:   declType(externalTableType).String(),
+				Name:   name,
+			})
+		}
+	}
+
+	for _, name := range sortedKeys(state.exports) {
+		if !declared[name] {
+			plan.Changes = append(plan.Changes, Change{
+				Action: ActionDatabaseOnly,
+				Kind:   declType(continuousExportType).String(),
+				Name:   name,
+			})
+		}
+	}
+
+	return plan
+}
+
+func diffFunction(src source, fn dbFunction) []string {
+	details := []string{}
+	// The service normalizes whitespace of stored functions,
+	// and so whitespace is ignored when comparing.
+	if normalizeWhitespace(fn.Parameters+fn.Body) != normalizeWhitespace(src.decl.signature+src.decl.body) {
+		details = append(details, "body changed")
+	}
+
+	if fn.Folder != src.folder() {
+		details = append(details, fmt.Sprintf("folder changed from '%s' to '%s'", fn.Folder, src.folder()))
+	}
+
+	if fn.DocString != src.decl.doc {
+		details = append(details, "docstring changed")
+	}
+
+	return details
+}
+
+func diffMaterializedView(src source, view dbMaterializedView) []string {
+	details := []string{}
+	if view.SourceTable != src.decl.source {
+		details = append(details, fmt.Sprintf("source table changed from '%s' to '%s'", view.SourceTable, src.decl.source))
+	}
+
+	// the stored query excludes the braces around the declared query
+	if normalizeWhitespace(view.Query) != normalizeWhitespace(query(src.decl.body)) {
+		details = append(details, "query changed")
+	}
+
+	if view.Folder != src.folder() {
+		details = append(details, fmt.Sprintf("folder changed from '%s' to '%s'", view.Folder, src.folder()))
+	}
+
+	if view.DocString != src.decl.doc {
+		details = append(details, "docstring changed")
+	}
+
+	return details
+}
+
+// diffExternalTable compares the declared schema, folder and docstring against the external table.
+//
+// Connection strings are not compared, as the service only returns them obfuscated.
+func diffExternalTable(src source, external dbExternalTable) []string {
+	details := []string{}
+	declared := make([]string, 0, len(src.decl.columns))
+	for _, col := range src.decl.columns {
+		typ, _ := canonicalType(col.typ)
+		declared = append(declared, col.name+":"+typ)
+	}
+	existing := make([]string, 0, len(external.OrderedColumns))
+	for _, col := range external.OrderedColumns {
+		existing = append(existing, col.Name+":"+col.CslType)
+	}
+	if strings.Join(declared, ", ") != strings.Join(existing, ", ") {
+		details = append(details, fmt.Sprintf(
+			"schema changed from (%s) to (%s)", strings.Join(existing, ", "), strings.Join(declared, ", ")))
+	}
+
+	if external.Folder != src.folder() {
+		details = append(details, fmt.Sprintf("folder changed from '%s' to '%s'", external.Folder, src.folder()))
+	}
+
+	if external.DocString != src.decl.doc {
+		details = append(details, "docstring changed")
+	}
+
+	return details
+}
+
+// diffTable compares the declared columns against the table.
+// altered is true if '.create-merge table' would change the table.
+func diffTable(src source, table dbTable) (details []string, altered bool) {
+	existing := map[string]dbColumn{}
+	for _, col := range table.OrderedColumns {
+		existing[col.Name] = col
+	}
+
+	declared := map[string]bool{}
+	for _, col := range src.decl.columns {
+		declared[col.name] = true
+		dbCol, has := existing[col.name]
+		if !has {
+			details = append(details, fmt.Sprintf("add column %s:%s", col.name, col.typ))
+			altered = true
+			continue
+		}
+
+		if canonical, _ := canonicalType(col.typ); canonical != dbCol.CslType {
+			details = append(details, fmt.Sprintf("column %s has type %s, declared as %s", col.name, dbCol.CslType, col.typ))
+			altered = true
+		}
+
+		// only declared column docstrings are synced
+		if col.doc != "" && col.doc != dbCol.DocString {
+			details = append(details, fmt.Sprintf("column %s docstring changed", col.name))
+			altered = true
+		}
+	}
+
+	for _, col := range table.OrderedColumns {
+		if !declared[col.Name] {
+			details = append(details, fmt.Sprintf("column %s:%s is only in the database", col.Name, col.CslType))
+		}
+	}
+
+	if table.Folder != src.folder() {
+		details = append(details, fmt.Sprintf("folder changed from '%s' to '%s'", table.Folder, src.folder()))
+		altered = true
+	}
+
+	if table.DocString != src.decl.doc {
+		details = append(details, "docstring changed")
+		altered = true
+	}
+
+	return details, altered
+}
+
+func normalizeWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
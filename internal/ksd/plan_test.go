@@ -0,0 +1,235 @@
+package ksd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseSource(t *testing.T, rel string, content string) source {
+	decls, err := parse(strings.NewReader(content))
+	require.NoError(t, err)
+	require.Len(t, decls, 1)
+	return source{rel: rel, decl: decls[0]}
+}
+
+func Test_diff(t *testing.T) {
+	sources := []source{
+		parseSource(t, "functions/New.csl", "let New = () { print 1 }"),
+		parseSource(t, "functions/Same.csl", "// doc\nlet Same = (a:int) {\n  print a\n}"),
+		parseSource(t, "functions/Changed.csl", "let Changed = (a:int) { print a + 1 }"),
+		parseSource(t, "tables/Metric.csl", "let Metric = datatable(['Timestamp']:datetime, Value:double, Name:string)[]"),
+		parseSource(t, "tables/Trace.csl", "let Trace = datatable(['Message']:string)[]"),
+		parseSource(t, "tables/Span.csl", "// Spans\nlet Span = datatable(\n    Id:string, // span id\n    Name:string\n)[]"),
+	}
+
+	state := &dbState{
+		functions: map[string]dbFunction{
+			"Same":    {Name: "Same", Parameters: "(a:int)", Body: "{ print a }", Folder: "functions", DocString: "doc"},
+			"Changed": {Name: "Changed", Parameters: "(a:int)", Body: "{ print a }", Folder: "other"},
+			"Old":     {Name: "Old", Parameters: "()", Body: "{ print 0 }"},
+		},
+		tables: map[string]dbTable{
+			StateTable: {Name: StateTable, Folder: stateFolder},
+			"Metric": {Name: "Metric", Folder: "tables", OrderedColumns: []dbColumn{
+				{Name: "Timestamp", CslType: "datetime"},
+				{Name: "Value", CslType: "real"},
+			}},
+			"Trace": {Name: "Trace", Folder: "tables", OrderedColumns: []dbColumn{
+				{Name: "Message", CslType: "string"},
+				{Name: "Level", CslType: "int"},
+			}},
+			"Span": {Name: "Span", Folder: "spans", OrderedColumns: []dbColumn{
+				{Name: "Id", CslType: "string", DocString: "id"},
+				{Name: "Name", CslType: "string", DocString: "span name"},
+			}},
+			"Legacy": {Name: "Legacy"},
+		},
+	}
+
+	plan := diff("db", sources, state)
+	expected := []Change{
+		{Action: ActionCreate, Kind: "function", Name: "New", File: "functions/New.csl"},
+		{Action: ActionNone, Kind: "function", Name: "Same", File: "functions/Same.csl", Details: []string{}},
+		{Action: ActionAlter, Kind: "function", Name: "Changed", File: "functions/Changed.csl", Details: []string{
+			"body changed",
+			"folder changed from 'other' to 'functions'",
+		}},
+		{Action: ActionAlter, Kind: "table", Name: "Metric", File: "tables/Metric.csl", Details: []string{
+			"add column Name:string",
+		}},
+		{Action: ActionNone, Kind: "table", Name: "Trace", File: "tables/Trace.csl", Details: []string{
+			"column Level:int is only in the database",
+		}},
+		{Action: ActionAlter, Kind: "table", Name: "Span", File: "tables/Span.csl", Details: []string{
+			"column Id docstring changed",
+			"folder changed from 'spans' to 'tables'",
+			"docstring changed",
+		}},
+		{Action: ActionDatabaseOnly, Kind: "function", Name: "Old"},
+		{Action: ActionDatabaseOnly, Kind: "table", Name: "Legacy"},
+	}
+
+	assert.Equal(t, expected, plan.Changes)
+	assert.True(t, plan.Pending())
+	assert.Equal(t, 1, plan.Count(ActionCreate))
+	assert.Equal(t, 3, plan.Count(ActionAlter))
+	assert.Equal(t, 2, plan.Count(ActionNone))
+	assert.Equal(t, 2, plan.Count(ActionDatabaseOnly))
+}
+
+func Test_diff_noChanges(t *testing.T) {
+	sources := []source{
+		parseSource(t, "Same.csl", "let Same = () { print 1 }"),
+	}
+	state := &dbState{
+		functions: map[string]dbFunction{
+			"Same": {Name: "Same", Parameters: "()", Body: "{\n    print 1\n}"},
+		},
+		tables: map[string]dbTable{},
+	}
+
+	plan := diff("db", sources, state)
+	assert.False(t, plan.Pending())
+}
+
+func Test_diff_materializedView(t *testing.T) {
+	sources := []source{
+		parseSource(t, "views/Same.csl", "// doc\nlet Same = materialized_view(T) {\n    T | summarize count() by a\n}"),
+		parseSource(t, "views/Changed.csl", "let Changed = materialized_view(U) { U | summarize count() by b }"),
+		parseSource(t, "views/New.csl", "let New = materialized_view(T) { T | summarize count() by c }"),
+	}
+	state := &dbState{
+		views: map[string]dbMaterializedView{
+			"Same":    {Name: "Same", SourceTable: "T", Query: "T | summarize count() by a", Folder: "views", DocString: "doc"},
+			"Changed": {Name: "Changed", SourceTable: "T", Query: "T | summarize count() by a", Folder: "views"},
+			"Old":     {Name: "Old", SourceTable: "T"},
+		},
+	}
+
+	plan := diff("db", sources, state)
+	assert.Equal(t, []Change{
+		{Action: ActionNone, Kind: "materialized-view", Name: "Same", File: "views/Same.csl", Details: []string{}},
+		{Action: ActionAlter, Kind: "materialized-view", Name: "Changed", File: "views/Changed.csl", Details: []string{
+			"source table changed from 'T' to 'U'",
+			"query changed",
+		}},
+		{Action: ActionCreate, Kind: "materialized-view", Name: "New", File: "views/New.csl"},
+		{Action: ActionDatabaseOnly, Kind: "materialized-view", Name: "Old"},
+	}, plan.Changes)
+}
+
+func Test_diff_externalTable(t *testing.T) {
+	external := "// @dataFormat csv\n// @connection https://a.blob.core.windows.net/c;${env:KEY}\n"
+	sources := []source{
+		parseSource(t, "externals/Same.csl", external+"let Same = external_table(a:int, b:string)"),
+		parseSource(t, "externals/Changed.csl", "// doc\n"+external+"let Changed = external_table(a:long)"),
+		parseSource(t, "externals/New.csl", external+"let New = external_table(a:int)"),
+	}
+	state := &dbState{
+		externals: map[string]dbExternalTable{
+			"Same": {Name: "Same", Folder: "externals", OrderedColumns: []dbColumn{
+				{Name: "a", CslType: "int"},
+				{Name: "b", CslType: "string"},
+			}},
+			"Changed": {Name: "Changed", Folder: "externals", OrderedColumns: []dbColumn{
+				{Name: "a", CslType: "int"},
+			}},
+			"Old": {Name: "Old"},
+		},
+	}
+
+	plan := diff("db", sources, state)
+	assert.Equal(t, []Change{
+		{Action: ActionNone, Kind: "external-table", Name: "Same", File: "externals/Same.csl", Details: []string{}},
+		{Action: ActionAlter, Kind: "external-table", Name: "Changed", File: "externals/Changed.csl", Details: []string{
+			"schema changed from (a:int) to (a:long)",
+			"docstring changed",
+		}},
+		{Action: ActionCreate, Kind: "external-table", Name: "New", File: "externals/New.csl"},
+		{Action: ActionDatabaseOnly, Kind: "external-table", Name: "Old"},
+	}, plan.Changes)
+}
+
+func Test_diff_continuousExport(t *testing.T) {
+	sources := []source{
+		parseSource(t, "exports/Same.csl", "// @intervalBetweenRuns 1h\nlet Same = continuous_export(Archive) {\n    Logs\n}"),
+		parseSource(t, "exports/Drifted.csl", "// @intervalBetweenRuns 1h\nlet Drifted = continuous_export(Archive) { Logs | take 10 }"),
+		parseSource(t, "exports/New.csl", "// @intervalBetweenRuns 1h\nlet New = continuous_export(Archive) { Logs }"),
+	}
+	state := &dbState{
+		exports: map[string]dbContinuousExport{
+			"Same":    {Name: "Same", ExternalTableName: "Archive", Query: "Logs"},
+			"Drifted": {Name: "Drifted", ExternalTableName: "OldArchive", Query: "Logs | take 100"},
+			"Old":     {Name: "Old", ExternalTableName: "Archive"},
+		},
+	}
+
+	plan := diff("db", sources, state)
+	assert.Equal(t, []Change{
+		{Action: ActionNone, Kind: "continuous-export", Name: "Same", File: "exports/Same.csl", Details: []string{}},
+		{Action: ActionAlter, Kind: "continuous-export", Name: "Drifted", File: "exports/Drifted.csl", Details: []string{
+			"target external table changed from 'OldArchive' to 'Archive'",
+			"query changed, the export will be replaced",
+		}},
+		{Action: ActionCreate, Kind: "continuous-export", Name: "New", File: "exports/New.csl"},
+		{Action: ActionDatabaseOnly, Kind: "continuous-export", Name: "Old"},
+	}, plan.Changes)
+}
+
+func Test_diff_policy(t *testing.T) {
+	files := []struct {
+		rel     string
+		content string
+	}{
+		{"tables/Same.csl", "// @updatePolicy Source=Raw Function=Parse\nlet Same = datatable(a:int)[]"},
+		{"tables/Changed.csl", "// @updatePolicy Source=Raw Function=Parse IsTransactional=true\nlet Changed = datatable(a:int)[]"},
+		{"tables/New.csl", "// @updatePolicy Source=Raw Function=Parse\nlet New = datatable(a:int)[]"},
+	}
+	sources := []source{}
+	for _, f := range files {
+		// only diff the policy of the table
+		table := parseSource(t, f.rel, f.content)
+		policies, err := policyDeclarations(table.decl)
+		require.NoError(t, err)
+		sources = append(sources, source{rel: f.rel, decl: policies[0]})
+	}
+
+	existing := `[{"IsEnabled":true,"Source":"Raw","Query":"Parse()","IsTransactional":false,` +
+		`"PropagateIngestionProperties":false,"ManagedIdentity":null}]`
+	state := &dbState{
+		policies: map[string]string{
+			"Same update":    existing,
+			"Changed update": existing,
+		},
+	}
+
+	plan := diff("db", sources, state)
+	assert.Equal(t, []Change{
+		{Action: ActionNone, Kind: "policy", Name: "Same update", File: "tables/Same.csl", Details: []string{}},
+		{Action: ActionAlter, Kind: "policy", Name: "Changed update", File: "tables/Changed.csl", Details: []string{
+			"policy changed",
+		}},
+		{Action: ActionCreate, Kind: "policy", Name: "New update", File: "tables/New.csl"},
+	}, plan.Changes)
+}
+
+func TestPlan_WriteText(t *testing.T) {
+	plan := &Plan{
+		Database: "db",
+		Changes: []Change{
+			{Action: ActionCreate, Kind: "function", Name: "New", File: "functions/New.csl"},
+			{Action: ActionAlter, Kind: "table", Name: "Metric", File: "tables/Metric.csl", Details: []string{
+				"add column Name:string",
+			}},
+			{Action: ActionDatabaseOnly, Kind: "function", Name: "Old"},
+		},
+	}
+
+	b := &strings.Builder{}
+	require.NoError(t, plan.WriteText(b))
+	err := snapshotter().SnapshotWithName("plan-text", b.String())
+	require.NoError(t, err)
+}
@@ -0,0 +1,610 @@
+package ksd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// databasePlaceholder is replaced by the name of the target database when commands are synced,
+// as the database is not known when building.
+const databasePlaceholder = "${database}"
+
+// policyDecl is a policy declared on a table or database, which is synced as a separate entity
+// after the entities it references.
+type policyDecl struct {
+	// the kind of policy, as used in '.alter policy', i.e. retention
+	kind string
+	// the table that the policy applies to. Empty for database policies.
+	table string
+	// the policy argument of the '.alter policy' command
+	arg string
+	// the policy as JSON, as returned by '.show policy'
+	value string
+	// names of the entities, other than the table, that the policy references
+	refs []string
+
+	// position of the annotation that declares the policy
+	row int
+	col int
+}
+
+// entity returns the entity that the policy applies to, as used in '.alter policy', i.e. table Events.
+func (p policyDecl) entity() string {
+	if p.table == "" {
+		return "database " + databasePlaceholder
+	}
+	return "table " + quoteName(p.table)
+}
+
+// policyName returns the name of the entity for the policy of the given kind on table,
+// or on the database when table is empty.
+func policyName(table string, kind string) string {
+	if table == "" {
+		return "database " + kind
+	}
+	return table + " " + kind
+}
+
+// policyDeclarations returns the policies declared by annotations on the table declaration,
+// as declarations that follow the table.
+func policyDeclarations(decl *declaration) ([]*declaration, error) {
+	if decl.declType != tableType {
+		return nil, nil
+	}
+
+	policies := append([]policyDecl{}, decl.policies...)
+	if len(decl.updatePolicies) > 0 {
+		content, err := updatePolicyJSON(decl.updatePolicies)
+		if err != nil {
+			return nil, err
+		}
+		refs := []string{}
+		for _, p := range decl.updatePolicies {
+			refs = append(refs, p.source, p.function)
+		}
+
+		policies = append(policies, policyDecl{
+			kind:  "update",
+			table: decl.name,
+			arg:   "```" + content + "```",
+			value: content,
+			refs:  refs,
+			row:   decl.updatePolicies[0].row,
+			col:   decl.updatePolicies[0].col,
+		})
+	}
+
+	decls := make([]*declaration, 0, len(policies))
+	for _, p := range policies {
+		decls = append(decls, newPolicyDeclaration(p))
+	}
+	return decls, nil
+}
+
+func newPolicyDeclaration(p policyDecl) *declaration {
+	return &declaration{
+		name:     policyName(p.table, p.kind),
+		declType: policyType,
+		policy:   p,
+		row:      p.row,
+		col:      p.col,
+	}
+}
+
+// propertyType is the type of a policy property.
+type propertyType uint8
+
+const (
+	boolType propertyType = iota
+	intType
+	realType
+	timespanType
+	stringType
+)
+
+// policyProperty is a property of a policy that can be declared with 'Key=value'.
+type policyProperty struct {
+	name string
+	typ  propertyType
+	// the allowed values of a string property
+	values []string
+}
+
+// policyKind is a kind of table or database policy that is declared with an annotation,
+// i.e. '// @retentionPolicy SoftDeletePeriod=30d'.
+type policyKind struct {
+	// the name of the annotation, i.e. retentionPolicy
+	annotation string
+	// the kind of policy, as used in '.alter policy', i.e. retention
+	kind string
+	// true if the policy can also be declared on a database
+	database bool
+	// the properties that can be declared with 'Key=value'.
+	// Empty if the policy can only be declared as a JSON object.
+	properties []policyProperty
+	// true if the policy can be declared as a JSON object
+	json bool
+	// render returns the argument of the '.alter policy' command, and the policy as JSON.
+	// When nil, the policy is passed as JSON.
+	render func(policy map[string]any) (arg string, value string)
+	// parse parses the annotation value, instead of as properties or JSON.
+	parse func(a annotation) (arg string, value string, err error)
+}
+
+var retentionPolicy = policyKind{
+	annotation: "retentionPolicy",
+	kind:       "retention",
+	database:   true,
+	properties: []policyProperty{
+		{name: "SoftDeletePeriod", typ: timespanType},
+		{name: "Recoverability", typ: stringType, values: []string{"Enabled", "Disabled"}},
+	},
+	json: true,
+}
+
+var cachingPolicy = policyKind{
+	annotation: "cachingPolicy",
+	kind:       "caching",
+	database:   true,
+	properties: []policyProperty{
+		{name: "Hot", typ: timespanType},
+	},
+	render: func(policy map[string]any) (string, string) {
+		hot := policy["Hot"].(string)
+		return fmt.Sprintf("hot = time(%s)", hot), fmt.Sprintf(`{"DataHotSpan":{"Value":"%s"}}`, hot)
+	},
+}
+
+var partitioningPolicy = policyKind{
+	annotation: "partitioningPolicy",
+	kind:       "partitioning",
+	json:       true,
+}
+
+var mergePolicy = policyKind{
+	annotation: "mergePolicy",
+	kind:       "merge",
+	database:   true,
+	properties: []policyProperty{
+		{name: "RowCountUpperBoundForMerge", typ: intType},
+		{name: "OriginalSizeMBUpperBoundForMerge", typ: intType},
+		{name: "MaxExtentsToMerge", typ: intType},
+		{name: "LoopPeriod", typ: timespanType},
+		{name: "MaxRangeInHours", typ: intType},
+		{name: "AllowRebuild", typ: boolType},
+		{name: "AllowMerge", typ: boolType},
+	},
+	json: true,
+}
+
+var ingestionBatchingPolicy = policyKind{
+	annotation: "ingestionBatchingPolicy",
+	kind:       "ingestionbatching",
+	database:   true,
+	properties: []policyProperty{
+		{name: "MaximumBatchingTimeSpan", typ: timespanType},
+		{name: "MaximumNumberOfItems", typ: intType},
+		{name: "MaximumRawDataSizeMB", typ: intType},
+	},
+	json: true,
+}
+
+var streamingIngestionPolicy = policyKind{
+	annotation: "streamingIngestionPolicy",
+	kind:       "streamingingestion",
+	database:   true,
+	properties: []policyProperty{
+		{name: "IsEnabled", typ: boolType},
+		{name: "HintAllocatedRate", typ: realType},
+	},
+	json: true,
+}
+
+var rowOrderPolicy = policyKind{
+	annotation: "rowOrderPolicy",
+	kind:       "roworder",
+	parse:      parseRowOrder,
+}
+
+// policyKinds are the kinds of table and database policies that can be declared with annotations.
+var policyKinds = []policyKind{
+	retentionPolicy,
+	cachingPolicy,
+	partitioningPolicy,
+	mergePolicy,
+	ingestionBatchingPolicy,
+	streamingIngestionPolicy,
+	rowOrderPolicy,
+}
+
+// applyPolicyAnnotation returns the function that applies the annotation of the policy kind to a table declaration.
+func applyPolicyAnnotation(k policyKind) annotationFunc {
+	return func(decl *declaration, a annotation) error {
+		p, err := k.policy(a, decl.name)
+		if err != nil {
+			return err
+		}
+		decl.policies = append(decl.policies, p)
+		return nil
+	}
+}
+
+// policy parses the policy declared by the annotation, on table or on the database when table is empty.
+func (k policyKind) policy(a annotation, table string) (policyDecl, error) {
+	p := policyDecl{kind: k.kind, table: table, row: a.row, col: a.col}
+	if k.parse != nil {
+		var err error
+		p.arg, p.value, err = k.parse(a)
+		return p, err
+	}
+
+	var policy map[string]any
+	switch {
+	case strings.HasPrefix(a.value, "{"):
+		if !k.json {
+			return p, newParseError(
+				a.row, a.col, "'@%s' must be declared with properties, i.e. %s=value", a.name, k.properties[0].name)
+		}
+		if err := json.Unmarshal([]byte(a.value), &policy); err != nil {
+			return p, newParseError(a.row, a.col, "invalid JSON for '@%s': %v", a.name, err)
+		}
+	case len(k.properties) == 0:
+		return p, newParseError(a.row, a.col, "'@%s' must be declared as a JSON object, i.e. {...}", a.name)
+	default:
+		var err error
+		policy, err = typedProperties(a, k.properties)
+		if err != nil {
+			return p, err
+		}
+	}
+
+	if k.render != nil {
+		p.arg, p.value = k.render(policy)
+		return p, nil
+	}
+
+	// map keys are marshalled in sorted order, and so the JSON is stable
+	content, err := json.Marshal(policy)
+	if err != nil {
+		return p, err
+	}
+	p.value = string(content)
+	p.arg = "```" + p.value + "```"
+	return p, nil
+}
+
+// typedProperties parses the 'Key=value' properties of the annotation into JSON values of their declared types.
+// At least one property must be declared.
+func typedProperties(a annotation, declared []policyProperty) (map[string]any, error) {
+	allowed := make([]string, 0, len(declared))
+	for _, p := range declared {
+		allowed = append(allowed, p.name)
+	}
+
+	props, err := properties(a, allowed, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(props) == 0 {
+		return nil, newParseError(
+			a.row, a.col, "missing properties for '@%s'. Allowed properties: %s", a.name, strings.Join(allowed, ", "))
+	}
+
+	policy := map[string]any{}
+	for _, p := range declared {
+		value, has := props[p.name]
+		if !has {
+			continue
+		}
+
+		invalid := func(expected string) error {
+			return newParseError(
+				a.row, a.col, "invalid value '%s' for property '%s'. Expected %s", value, p.name, expected)
+		}
+		switch p.typ {
+		case boolType:
+			b, err := strconv.ParseBool(value)
+			if err != nil || (value != "true" && value != "false") {
+				return nil, invalid("true or false")
+			}
+			policy[p.name] = b
+		case intType:
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, invalid("an integer")
+			}
+			policy[p.name] = i
+		case realType:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, invalid("a number")
+			}
+			policy[p.name] = f
+		case timespanType:
+			t, ok := formatTimespan(value)
+			if !ok {
+				return nil, invalid("a timespan, i.e. 30d")
+			}
+			policy[p.name] = t
+		case stringType:
+			known := len(p.values) == 0
+			for _, v := range p.values {
+				known = known || v == value
+			}
+			if !known {
+				return nil, invalid("one of: " + strings.Join(p.values, ", "))
+			}
+			policy[p.name] = value
+		}
+	}
+
+	return policy, nil
+}
+
+var (
+	timespanUnits = map[string]time.Duration{
+		"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+		"h": time.Hour, "hour": time.Hour, "hours": time.Hour,
+		"m": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+		"s": time.Second, "second": time.Second, "seconds": time.Second,
+		"ms": time.Millisecond, "millisecond": time.Millisecond, "milliseconds": time.Millisecond,
+		"microsecond": time.Microsecond, "microseconds": time.Microsecond,
+		"tick": 100 * time.Nanosecond, "ticks": 100 * time.Nanosecond,
+	}
+	timespanFormat = regexp.MustCompile(`^(\d+\.)?\d{2}:\d{2}:\d{2}(\.\d{1,7})?$`)
+)
+
+// formatTimespan converts the timespan literal, i.e. 30d, to the format used by the service in policies,
+// i.e. 30.00:00:00. Timespans already in that format are returned unchanged.
+func formatTimespan(literal string) (string, bool) {
+	if timespanFormat.MatchString(literal) {
+		return literal, true
+	}
+
+	m := timespanLiteral.FindStringSubmatch(literal)
+	if m == nil || strings.HasPrefix(literal, "-") {
+		return "", false
+	}
+	n, err := strconv.ParseFloat(strings.TrimPrefix(m[1], "+"), 64)
+	if err != nil {
+		return "", false
+	}
+	d := time.Duration(n * float64(timespanUnits[m[2]]))
+
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	d -= minutes * time.Minute
+	seconds := d / time.Second
+	d -= seconds * time.Second
+
+	var b strings.Builder
+	if days > 0 {
+		fmt.Fprintf(&b, "%d.", days)
+	}
+	fmt.Fprintf(&b, "%02d:%02d:%02d", hours, minutes, seconds)
+	if d > 0 {
+		fmt.Fprintf(&b, ".%07d", d/100)
+	}
+	return b.String(), true
+}
+
+// parseRowOrder parses '// @rowOrderPolicy Column [asc|desc], ...'.
+func parseRowOrder(a annotation) (arg string, value string, err error) {
+	keys := []string{}
+	for _, v := range strings.Split(a.value, ",") {
+		s, err := newScanner(strings.TrimSpace(v), a.row, a.col)
+		var name string
+		if err == nil {
+			name, err = s.identifier()
+		}
+		if err != nil {
+			return "", "", newParseError(
+				a.row, a.col, "invalid value '%s' for '@%s'. Expected Column [asc|desc], ...", a.value, a.name)
+		}
+
+		s.skipSpace()
+		order := "asc"
+		if !s.eof() {
+			order = s.src[s.pos:]
+			if order != "asc" && order != "desc" {
+				return "", "", newParseError(
+					a.row, a.col, "invalid order '%s' for column '%s'. Expected asc or desc", order, name)
+			}
+		}
+		keys = append(keys, quoteName(name)+" "+order)
+	}
+
+	content, err := json.Marshal(map[string][]string{"Keys": keys})
+	if err != nil {
+		return "", "", err
+	}
+	return "(" + strings.Join(keys, ", ") + ")", string(content), nil
+}
+
+// properties parses the 'Key=value' pairs, separated by whitespace, in the value of the annotation.
+//
+// Only the keys in allowed are accepted, and the keys in required must be present.
+func properties(a annotation, allowed []string, required []string) (map[string]string, error) {
+	props := map[string]string{}
+	for _, field := range fields(a.value) {
+		key, value, found := strings.Cut(field, "=")
+		if !found || key == "" || value == "" {
+			return nil, newParseError(
+				a.row, a.col, "invalid property '%s' for '@%s'. Expected Key=value", field, a.name)
+		}
+
+		known := false
+		for _, k := range allowed {
+			known = known || k == key
+		}
+		if !known {
+			return nil, newParseError(
+				a.row, a.col, "unknown property '%s' for '@%s'. Allowed properties: %s",
+				key, a.name, strings.Join(allowed, ", "))
+		}
+
+		if _, has := props[key]; has {
+			return nil, newParseError(a.row, a.col, "duplicate property '%s' for '@%s'", key, a.name)
+		}
+		props[key] = value
+	}
+
+	for _, key := range required {
+		if _, has := props[key]; !has {
+			return nil, newParseError(a.row, a.col, "missing property '%s' for '@%s'", key, a.name)
+		}
+	}
+
+	return props, nil
+}
+
+// fields splits value around whitespace that is not within a string literal, i.e. ['name with spaces'].
+func fields(value string) []string {
+	result := []string{}
+	start := -1
+	for i := 0; i < len(value); {
+		c := value[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if start != -1 {
+				result = append(result, value[start:i])
+				start = -1
+			}
+			i++
+			continue
+		case start == -1:
+			start = i
+		}
+
+		if c == '\'' || c == '"' {
+			i = skipString(value, i)
+		} else {
+			i++
+		}
+	}
+	if start != -1 {
+		result = append(result, value[start:])
+	}
+	return result
+}
+
+// boolProperty parses the boolean property, returning false when it is not set.
+func boolProperty(a annotation, props map[string]string, key string) (bool, error) {
+	switch props[key] {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, newParseError(
+			a.row, a.col, "invalid value '%s' for property '%s'. Allowed values: true, false", props[key], key)
+	}
+}
+
+// checkPolicyReferences verifies that the entities referenced by the declared policies
+// are declared with the expected kind. An error is returned for each reference that is not.
+func checkPolicyReferences(sources []source) []*ParseError {
+	declared := map[string]*declaration{}
+	for _, src := range sources {
+		if src.decl.declType != policyType {
+			declared[src.decl.name] = src.decl
+		}
+	}
+
+	errs := []*ParseError{}
+	for _, src := range sources {
+		if src.decl.declType != tableType {
+			continue
+		}
+
+		for _, p := range src.decl.updatePolicies {
+			check := func(name string, what string, expected declType) {
+				decl, has := declared[name]
+				if !has {
+					errs = append(errs, &ParseError{
+						file: src.rel,
+						row:  p.row,
+						col:  p.col,
+						msg:  fmt.Sprintf("update policy %s '%s' is not declared", what, name),
+					})
+				} else if decl.declType != expected {
+					errs = append(errs, &ParseError{
+						file: src.rel,
+						row:  p.row,
+						col:  p.col,
+						msg:  fmt.Sprintf("update policy %s '%s' is declared as a %s", what, name, decl.declType),
+					})
+				}
+			}
+
+			check(p.source, "source table", tableType)
+			check(p.function, "function", functionType)
+		}
+	}
+
+	return errs
+}
+
+// diffPolicy compares the declared policy against the policy in the database.
+//
+// Properties of the policy in the database that are not declared are ignored,
+// as the service fills in defaults for them.
+func diffPolicy(decl *declaration, existing string) []string {
+	var declared, actual any
+	if err := json.Unmarshal([]byte(decl.policy.value), &declared); err != nil {
+		return []string{"policy changed"}
+	}
+	if err := json.Unmarshal([]byte(existing), &actual); err != nil {
+		return []string{"policy changed"}
+	}
+
+	if !containsJSON(actual, declared) {
+		return []string{"policy changed"}
+	}
+	return []string{}
+}
+
+// containsJSON returns true if actual contains all the values in expected.
+// Objects in actual may have additional properties.
+func containsJSON(actual any, expected any) bool {
+	switch e := expected.(type) {
+	case map[string]any:
+		a, ok := actual.(map[string]any)
+		if !ok {
+			return false
+		}
+		keys := make([]string, 0, len(e))
+		for k := range e {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if !containsJSON(a[k], e[k]) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		a, ok := actual.([]any)
+		if !ok || len(a) != len(e) {
+			return false
+		}
+		for i := range e {
+			if !containsJSON(a[i], e[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(actual, expected)
+	}
+}
@@ -0,0 +1,272 @@
+package ksd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_formatTimespan(t *testing.T) {
+	tests := []struct {
+		literal  string
+		expected string
+	}{
+		{"30d", "30.00:00:00"},
+		{"36h", "1.12:00:00"},
+		{"5m", "00:05:00"},
+		{"1.5s", "00:00:01.5000000"},
+		{"2days", "2.00:00:00"},
+		{"100ms", "00:00:00.1000000"},
+		{"1.00:00:00", "1.00:00:00"},
+		{"00:05:00", "00:05:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.literal, func(t *testing.T) {
+			actual, ok := formatTimespan(tt.literal)
+			require.True(t, ok)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+
+	for _, invalid := range []string{"", "30", "-1d", "1y", "1:00"} {
+		_, ok := formatTimespan(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func Test_policyKind_policy(t *testing.T) {
+	tests := []struct {
+		name  string
+		kind  policyKind
+		value string
+		arg   string
+		json  string
+	}{
+		{
+			"retention",
+			retentionPolicy,
+			"SoftDeletePeriod=30d Recoverability=Disabled",
+			"```{\"Recoverability\":\"Disabled\",\"SoftDeletePeriod\":\"30.00:00:00\"}```",
+			`{"Recoverability":"Disabled","SoftDeletePeriod":"30.00:00:00"}`,
+		},
+		{
+			"retentionJSON",
+			retentionPolicy,
+			`{"SoftDeletePeriod": "10.00:00:00"}`,
+			"```{\"SoftDeletePeriod\":\"10.00:00:00\"}```",
+			`{"SoftDeletePeriod":"10.00:00:00"}`,
+		},
+		{
+			"caching",
+			cachingPolicy,
+			"Hot=7d",
+			"hot = time(7.00:00:00)",
+			`{"DataHotSpan":{"Value":"7.00:00:00"}}`,
+		},
+		{
+			"partitioning",
+			partitioningPolicy,
+			`{"PartitionKeys":[{"ColumnName":"TenantId","Kind":"Hash"}]}`,
+			"```{\"PartitionKeys\":[{\"ColumnName\":\"TenantId\",\"Kind\":\"Hash\"}]}```",
+			`{"PartitionKeys":[{"ColumnName":"TenantId","Kind":"Hash"}]}`,
+		},
+		{
+			"merge",
+			mergePolicy,
+			"MaxRangeInHours=24 AllowRebuild=false",
+			"```{\"AllowRebuild\":false,\"MaxRangeInHours\":24}```",
+			`{"AllowRebuild":false,"MaxRangeInHours":24}`,
+		},
+		{
+			"ingestionBatching",
+			ingestionBatchingPolicy,
+			"MaximumBatchingTimeSpan=30s MaximumNumberOfItems=500",
+			"```{\"MaximumBatchingTimeSpan\":\"00:00:30\",\"MaximumNumberOfItems\":500}```",
+			`{"MaximumBatchingTimeSpan":"00:00:30","MaximumNumberOfItems":500}`,
+		},
+		{
+			"streamingIngestion",
+			streamingIngestionPolicy,
+			"IsEnabled=true HintAllocatedRate=2.5",
+			"```{\"HintAllocatedRate\":2.5,\"IsEnabled\":true}```",
+			`{"HintAllocatedRate":2.5,"IsEnabled":true}`,
+		},
+		{
+			"rowOrder",
+			rowOrderPolicy,
+			"Timestamp desc, ['Tenant Id']",
+			"(Timestamp desc, ['Tenant Id'] asc)",
+			`{"Keys":["Timestamp desc","['Tenant Id'] asc"]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.kind.policy(annotation{name: tt.kind.annotation, value: tt.value}, "Events")
+			require.NoError(t, err)
+			assert.Equal(t, tt.kind.kind, p.kind)
+			assert.Equal(t, "Events", p.table)
+			assert.Equal(t, tt.arg, p.arg)
+			assert.Equal(t, tt.json, p.value)
+		})
+	}
+}
+
+func Test_policyKind_policy_errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		kind   policyKind
+		value  string
+		errMsg string
+	}{
+		{"empty", retentionPolicy, "",
+			"missing properties for '@retentionPolicy'. Allowed properties: SoftDeletePeriod, Recoverability"},
+		{"unknownProperty", retentionPolicy, "SoftDelete=30d",
+			"unknown property 'SoftDelete' for '@retentionPolicy'. Allowed properties: SoftDeletePeriod, Recoverability"},
+		{"invalidTimespan", retentionPolicy, "SoftDeletePeriod=30",
+			"invalid value '30' for property 'SoftDeletePeriod'. Expected a timespan, i.e. 30d"},
+		{"invalidEnum", retentionPolicy, "Recoverability=On",
+			"invalid value 'On' for property 'Recoverability'. Expected one of: Enabled, Disabled"},
+		{"invalidInt", mergePolicy, "MaxRangeInHours=1.5",
+			"invalid value '1.5' for property 'MaxRangeInHours'. Expected an integer"},
+		{"invalidBool", streamingIngestionPolicy, "IsEnabled=1",
+			"invalid value '1' for property 'IsEnabled'. Expected true or false"},
+		{"invalidJSON", mergePolicy, "{MaxRangeInHours: 1}",
+			"invalid JSON for '@mergePolicy': invalid character 'M' looking for beginning of object key string"},
+		{"jsonNotAllowed", cachingPolicy, `{"Hot": "1d"}`,
+			"'@cachingPolicy' must be declared with properties, i.e. Hot=value"},
+		{"propertiesNotAllowed", partitioningPolicy, "PartitionKeys=TenantId",
+			"'@partitioningPolicy' must be declared as a JSON object, i.e. {...}"},
+		{"invalidRowOrder", rowOrderPolicy, "Timestamp descending",
+			"invalid order 'descending' for column 'Timestamp'. Expected asc or desc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.kind.policy(annotation{name: tt.kind.annotation, value: tt.value, row: 2, col: 4}, "Events")
+			require.Error(t, err)
+
+			var parseErr *ParseError
+			require.ErrorAs(t, err, &parseErr)
+			assert.Equal(t, 2, parseErr.row)
+			assert.Equal(t, 4, parseErr.col)
+			assert.Equal(t, tt.errMsg, parseErr.msg)
+		})
+	}
+}
+
+func Test_parsePolicyFile(t *testing.T) {
+	content := `{
+  "database": {
+    "retentionPolicy": "SoftDeletePeriod=365d"
+  },
+  "tables": {
+    "cachingPolicy": "Hot=7d",
+    "partitioningPolicy": {"PartitionKeys": []}
+  }
+}`
+	policies, err := parsePolicyFile([]byte(content))
+	require.NoError(t, err)
+	assert.Equal(t, []annotation{
+		{name: "retentionPolicy", value: "SoftDeletePeriod=365d", row: 3, col: 6},
+	}, policies.database)
+	assert.Equal(t, []annotation{
+		{name: "cachingPolicy", value: "Hot=7d", row: 6, col: 6},
+		{name: "partitioningPolicy", value: `{"PartitionKeys":[]}`, row: 7, col: 6},
+	}, policies.tables)
+
+	for _, invalid := range []string{"", "[]", `{"views": {}}`, `{"tables": {"cachingPolicy": "Hot=7d"`} {
+		_, err := parsePolicyFile([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestBuild_Policies(t *testing.T) {
+	srcRoot := t.TempDir()
+	files := map[string]string{
+		PolicyFile: `{
+  "database": { "cachingPolicy": "Hot=31d" },
+  "tables": { "retentionPolicy": "SoftDeletePeriod=365d", "cachingPolicy": "Hot=1d" }
+}`,
+		"tables/" + PolicyFile: `{ "tables": { "retentionPolicy": "SoftDeletePeriod=90d" } }`,
+		"tables/Events.csl":    "// @cachingPolicy Hot=7d\n// @rowOrderPolicy Timestamp desc\nlet Events = datatable(Timestamp:datetime)[]",
+	}
+	for name, content := range files {
+		path := filepath.Join(srcRoot, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	}
+
+	outRoot := filepath.Join(srcRoot, OutDir)
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+
+	commands := []string{}
+	for _, e := range m.Entities {
+		cmds, err := readCommands(outRoot, e)
+		require.NoError(t, err)
+		commands = append(commands, e.Kind+" "+e.Name+": "+strings.Join(cmds, "\n"))
+	}
+	assert.Equal(t, []string{
+		"table Events: .create-merge table Events(Timestamp:datetime) with (folder=\"tables\",docstring=\"\")",
+		"policy Events caching: .alter table Events policy caching hot = time(7.00:00:00)",
+		"policy Events roworder: .alter table Events policy roworder (Timestamp desc)",
+		"policy Events retention: .alter table Events policy retention ```{\"SoftDeletePeriod\":\"90.00:00:00\"}```",
+		"policy database caching: .alter database ${database} policy caching hot = time(31.00:00:00)",
+	}, commands)
+	assert.Equal(t, "policies.json.csl", m.Entities[4].File)
+}
+
+func TestBuild_PolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		errMsg string
+	}{
+		{
+			"databaseInSubfolder",
+			map[string]string{"tables/" + PolicyFile: "{\n  \"database\": { \"cachingPolicy\": \"Hot=1d\" }\n}"},
+			filepath.Join("tables", PolicyFile) + ":2:18: database policies can only be declared in the policies.json at the source root",
+		},
+		{
+			"notDatabasePolicy",
+			map[string]string{PolicyFile: `{"database": {"rowOrderPolicy": "Timestamp"}}`},
+			"policies.json:1:16: 'rowOrderPolicy' cannot be declared on a database",
+		},
+		{
+			"unknownPolicy",
+			map[string]string{
+				PolicyFile:   `{"tables": {"updatePolicy": "Source=A Function=B"}}`,
+				"Events.csl": "let Events = datatable(a:int)[]",
+			},
+			"policies.json:1:14: unknown policy 'updatePolicy'. Allowed policies: retentionPolicy, cachingPolicy, " +
+				"partitioningPolicy, mergePolicy, ingestionBatchingPolicy, streamingIngestionPolicy, rowOrderPolicy",
+		},
+		{
+			"invalidTableDefault",
+			map[string]string{
+				PolicyFile:   `{"tables": {"cachingPolicy": "Hot=hot"}}`,
+				"Events.csl": "let Events = datatable(a:int)[]",
+			},
+			"policies.json:1:14: invalid value 'hot' for property 'Hot'. Expected a timespan, i.e. 30d",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcRoot := t.TempDir()
+			for name, content := range tt.files {
+				path := filepath.Join(srcRoot, name)
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+				require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+			}
+
+			_, err := Build(srcRoot, filepath.Join(srcRoot, OutDir), BuildOptions{})
+			require.EqualError(t, err, tt.errMsg)
+		})
+	}
+}
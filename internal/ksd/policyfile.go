@@ -0,0 +1,199 @@
+package ksd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// PolicyFile is the name of the file that declares the default policies of the tables in its folder
+// and subfolders. The file at the source root may also declare the policies of the database.
+//
+// Each policy is declared with the name of its annotation, and the annotation value as a string:
+//
+//	{
+//	  "database": { "retentionPolicy": "SoftDeletePeriod=365d" },
+//	  "tables": { "cachingPolicy": "Hot=7d" }
+//	}
+const PolicyFile = "policies.json"
+
+// folderPolicies are the policies declared in a policy file.
+type folderPolicies struct {
+	// the policies of the database
+	database []annotation
+	// the default policies of the tables in the folder
+	tables []annotation
+}
+
+// parsePolicyFile parses the policy file content. Policies are returned as annotations,
+// positioned at their name in the file.
+func parsePolicyFile(content []byte) (*folderPolicies, error) {
+	policies := &folderPolicies{}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	position := func() (row int, col int) {
+		offset := int(dec.InputOffset())
+		before := content[:offset]
+		row = bytes.Count(before, []byte("\n")) + 1
+		col = offset - bytes.LastIndexByte(before, '\n')
+		return row, col
+	}
+	invalid := func(err error) error {
+		row, col := position()
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return newParseError(row, col, "invalid policy file: %v", err)
+	}
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, invalid(err)
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, invalid(err)
+		}
+
+		var section *[]annotation
+		switch key {
+		case "database":
+			section = &policies.database
+		case "tables":
+			section = &policies.tables
+		default:
+			row, col := position()
+			return nil, newParseError(
+				row, col, "unknown section '%v' in policy file. Allowed sections: database, tables", key)
+		}
+
+		if err := expectDelim(dec, '{'); err != nil {
+			return nil, invalid(err)
+		}
+		for dec.More() {
+			name, err := dec.Token()
+			if err != nil {
+				return nil, invalid(err)
+			}
+			row, col := position()
+			// position at the start of the name, after the opening quote
+			col -= len(name.(string)) + 1
+
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, invalid(err)
+			}
+
+			// policies declared as JSON objects may be written as objects, instead of as strings
+			value := string(raw)
+			var str string
+			if err := json.Unmarshal(raw, &str); err == nil {
+				value = str
+			} else if compact := (&bytes.Buffer{}); json.Compact(compact, raw) == nil {
+				value = compact.String()
+			}
+
+			*section = append(*section, annotation{
+				name:  name.(string),
+				value: strings.TrimSpace(value),
+				row:   row,
+				col:   col,
+			})
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return nil, invalid(err)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, invalid(err)
+	}
+
+	return policies, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("expected '%s', found '%v'", delim, t)
+	}
+	return nil
+}
+
+// findPolicyKind returns the table or database policy kind declared by the annotation.
+func findPolicyKind(a annotation) (policyKind, error) {
+	names := make([]string, 0, len(policyKinds))
+	for _, k := range policyKinds {
+		if k.annotation == a.name {
+			return k, nil
+		}
+		names = append(names, k.annotation)
+	}
+	return policyKind{}, newParseError(
+		a.row, a.col, "unknown policy '%s'. Allowed policies: %s", a.name, strings.Join(names, ", "))
+}
+
+// databasePolicies returns the database policies declared in the policy file.
+func databasePolicies(policies *folderPolicies) ([]*declaration, error) {
+	decls := []*declaration{}
+	seen := map[string]bool{}
+	for _, a := range policies.database {
+		k, err := findPolicyKind(a)
+		if err != nil {
+			return nil, err
+		}
+		if !k.database {
+			return nil, newParseError(a.row, a.col, "'%s' cannot be declared on a database", a.name)
+		}
+		if seen[a.name] {
+			return nil, newParseError(a.row, a.col, "duplicate policy '%s'", a.name)
+		}
+		seen[a.name] = true
+
+		p, err := k.policy(a, "")
+		if err != nil {
+			return nil, err
+		}
+		decls = append(decls, newPolicyDeclaration(p))
+	}
+	return decls, nil
+}
+
+// applyDefaultPolicies applies the default table policies of the folders that contain the source
+// to the table declaration. Policies declared by the table, or by a folder closer to the table, take precedence.
+func applyDefaultPolicies(src source, folders map[string]*folderPolicies) error {
+	declared := map[string]bool{}
+	for _, p := range src.decl.policies {
+		declared[p.kind] = true
+	}
+
+	dir := filepath.Dir(src.rel)
+	for {
+		if policies, has := folders[dir]; has {
+			for _, a := range policies.tables {
+				k, err := findPolicyKind(a)
+				if err != nil {
+					return parseFileError(filepath.Join(dir, PolicyFile), err)
+				}
+				if declared[k.kind] {
+					continue
+				}
+				declared[k.kind] = true
+
+				if err := applyPolicyAnnotation(k)(src.decl, a); err != nil {
+					return parseFileError(filepath.Join(dir, PolicyFile), err)
+				}
+			}
+		}
+
+		if dir == "." {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
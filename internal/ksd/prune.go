@@ -0,0 +1,201 @@
+package ksd
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+)
+
+// PruneConfirmFunc is called with the names of the entities of the given kind
+// that are about to be dropped from db. Dropping is skipped when it returns false.
+type PruneConfirmFunc func(db string, kind string, names []string) (bool, error)
+
+// PruneOptions configures dropping entities in the database that are no longer declared in source.
+type PruneOptions struct {
+	// Drop functions that are not declared.
+	Functions bool
+	// Drop tables that are not declared. Dropping a table deletes its data.
+	Tables bool
+
+	// Limit pruning to entities in these folders, including subfolders.
+	Folders []string
+	// Limit pruning to entities with names matching these patterns.
+	// Patterns use the syntax of path.Match, i.e. 'Legacy*'.
+	Names []string
+
+	// Confirm is called before entities are dropped.
+	Confirm PruneConfirmFunc
+}
+
+func (o PruneOptions) enabled() bool {
+	return o.Functions || o.Tables
+}
+
+// pruneScope determines the database entities owned by the project.
+type pruneScope struct {
+	folders []string
+	names   []string
+}
+
+// newPruneScope creates the scope for pruning. When no folders or names are specified,
+// the project owns the top-level folders of its declarations.
+func newPruneScope(m *manifest, opts PruneOptions) (pruneScope, error) {
+	for _, pattern := range opts.Names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return pruneScope{}, fmt.Errorf("invalid name pattern '%s': %w", pattern, err)
+		}
+	}
+
+	scope := pruneScope{
+		folders: make([]string, 0, len(opts.Folders)),
+		names:   opts.Names,
+	}
+	for _, folder := range opts.Folders {
+		scope.folders = append(scope.folders, strings.Trim(strings.ReplaceAll(folder, "\\", "/"), "/"))
+	}
+
+	if len(scope.folders) == 0 && len(scope.names) == 0 {
+		seen := map[string]bool{}
+		for _, e := range m.Entities {
+			top, _, _ := strings.Cut(e.Folder, "/")
+			// declarations at the source root do not own the entities that are not in a folder
+			if top == "" {
+				continue
+			}
+			if !seen[top] {
+				seen[top] = true
+				scope.folders = append(scope.folders, top)
+			}
+		}
+		sort.Strings(scope.folders)
+	}
+
+	return scope, nil
+}
+
+// owns returns true if the entity with the given name and folder is owned by the project.
+func (s pruneScope) owns(name string, folder string) bool {
+	for _, f := range s.folders {
+		if folder == f || strings.HasPrefix(folder, f+"/") {
+			return true
+		}
+	}
+
+	for _, pattern := range s.names {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneCandidates returns the functions and tables in the database that are owned by the project,
+// but are not declared in the manifest.
+func pruneCandidates(m *manifest, state *dbState, scope pruneScope) (functions []string, tables []string) {
+	declared := map[string]bool{}
+	for _, e := range m.Entities {
+		declared[e.Name] = true
+	}
+
+	for _, name := range sortedKeys(state.functions) {
+		if !declared[name] && scope.owns(name, state.functions[name].Folder) {
+			functions = append(functions, name)
+		}
+	}
+
+	for _, name := range sortedKeys(state.tables) {
+		// the state of incremental syncs is not dropped
+		if !declared[name] && name != StateTable && scope.owns(name, state.tables[name].Folder) {
+			tables = append(tables, name)
+		}
+	}
+
+	return functions, tables
+}
+
+// prune drops functions and tables in the database that are no longer declared in the manifest.
+// The state keys of the entities that were dropped are returned, including when an error is returned.
+func prune(
+	ctx context.Context,
+	client kustoClient,
+	db string,
+	m *manifest,
+	opts PruneOptions) ([]string, error) {
+	scope, err := newPruneScope(m, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := fetchState(ctx, client, db)
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := []string{}
+	functions, tables := pruneCandidates(m, state, scope)
+	if opts.Functions {
+		kind := declType(functionType).String()
+		names, err := dropAll(ctx, client, db, kind, functions, opts.Confirm)
+		for _, name := range names {
+			dropped = append(dropped, stateKey(kind, name))
+		}
+		if err != nil {
+			return dropped, err
+		}
+	}
+
+	if opts.Tables {
+		kind := declType(tableType).String()
+		names, err := dropAll(ctx, client, db, kind, tables, opts.Confirm)
+		for _, name := range names {
+			dropped = append(dropped, stateKey(kind, name))
+		}
+		if err != nil {
+			return dropped, err
+		}
+	}
+
+	return dropped, nil
+}
+
+func dropAll(
+	ctx context.Context,
+	client kustoClient,
+	db string,
+	kind string,
+	names []string,
+	confirm PruneConfirmFunc) (dropped []string, err error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	if confirm != nil {
+		ok, err := confirm(db, kind, names)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			fmt.Printf("Skipped dropping %ss\n", kind)
+			return nil, nil
+		}
+	}
+
+	for _, name := range names {
+		command := fmt.Sprintf(".drop %s %s ifexists", kind, quoteName(name))
+		err := mgmtRows(ctx, client, db, command, func(_ *table.Row) error { return nil })
+		if err != nil {
+			return dropped, fmt.Errorf("dropping %s %s: %w", kind, name, err)
+		}
+
+		fmt.Printf("Dropped %s %s\n", kind, name)
+		dropped = append(dropped, name)
+	}
+
+	return dropped, nil
+}
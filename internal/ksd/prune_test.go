@@ -0,0 +1,90 @@
+package ksd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_pruneCandidates(t *testing.T) {
+	m := &manifest{
+		Entities: []manifestEntity{
+			{Name: "Find", Kind: "function", File: "functions/dir1/Find.csl", Folder: "functions/dir1"},
+			{Name: "Limit", Kind: "function", File: "functions/dir2/Limit.csl", Folder: "functions/dir2"},
+			{Name: "Log", Kind: "table", File: "tables/Log.csl", Folder: "tables"},
+			{Name: "Root", Kind: "function", File: "Root.csl", Folder: ""},
+		},
+	}
+
+	state := &dbState{
+		functions: map[string]dbFunction{
+			"Find":        {Name: "Find", Folder: "functions/dir1"},
+			"Limit":       {Name: "Limit", Folder: "functions/dir2"},
+			"Removed":     {Name: "Removed", Folder: "functions/dir3"},
+			"RemovedRoot": {Name: "RemovedRoot", Folder: "functions"},
+			"Shared":      {Name: "Shared", Folder: "shared"},
+			"LegacyFind":  {Name: "LegacyFind", Folder: ""},
+			"NotOwned":    {Name: "NotOwned", Folder: "functionsOther"},
+		},
+		tables: map[string]dbTable{
+			"Log":       {Name: "Log", Folder: "tables"},
+			"OldLog":    {Name: "OldLog", Folder: "tables/old"},
+			"LegacyLog": {Name: "LegacyLog"},
+			StateTable:  {Name: StateTable, Folder: stateFolder},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		opts      PruneOptions
+		functions []string
+		tables    []string
+	}{
+		{
+			"DefaultScope",
+			PruneOptions{},
+			[]string{"Removed", "RemovedRoot"},
+			[]string{"OldLog"},
+		},
+		{
+			"Folders",
+			PruneOptions{Folders: []string{"functions/dir3", "shared/"}},
+			[]string{"Removed", "Shared"},
+			nil,
+		},
+		{
+			"Names",
+			PruneOptions{Names: []string{"Legacy*"}},
+			[]string{"LegacyFind"},
+			[]string{"LegacyLog"},
+		},
+		{
+			"FoldersAndNames",
+			PruneOptions{Folders: []string{"tables"}, Names: []string{"Legacy*"}},
+			[]string{"LegacyFind"},
+			[]string{"LegacyLog", "OldLog"},
+		},
+		{
+			"AllNames",
+			PruneOptions{Names: []string{"*"}},
+			[]string{"LegacyFind", "NotOwned", "Removed", "RemovedRoot", "Shared"},
+			[]string{"LegacyLog", "OldLog"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scope, err := newPruneScope(m, tt.opts)
+			require.NoError(t, err)
+
+			functions, tables := pruneCandidates(m, state, scope)
+			assert.Equal(t, tt.functions, functions)
+			assert.Equal(t, tt.tables, tables)
+		})
+	}
+}
+
+func Test_newPruneScope_invalidPattern(t *testing.T) {
+	_, err := newPruneScope(&manifest{}, PruneOptions{Names: []string{"["}})
+	require.Error(t, err)
+}
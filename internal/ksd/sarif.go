@@ -0,0 +1,152 @@
+package ksd
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// the SARIF version and schema of WriteSARIF
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+)
+
+// buildRuleDescription describes RuleBuild in SARIF output.
+const buildRuleDescription = "Source files should parse, and their declarations should be valid."
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	// nil if the position in the file is not known
+	Region *sarifRegion `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+}
+
+// WriteSARIF writes the diagnostics of the source files under srcRoot as a SARIF 2.1.0 log, for code scanning tools.
+//
+// The URI of each file is relative to the root of the git repository that contains srcRoot,
+// or to srcRoot if it is not in a repository. The rules of the log are the rules of the diagnostics.
+func (d Diagnostics) WriteSARIF(w io.Writer, srcRoot string) error {
+	srcRoot, err := filepath.Abs(srcRoot)
+	if err != nil {
+		return err
+	}
+	prefix, err := filepath.Rel(repositoryRoot(srcRoot), srcRoot)
+	if err != nil {
+		return err
+	}
+
+	descriptions := map[string]string{RuleBuild: buildRuleDescription}
+	for _, r := range lintRules {
+		descriptions[r.name] = r.description
+	}
+
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "ksd",
+			InformationURI: "https://github.com/weikanglim/ksd",
+			Rules:          []sarifRule{},
+		}},
+		// columns count characters, as in the text output
+		ColumnKind: "unicodeCodePoints",
+		Results:    []sarifResult{},
+	}
+	ruleIndex := map[string]int{}
+	for _, diag := range d {
+		rule := diag.Rule()
+		index, has := ruleIndex[rule]
+		if !has {
+			index = len(run.Tool.Driver.Rules)
+			ruleIndex[rule] = index
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+				ID:               rule,
+				ShortDescription: sarifMessage{Text: descriptions[rule]},
+			})
+		}
+
+		uri := url.URL{Path: filepath.ToSlash(filepath.Join(prefix, diag.File()))}
+		location := sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: uri.String()}}
+		if diag.Row() >= 1 && diag.Col() >= 1 {
+			location.Region = &sarifRegion{StartLine: diag.Row(), StartColumn: diag.Col()}
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    rule,
+			RuleIndex: index,
+			Level:     string(diag.Severity),
+			Message:   sarifMessage{Text: diag.Message()},
+			Locations: []sarifLocation{{PhysicalLocation: location}},
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{Schema: sarifSchema, Version: sarifVersion, Runs: []sarifRun{run}})
+}
+
+// repositoryRoot returns the closest directory to dir, or dir itself, that contains '.git'.
+// dir is returned if there is none.
+func repositoryRoot(dir string) string {
+	for current := dir; ; {
+		if _, err := os.Stat(filepath.Join(current, ".git")); err == nil {
+			return current
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return dir
+		}
+		current = parent
+	}
+}
@@ -0,0 +1,39 @@
+package ksd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnostics_WriteSARIF(t *testing.T) {
+	repoRoot := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(repoRoot, ".git"), 0777))
+	srcRoot := filepath.Join(repoRoot, "src", "kusto")
+	writeSources(t, srcRoot, map[string]string{
+		"functions/Get Logs.csl": "// Gets logs.\nlet get_logs = () { Logs | take 1 }",
+		"functions/Count.csl":    "let Count = () { Logs | count }",
+		"tables/Logs.csl":        "// Logs.\nlet Logs = datatable(a:int)[1]",
+	})
+
+	diags, err := Lint(srcRoot, LintOptions{Rules: map[string]string{"pascal-case": "error"}})
+	require.NoError(t, err)
+
+	b := &strings.Builder{}
+	require.NoError(t, diags.WriteSARIF(b, srcRoot))
+	snapshotter().SnapshotT(t, b.String())
+}
+
+func Test_repositoryRoot(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "a", "b")
+	require.NoError(t, os.MkdirAll(nested, 0777))
+	assert.Equal(t, nested, repositoryRoot(nested))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".git"), []byte("gitdir: elsewhere"), 0666))
+	assert.Equal(t, dir, repositoryRoot(nested))
+}
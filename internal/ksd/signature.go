@@ -0,0 +1,507 @@
+package ksd
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// parameter is a parameter in a function signature.
+type parameter struct {
+	name string
+	// the scalar type of the parameter. Empty for tabular parameters.
+	typ string
+	// true for tabular parameters, i.e. T:(x:int) or T:(*)
+	tabular bool
+	// the columns of a tabular parameter
+	columns []column
+	// true for tabular parameters that accept columns beyond the declared columns, i.e. T:(*)
+	wildcard bool
+	// the default value expression. Empty when the parameter has no default value.
+	defaultValue string
+
+	// position of the parameter name
+	row int
+	col int
+}
+
+// column is a column in a table schema.
+type column struct {
+	name string
+	typ  string
+	// the trailing '//' comment on the line of the column
+	doc string
+
+	// position of the column name
+	row int
+	col int
+}
+
+// scanner reads the tokens of a string, while tracking the position of the token at the cursor.
+type scanner struct {
+	src  string
+	toks []token
+	// index of the token at the cursor
+	i int
+	// byte offset, row and column of the token at the cursor. Rows and columns start at 1.
+	pos int
+	row int
+	col int
+}
+
+// newScanner returns a scanner over the tokens of src, where row and col are the position of the start of src.
+// An error is returned if src contains an unterminated string literal.
+func newScanner(src string, row int, col int) (*scanner, error) {
+	toks, err := tokenize(src, row, col)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &scanner{src: src, toks: toks}
+	s.seek(0)
+	return s, nil
+}
+
+// seek moves the cursor to the token at index i.
+func (s *scanner) seek(i int) {
+	s.i = i
+	t := s.toks[i]
+	s.pos, s.row, s.col = t.pos, t.row, t.col
+}
+
+// tok returns the token at the cursor.
+func (s *scanner) tok() token {
+	return s.toks[s.i]
+}
+
+func (s *scanner) eof() bool {
+	return s.tok().kind == tokenEOF
+}
+
+// next advances the cursor past the token at the cursor, and returns the token.
+func (s *scanner) next() token {
+	t := s.tok()
+	if !s.eof() {
+		s.seek(s.i + 1)
+	}
+	return t
+}
+
+// skipSpace advances the cursor past whitespace, line breaks and '//' comments.
+func (s *scanner) skipSpace() {
+	for s.tok().trivia() {
+		s.next()
+	}
+}
+
+// skipLineSpace advances the cursor past whitespace, up to the end of the line.
+func (s *scanner) skipLineSpace() {
+	for s.tok().kind == tokenSpace {
+		s.next()
+	}
+}
+
+// commentLine is a '//' comment line.
+type commentLine struct {
+	// the line, including any indentation
+	text string
+	row  int
+}
+
+// leadingComments advances the cursor to the start of the first line that is neither empty nor a '//' comment.
+// The block of comment lines that immediately precedes the line is returned.
+func (s *scanner) leadingComments() []commentLine {
+	comments := []commentLine{}
+	for !s.eof() {
+		lineStart := s.i
+		s.skipLineSpace()
+		switch t := s.tok(); t.kind {
+		case tokenEOF:
+			return comments
+		case tokenNewline:
+			// an empty line ends the comment block
+			comments = []commentLine{}
+			s.next()
+		case tokenComment:
+			comments = append(comments, commentLine{text: s.src[s.toks[lineStart].pos:t.end()], row: t.row})
+			s.next()
+			s.accept('\n')
+		default:
+			s.seek(lineStart)
+			return comments
+		}
+	}
+	return comments
+}
+
+// recover advances the cursor past a declaration with an error, to the next 'let' statement at the start
+// of a line, or to the end of input. The cursor is placed at the start of the block of comment lines that
+// immediately precedes the statement, so that its docstring and annotations are parsed.
+func (s *scanner) recover() {
+	start := s.i
+	next := len(s.toks) - 1
+	for i := start + 1; i < len(s.toks); i++ {
+		if t := s.toks[i]; t.kind == tokenIdentifier && t.text == "let" && t.col == 1 {
+			next = i
+			break
+		}
+	}
+
+	// each preceding comment line is a line break, followed by the comment and any indentation
+	for {
+		i := next - 2
+		if i <= start || s.toks[next-1].kind != tokenNewline || s.toks[i].kind != tokenComment {
+			break
+		}
+		if s.toks[i-1].kind == tokenSpace {
+			i--
+		}
+		if i <= start || s.toks[i-1].kind != tokenNewline {
+			// a comment that follows code on the same line
+			break
+		}
+		next = i
+	}
+	s.seek(next)
+}
+
+// accept advances the cursor past the punctuation r if it is at the cursor.
+// A '\n' accepts a line break.
+func (s *scanner) accept(r rune) bool {
+	t := s.tok()
+	if t.is(string(r)) || r == '\n' && t.kind == tokenNewline {
+		s.next()
+		return true
+	}
+	return false
+}
+
+func (s *scanner) errorf(m string, args ...any) error {
+	return newParseError(s.row, s.col, m, args...)
+}
+
+// describe returns a description of the token at the cursor for use in errors.
+func (s *scanner) describe() string {
+	switch t := s.tok(); t.kind {
+	case tokenEOF, tokenNewline:
+		return t.kind.String()
+	default:
+		return "'" + t.text + "'"
+	}
+}
+
+// identifier reads a plain identifier, i.e. Name, or a quoted identifier, i.e. ['Name'].
+func (s *scanner) identifier() (string, error) {
+	if s.accept('[') {
+		if s.tok().kind != tokenString {
+			return "", s.errorf("expected quoted identifier, i.e. ['name']")
+		}
+		name := unquoteString(s.tok().text)
+		if name == "" {
+			return "", s.errorf("empty quoted identifier")
+		}
+		s.next()
+		if !s.accept(']') {
+			return "", s.errorf("expected ']' after quoted identifier")
+		}
+		return name, nil
+	}
+
+	t := s.tok()
+	if r, _ := utf8.DecodeRuneInString(t.text); t.kind != tokenIdentifier || !isIdentifierStart(r) {
+		return "", s.errorf("expected identifier, found %s", s.describe())
+	}
+	s.next()
+	return t.text, nil
+}
+
+// skipExpression advances the cursor to the first unmatched closing bracket, skipping over nested brackets.
+// The byte offset one-past the end of the last token of the expression, other than whitespace and comments,
+// is returned.
+//
+// When stopAtComma is true, the cursor also stops at the first ',' that is not nested.
+func (s *scanner) skipExpression(stopAtComma bool) int {
+	depth := 0
+	end := s.pos
+	for !s.eof() {
+		t := s.tok()
+		switch {
+		case t.is("(") || t.is("[") || t.is("{"):
+			depth++
+		case t.is(")") || t.is("]") || t.is("}"):
+			if depth == 0 {
+				return end
+			}
+			depth--
+		case t.is(",") && depth == 0 && stopAtComma:
+			return end
+		}
+
+		if !t.trivia() {
+			end = t.end()
+		}
+		s.next()
+	}
+	return end
+}
+
+// parseFunction parses the function signature and body that start at the cursor, i.e.:
+//
+//	(name:type, T:(col:type, *), name:type = default) { body }
+func parseFunction(s *scanner, decl *declaration) error {
+	start := s.pos
+	if !s.accept('(') {
+		return s.errorf("expected '(' for function signature")
+	}
+
+	params := []parameter{}
+	s.skipSpace()
+	if !s.accept(')') {
+		for {
+			s.skipSpace()
+			param, err := parseParameter(s)
+			if err != nil {
+				return err
+			}
+			params = append(params, param)
+
+			s.skipSpace()
+			if s.accept(')') {
+				break
+			}
+			if !s.accept(',') {
+				return s.errorf("expected ',' or ')' after parameter '%s', found %s", param.name, s.describe())
+			}
+		}
+	}
+	decl.signature = s.src[start:s.pos]
+	decl.params = params
+
+	s.skipSpace()
+	if err := parseBody(s, decl, "function body"); err != nil {
+		return err
+	}
+
+	return s.expectEnd("function body")
+}
+
+// parseBody parses the body that starts at the cursor, from the opening '{' up to and including the matching '}'.
+func parseBody(s *scanner, decl *declaration, what string) error {
+	start := s.pos
+	row, col := s.row, s.col
+	if !s.accept('{') {
+		return s.errorf("expected '{' for beginning of %s, found %s", what, s.describe())
+	}
+	s.skipExpression(false)
+	if !s.accept('}') {
+		return s.errorf("unmatched braces, missing '}' for end of %s", what)
+	}
+	decl.body = s.src[start:s.pos]
+	decl.bodyRow, decl.bodyCol = row, col
+	return nil
+}
+
+// parseTable parses the table schema and rows that start at the cursor, i.e.:
+//
+//	(col:type, col:type) [ rows ]
+func parseTable(s *scanner, decl *declaration) error {
+	start := s.pos
+	if !s.accept('(') {
+		return s.errorf("expected '(' for table schema")
+	}
+
+	columns, _, err := parseSchema(s, false)
+	if err != nil {
+		return err
+	}
+	// comments are column docstrings, which are synced by a separate command
+	decl.signature = stripComments(s.src[start:s.pos])
+	decl.columns = columns
+
+	s.skipSpace()
+	if !s.accept('[') {
+		return s.errorf("expected '[' for beginning of table body, found %s", s.describe())
+	}
+	rowsStart := s.pos
+	if _, err := parseRows(s, columns); err != nil {
+		return err
+	}
+	decl.rows = strings.TrimSpace(s.src[rowsStart : s.pos-1])
+	decl.body = ""
+
+	return s.expectEnd("table body")
+}
+
+// expectEnd expects only whitespace, an optional ';' and a trailing comment on the rest of the line
+// after the end of the declaration.
+func (s *scanner) expectEnd(what string) error {
+	s.skipLineSpace()
+	s.accept(';')
+	s.skipLineSpace()
+	if s.tok().kind == tokenComment {
+		s.next()
+	}
+
+	if !s.eof() && !s.accept('\n') {
+		return s.errorf("unexpected %s after end of %s", s.describe(), what)
+	}
+	return nil
+}
+
+// scalarType reads a scalar type name, and verifies that it is a known Kusto scalar type.
+func (s *scanner) scalarType() (string, error) {
+	row, col := s.row, s.col
+	typ, err := s.identifier()
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := canonicalType(typ); !ok {
+		return "", newParseError(row, col, "unknown type '%s'. %s", typ, suggestType(typ))
+	}
+	return typ, nil
+}
+
+func parseParameter(s *scanner) (parameter, error) {
+	param := parameter{row: s.row, col: s.col}
+	name, err := s.identifier()
+	if err != nil {
+		return param, err
+	}
+	param.name = name
+
+	s.skipSpace()
+	if !s.accept(':') {
+		return param, s.errorf("expected ':' and type after parameter '%s'", name)
+	}
+
+	s.skipSpace()
+	if s.accept('(') {
+		param.tabular = true
+		param.columns, param.wildcard, err = parseSchema(s, true)
+		if err != nil {
+			return param, err
+		}
+	} else {
+		param.typ, err = s.scalarType()
+		if err != nil {
+			return param, err
+		}
+	}
+
+	s.skipSpace()
+	if s.accept('=') {
+		s.skipSpace()
+		start := s.pos
+		param.defaultValue = s.src[start:s.skipExpression(true)]
+		if param.defaultValue == "" {
+			return param, s.errorf("expected default value for parameter '%s'", name)
+		}
+	}
+
+	return param, nil
+}
+
+// parseSchema parses the columns of a tabular schema, after the opening '(', i.e.:
+//
+//	col:type, col:type, *)
+//
+// The wildcard '*' is only allowed when allowWildcard is true.
+func parseSchema(s *scanner, allowWildcard bool) (columns []column, wildcard bool, err error) {
+	columns = []column{}
+	s.skipSpace()
+	if s.accept(')') {
+		return columns, false, nil
+	}
+
+	declared := map[string]bool{}
+	for {
+		s.skipSpace()
+		if s.tok().is("*") {
+			if !allowWildcard {
+				return nil, false, s.errorf("'*' is not allowed in a table schema")
+			}
+			s.next()
+			wildcard = true
+		} else {
+			if wildcard {
+				return nil, false, s.errorf("'*' must be the last column in a schema")
+			}
+
+			col := column{row: s.row, col: s.col}
+			col.name, err = s.identifier()
+			if err != nil {
+				return nil, false, err
+			}
+
+			if declared[col.name] {
+				return nil, false, newParseError(col.row, col.col, "duplicate column '%s'", col.name)
+			}
+			declared[col.name] = true
+
+			s.skipSpace()
+			if !s.accept(':') {
+				return nil, false, s.errorf("expected ':' and type after column '%s'", col.name)
+			}
+
+			s.skipSpace()
+			col.typ, err = s.scalarType()
+			if err != nil {
+				return nil, false, err
+			}
+
+			// a comment on the same line as the column, before or after its ',', is the column docstring
+			s.skipLineSpace()
+			if s.accept(',') {
+				s.skipLineSpace()
+				col.doc = s.trailingComment()
+				columns = append(columns, col)
+				continue
+			}
+			col.doc = s.trailingComment()
+			columns = append(columns, col)
+		}
+
+		s.skipSpace()
+		if s.accept(')') {
+			return columns, wildcard, nil
+		}
+		if !s.accept(',') {
+			return nil, false, s.errorf("expected ',' or ')' in schema, found %s", s.describe())
+		}
+	}
+}
+
+// trailingComment reads the '//' comment at the cursor, and returns its text.
+// An empty string is returned if there is no comment at the cursor.
+func (s *scanner) trailingComment() string {
+	if s.tok().kind != tokenComment {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(s.next().text, "//"))
+}
+
+// stripComments removes the '//' comments, and any whitespace before them, from text.
+// Lines that only contain a comment are removed.
+func stripComments(text string) string {
+	toks, err := tokenize(text, 1, 1)
+	if err != nil {
+		return text
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(toks); i++ {
+		if toks[i].kind != tokenComment {
+			b.WriteString(toks[i].text)
+			continue
+		}
+
+		trimmed := strings.TrimRightFunc(b.String(), func(r rune) bool { return r == ' ' || r == '\t' })
+		b.Reset()
+		b.WriteString(trimmed)
+		// remove lines that only contain a comment
+		if (trimmed == "" || strings.HasSuffix(trimmed, "\n")) && toks[i+1].kind == tokenNewline {
+			i++
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,410 @@
+package ksd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+)
+
+// StateTable is the table in the database where sync records what it deployed for each entity:
+// the hash of its commands, its definition in the database after the sync, the version of ksd,
+// and the hash of the rows it appended.
+const StateTable = "KsdSyncState"
+
+// stateFolder is the folder of StateTable.
+const stateFolder = "ksd"
+
+// stateRecord is what sync last deployed for an entity, as recorded in StateTable.
+type stateRecord struct {
+	// the hash of the commands of the entity
+	Hash string
+	// the definition of the entity in the database, as rendered by liveDefinitions
+	Definition string
+	// the version of ksd that synced the entity
+	Version  string
+	SyncedOn time.Time
+	// the hash of the commands that append the rows of a table annotated with '// @data append', if any
+	RowsHash string
+}
+
+// syncState is what sync last deployed for each entity, by the key of the entity.
+type syncState map[string]stateRecord
+
+// stateKey returns the key of the entity of the kind and name in a syncState.
+func stateKey(kind string, name string) string {
+	return kind + "/" + name
+}
+
+// commandsHash returns the hash of the commands of an entity, as read from its command script file.
+//
+// The commands are hashed before secrets are substituted, so that secrets are not hashed.
+func commandsHash(cmds []string) string {
+	h := sha256.New()
+	for _, cmd := range cmds {
+		// the length separates the commands, so that commands split differently do not hash the same
+		fmt.Fprintf(h, "%d\n%s", len(cmd), cmd)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// createStateTableCommand returns the command that creates StateTable, or adds its missing columns.
+func createStateTableCommand() string {
+	return fmt.Sprintf(
+		".create-merge table %s "+
+			"(Kind:string, Name:string, Hash:string, SyncedOn:datetime, Definition:string, Version:string, RowsHash:string) "+
+			"with (folder=\"%s\", docstring=\"%s\")",
+		StateTable,
+		stateFolder,
+		"What ksd sync last deployed for each entity.")
+}
+
+// fetchSyncState retrieves what was last deployed for each entity from StateTable.
+//
+// If create is true, StateTable is created if it does not exist. Otherwise, nil is returned if it does not exist,
+// so that syncing does not require permissions beyond those to manage the declared entities.
+func fetchSyncState(ctx context.Context, client kustoClient, db string, create bool) (syncState, error) {
+	if create {
+		err := mgmtRows(ctx, client, db, createStateTableCommand(), func(_ *table.Row) error { return nil })
+		if err != nil {
+			return nil, fmt.Errorf("creating table %s: %w", StateTable, err)
+		}
+	} else {
+		exists := false
+		command := fmt.Sprintf(".show tables | where TableName == %s | project TableName", kqlString(StateTable))
+		err := mgmtRows(ctx, client, db, command, func(_ *table.Row) error {
+			exists = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("fetching table %s: %w", StateTable, err)
+		}
+		if !exists {
+			return nil, nil
+		}
+	}
+
+	type stateRow struct {
+		Kind       string
+		Name       string
+		Hash       string
+		Definition string
+		Version    string
+		SyncedOn   time.Time
+		RowsHash   string
+	}
+	state := syncState{}
+	query := fmt.Sprintf(
+		"%s | summarize arg_max(SyncedOn, Hash, Definition, Version, RowsHash) by Kind, Name", StateTable)
+	err := queryRows(ctx, client, db, query, func(row *table.Row) error {
+		res := stateRow{}
+		if err := row.ToStruct(&res); err != nil {
+			return err
+		}
+		if res.Hash != "" {
+			state[stateKey(res.Kind, res.Name)] = stateRecord{
+				Hash:       res.Hash,
+				Definition: res.Definition,
+				Version:    res.Version,
+				SyncedOn:   res.SyncedOn,
+				RowsHash:   res.RowsHash,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", StateTable, err)
+	}
+	return state, nil
+}
+
+// kqlString returns s as a double-quoted Kusto string literal.
+func kqlString(s string) string {
+	s = escapeString(s)
+	s = strings.ReplaceAll(s, "\r", "\\r")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+	s = strings.ReplaceAll(s, "\t", "\\t")
+	return "\"" + s + "\""
+}
+
+// recordStateCommand returns the command that records what was deployed for the entities in StateTable,
+// by the key of each entity. A record without a hash clears what was recorded for the entity.
+//
+// The table is replaced with a row per entity, keeping the rows of other entities,
+// so that it does not grow with each sync.
+func recordStateCommand(records map[string]stateRecord) string {
+	rows := make([]string, 0, len(records))
+	for _, key := range sortedKeys(records) {
+		kind, name, _ := strings.Cut(key, "/")
+		r := records[key]
+		rows = append(rows, strings.Join([]string{
+			kqlString(kind), kqlString(name), kqlString(r.Hash), kqlString(r.Definition), kqlString(r.Version),
+			kqlString(r.RowsHash),
+		}, ", "))
+	}
+	return fmt.Sprintf(
+		".set-or-replace %[1]s <|\n"+
+			"let synced = datatable(Kind:string, Name:string, Hash:string, Definition:string, Version:string, RowsHash:string) [\n    %[2]s\n]\n"+
+			"| extend SyncedOn = now();\n"+
+			"%[1]s\n"+
+			"| summarize arg_max(SyncedOn, Hash, Definition, Version, RowsHash) by Kind, Name\n"+
+			"| join kind=leftanti synced on Kind, Name\n"+
+			"| union synced\n"+
+			"| where isnotempty(Hash)\n"+
+			"| project Kind, Name, Hash, SyncedOn, Definition, Version, RowsHash",
+		StateTable,
+		strings.Join(rows, ",\n    "))
+}
+
+// clearState clears what was recorded in StateTable for the entities of the keys,
+// so that an entity that was dropped is synced again if it is declared again.
+func clearState(ctx context.Context, client kustoClient, db string, keys []string) error {
+	records := map[string]stateRecord{}
+	for _, key := range keys {
+		records[key] = stateRecord{}
+	}
+	return recordState(ctx, client, db, records)
+}
+
+// recordState records what was deployed for the entities in StateTable, by the key of each entity.
+func recordState(ctx context.Context, client kustoClient, db string, records map[string]stateRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	command := kql.New("")
+	command.AddUnsafe(recordStateCommand(records))
+	if _, err := client.Mgmt(ctx, db, command); err != nil {
+		return fmt.Errorf("recording the synced entities in %s: %w", StateTable, err)
+	}
+	return nil
+}
+
+// stateDiff compares the entities of a manifest with what sync last deployed.
+type stateDiff struct {
+	// the entities to sync, in the order of the manifest
+	changed *manifest
+	// the hash of the commands of each entity to sync, by name
+	hashes map[string]string
+	// the hash of the commands that append rows, of each entity to sync that has them, by name
+	rowsHashes map[string]string
+	// the entities that have not been synced before
+	created map[string]bool
+	// the number of entities whose commands did not change since they were last synced
+	unchanged int
+	// true if what is deployed is recorded in StateTable, i.e. the state was fetched from it
+	tracked bool
+}
+
+// diffState compares the commands of each entity in the manifest of the output directory root
+// with the hash of the commands last synced. In an incremental sync, entities with the same hash are skipped,
+// unless forced. A nil state means that StateTable does not exist, and nothing is recorded.
+//
+// The rows of a table annotated with '// @data append' are hashed on their own, and are not appended again
+// when their hash is the same, unless forced, so that syncing the same rows does not duplicate them.
+// Since the rows cannot be compared without StateTable, they are not appended without it, unless forced.
+func diffState(root string, m *manifest, state syncState, opts SyncOptions) (*stateDiff, error) {
+	diff := &stateDiff{
+		changed:    &manifest{},
+		hashes:     map[string]string{},
+		rowsHashes: map[string]string{},
+		created:    map[string]bool{},
+		tracked:    state != nil,
+	}
+
+	for _, e := range m.Entities {
+		key := stateKey(e.Kind, e.Name)
+		cmds, err := readCommands(root, e)
+		if err != nil {
+			return nil, err
+		}
+		hash := commandsHash(cmds)
+
+		synced, has := state[key]
+		unchanged := has && synced.Hash == hash && !opts.Force
+		if unchanged && opts.Incremental {
+			diff.unchanged++
+			continue
+		}
+
+		if appends := appendCommands(cmds); len(appends) > 0 {
+			if !diff.tracked && !opts.Force {
+				return nil, fmt.Errorf(
+					"%s %s in %s appends rows with '// @data append', which requires the %s table "+
+						"to not append the same rows again. Pass '--track' to create it, or '--force' to append the rows",
+					e.Kind, e.Name, e.File, StateTable)
+			}
+			rowsHash := commandsHash(appends)
+			if has && synced.RowsHash == rowsHash && !opts.Force {
+				e = withoutAppend(e, cmds)
+			}
+			diff.rowsHashes[e.Name] = rowsHash
+		}
+
+		diff.changed.Entities = append(diff.changed.Entities, e)
+		diff.hashes[e.Name] = hash
+		diff.created[e.Name] = !has
+	}
+
+	return diff, nil
+}
+
+// checkOutOfBand returns an error if the definition of any entity in the manifest was changed in the database
+// since it was last synced, showing both definitions. live is the definition of each entity in the database.
+//
+// Entities that were not synced before, or that no longer exist in the database, are not checked.
+func checkOutOfBand(m *manifest, state syncState, live map[string]string) error {
+	var b strings.Builder
+	changed := 0
+	for _, e := range m.Entities {
+		key := stateKey(e.Kind, e.Name)
+		synced, has := state[key]
+		if !has || synced.Definition == "" {
+			continue
+		}
+		definition, exists := live[key]
+		if !exists || definition == synced.Definition {
+			continue
+		}
+
+		changed++
+		fmt.Fprintf(&b, "\n\n%s %s in %s was changed in the database since ksd %s synced it on %s.\n",
+			e.Kind, e.Name, e.File, synced.Version, synced.SyncedOn.UTC().Format(time.RFC3339))
+		fmt.Fprintf(&b, "Last synced:\n%s\nIn the database:\n%s", indent(synced.Definition), indent(definition))
+	}
+
+	if changed == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"refusing to overwrite %d declaration(s) changed outside of ksd. "+
+			"Update the source to keep the changes, or pass '--overwrite' to overwrite them:%s",
+		changed, b.String())
+}
+
+// hasDefinitions returns true if the definition of any entity in the manifest was recorded when it was last synced.
+func hasDefinitions(m *manifest, state syncState) bool {
+	for _, e := range m.Entities {
+		if state[stateKey(e.Kind, e.Name)].Definition != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// indent indents each line of s.
+func indent(s string) string {
+	return "    " + strings.ReplaceAll(s, "\n", "\n    ")
+}
+
+// liveDefinitions returns the definition of each entity in the database state, by the key of the entity.
+// A definition includes the properties of an entity that sync sets, so that a change to any of them
+// outside of ksd changes the definition.
+func liveDefinitions(state *dbState) map[string]string {
+	columns := func(cols []dbColumn) string {
+		parts := make([]string, 0, len(cols))
+		for _, c := range cols {
+			parts = append(parts, fmt.Sprintf("%s:%s", quoteName(c.Name), c.CslType))
+		}
+		return "(" + strings.Join(parts, ", ") + ")"
+	}
+	properties := func(definition string, folder string, doc string) string {
+		return fmt.Sprintf("%s\nfolder: %s\ndocstring: %s", definition, folder, doc)
+	}
+
+	live := map[string]string{}
+	for name, fn := range state.functions {
+		live[stateKey(declType(functionType).String(), name)] =
+			properties(fn.Parameters+" "+fn.Body, fn.Folder, fn.DocString)
+	}
+	for name, t := range state.tables {
+		live[stateKey(declType(tableType).String(), name)] =
+			properties(columns(t.OrderedColumns), t.Folder, t.DocString)
+	}
+	for name, view := range state.views {
+		live[stateKey(declType(materializedViewType).String(), name)] =
+			properties(view.SourceTable+"\n"+view.Query, view.Folder, view.DocString)
+	}
+	for name, external := range state.externals {
+		live[stateKey(declType(externalTableType).String(), name)] =
+			properties(columns(external.OrderedColumns), external.Folder, external.DocString)
+	}
+	for name, export := range state.exports {
+		live[stateKey(declType(continuousExportType).String(), name)] =
+			fmt.Sprintf("to table %s\n%s", export.ExternalTableName, export.Query)
+	}
+	for name, policy := range state.policies {
+		live[stateKey(declType(policyType).String(), name)] = policy
+	}
+	return live
+}
+
+// fetchLiveDefinitions retrieves the definition of each entity in the database, by the key of the entity.
+func fetchLiveDefinitions(ctx context.Context, client kustoClient, db string) (map[string]string, error) {
+	state, err := fetchState(ctx, client, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := fetchPolicies(ctx, client, db, state); err != nil {
+		return nil, err
+	}
+	return liveDefinitions(state), nil
+}
+
+// records returns what was deployed for the entities that synced, with their definitions in live.
+//
+// The records of entities that are no longer in the manifest are kept, since they may be owned by
+// another project that syncs to the same database. They are cleared when the entities are pruned.
+func (diff *stateDiff) records(result *syncResult, live map[string]string) map[string]stateRecord {
+	records := map[string]stateRecord{}
+	for _, e := range result.synced {
+		key := stateKey(e.Kind, e.Name)
+		records[key] = stateRecord{
+			Hash:       diff.hashes[e.Name],
+			Definition: live[key],
+			Version:    Version,
+			RowsHash:   diff.rowsHashes[e.Name],
+		}
+	}
+	return records
+}
+
+// record records what was deployed for the entities that synced in StateTable, if it exists.
+// It then prints the number of entities created, updated, unchanged and failed.
+func (diff *stateDiff) record(ctx context.Context, client kustoClient, db string, result *syncResult) error {
+	if diff.tracked {
+		if err := diff.recordState(ctx, client, db, result); err != nil {
+			return err
+		}
+	}
+
+	created := 0
+	for _, e := range result.synced {
+		if diff.created[e.Name] {
+			created++
+		}
+	}
+	fmt.Printf("Sync: %d created, %d updated, %d unchanged, %d failed.\n",
+		created, len(result.synced)-created, diff.unchanged, len(result.errs))
+	return nil
+}
+
+// recordState records what was deployed for the entities that synced in StateTable,
+// with their definitions in the database after the sync.
+func (diff *stateDiff) recordState(ctx context.Context, client kustoClient, db string, result *syncResult) error {
+	var live map[string]string
+	if len(result.synced) > 0 {
+		var err error
+		live, err = fetchLiveDefinitions(ctx, client, db)
+		if err != nil {
+			return fmt.Errorf("recording the synced entities in %s: %w", StateTable, err)
+		}
+	}
+
+	return recordState(ctx, client, db, diff.records(result, live))
+}
@@ -0,0 +1,249 @@
+package ksd
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_commandsHash(t *testing.T) {
+	hash := commandsHash([]string{".create table T(a:int)", ".alter table T policy retention '{}'"})
+	assert.Len(t, hash, 64)
+	assert.Equal(t, hash, commandsHash([]string{".create table T(a:int)", ".alter table T policy retention '{}'"}))
+	assert.NotEqual(t, hash, commandsHash([]string{".create table T(a:int)"}))
+	assert.NotEqual(t, commandsHash([]string{"ab", "c"}), commandsHash([]string{"a", "bc"}))
+}
+
+func Test_recordStateCommand(t *testing.T) {
+	command := recordStateCommand(map[string]stateRecord{
+		stateKey("table", "Log"):         {Hash: "abc", Definition: "(a:int)\nfolder: tables", Version: "v1.0.0", RowsHash: "rows"},
+		stateKey("function", `Get"Logs`): {Hash: "def", Definition: "() {\n\tprint \"a\\b\"\n}", Version: "dev"},
+		stateKey("function", "Removed"):  {},
+	})
+	assert.Equal(t, `.set-or-replace KsdSyncState <|
+let synced = datatable(Kind:string, Name:string, Hash:string, Definition:string, Version:string, RowsHash:string) [
+    "function", "Get\"Logs", "def", "() {\n\tprint \"a\\b\"\n}", "dev", "",
+    "function", "Removed", "", "", "", "",
+    "table", "Log", "abc", "(a:int)\nfolder: tables", "v1.0.0", "rows"
+]
+| extend SyncedOn = now();
+KsdSyncState
+| summarize arg_max(SyncedOn, Hash, Definition, Version, RowsHash) by Kind, Name
+| join kind=leftanti synced on Kind, Name
+| union synced
+| where isnotempty(Hash)
+| project Kind, Name, Hash, SyncedOn, Definition, Version, RowsHash`, command)
+}
+
+func Test_diffState(t *testing.T) {
+	srcRoot := t.TempDir()
+	outRoot := filepath.Join(srcRoot, "kout")
+	writeSources(t, srcRoot, map[string]string{
+		"tables/Log.csl":      "let Log = datatable(a:int)[]",
+		"functions/Same.csl":  "let Same = () { Log }",
+		"functions/Edit.csl":  "let Edit = () { Log | take 1 }",
+		"functions/Added.csl": "let Added = () { print 1 }",
+	})
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+
+	hashes := map[string]string{}
+	for _, e := range m.Entities {
+		cmds, err := readCommands(outRoot, e)
+		require.NoError(t, err)
+		hashes[e.Name] = commandsHash(cmds)
+	}
+	state := syncState{
+		stateKey("table", "Log"):       {Hash: hashes["Log"]},
+		stateKey("function", "Same"):   {Hash: hashes["Same"]},
+		stateKey("function", "Edit"):   {Hash: "outdated"},
+		stateKey("function", "Delete"): {Hash: "deleted"},
+	}
+
+	diff, err := diffState(outRoot, m, state, SyncOptions{Incremental: true})
+	require.NoError(t, err)
+	names := []string{}
+	for _, e := range diff.changed.Entities {
+		names = append(names, e.Name)
+	}
+	assert.ElementsMatch(t, []string{"Edit", "Added"}, names)
+	assert.Equal(t, map[string]bool{"Edit": false, "Added": true}, diff.created)
+	assert.Equal(t, map[string]string{"Edit": hashes["Edit"], "Added": hashes["Added"]}, diff.hashes)
+	assert.Equal(t, 2, diff.unchanged)
+	assert.True(t, diff.tracked)
+
+	diff, err = diffState(outRoot, m, state, SyncOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, m.Entities, diff.changed.Entities)
+	assert.Equal(t, hashes, diff.hashes)
+	assert.Equal(t, 0, diff.unchanged)
+
+	// without StateTable, every entity is synced and nothing is recorded
+	diff, err = diffState(outRoot, m, nil, SyncOptions{Incremental: true})
+	require.NoError(t, err)
+	assert.Equal(t, m.Entities, diff.changed.Entities)
+	assert.False(t, diff.tracked)
+
+	client := &fakeClient{mgmt: func(command string) error {
+		t.Fatalf("unexpected command: %s", command)
+		return nil
+	}}
+	require.NoError(t, diff.record(context.Background(), client, "db", &syncResult{synced: m.Entities}))
+}
+
+func Test_diffState_dataAppend(t *testing.T) {
+	srcRoot := t.TempDir()
+	outRoot := filepath.Join(srcRoot, "kout")
+	writeSources(t, srcRoot, map[string]string{
+		"tables/Events.csl": "// @data append\nlet Events = datatable(a:int)[1, 2]",
+	})
+	_, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+	cmds, err := readCommands(outRoot, m.Entities[0])
+	require.NoError(t, err)
+	require.Len(t, cmds, 2)
+	rowsHash := commandsHash(cmds[1:])
+	synced := syncState{stateKey("table", "Events"): {Hash: commandsHash(cmds), RowsHash: rowsHash}}
+
+	commandsOf := func(state syncState, opts SyncOptions) []string {
+		diff, err := diffState(outRoot, m, state, opts)
+		require.NoError(t, err)
+		require.Len(t, diff.changed.Entities, 1)
+		assert.Equal(t, map[string]string{"Events": rowsHash}, diff.rowsHashes)
+		cmds, err := readCommands(outRoot, diff.changed.Entities[0])
+		require.NoError(t, err)
+		return cmds
+	}
+
+	// the rows are appended when they changed, regardless of the rest of the declaration
+	assert.Equal(t, cmds, commandsOf(syncState{stateKey("table", "Events"): {Hash: "outdated"}}, SyncOptions{}))
+	assert.Equal(t, cmds, commandsOf(syncState{stateKey("table", "Events"): {Hash: "outdated", RowsHash: "outdated"}}, SyncOptions{}))
+	assert.Equal(t, cmds[:1], commandsOf(syncState{stateKey("table", "Events"): {Hash: "outdated", RowsHash: rowsHash}}, SyncOptions{}))
+
+	// the rows are not appended again when they were recorded, unless forced
+	assert.Equal(t, cmds[:1], commandsOf(synced, SyncOptions{}))
+	assert.Equal(t, cmds, commandsOf(synced, SyncOptions{Force: true}))
+	assert.Equal(t, cmds, commandsOf(synced, SyncOptions{Incremental: true, Force: true}))
+
+	// without StateTable, the rows are only appended when forced, since they would be appended by every sync
+	_, err = diffState(outRoot, m, nil, SyncOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "table Events in tables/Events.csl appends rows with '// @data append', "+
+		"which requires the KsdSyncState table to not append the same rows again")
+	assert.Equal(t, cmds, commandsOf(nil, SyncOptions{Force: true}))
+}
+
+func Test_stateDiff_records(t *testing.T) {
+	diff := &stateDiff{
+		hashes:     map[string]string{"Edit": "new", "Added": "added", "Broken": "broken"},
+		rowsHashes: map[string]string{"Added": "rows"},
+		created:    map[string]bool{"Edit": false, "Added": true, "Broken": true},
+		unchanged:  2,
+	}
+	result := &syncResult{
+		synced: []manifestEntity{{Name: "Edit", Kind: "function"}, {Name: "Added", Kind: "function"}},
+		errs:   []error{assert.AnError},
+	}
+	live := map[string]string{
+		stateKey("function", "Edit"):   "() { 2 }",
+		stateKey("function", "Added"):  "() { 1 }",
+		stateKey("function", "Broken"): "() { 0 }",
+	}
+
+	// the entity that failed to sync is not recorded, so that it is synced again,
+	// and entities that are not in the manifest are left to the projects that own them
+	assert.Equal(t, map[string]stateRecord{
+		stateKey("function", "Added"): {Hash: "added", Definition: "() { 1 }", Version: Version, RowsHash: "rows"},
+		stateKey("function", "Edit"):  {Hash: "new", Definition: "() { 2 }", Version: Version},
+	}, diff.records(result, live))
+}
+
+func Test_clearState(t *testing.T) {
+	commands := []string{}
+	client := &fakeClient{mgmt: func(command string) error {
+		commands = append(commands, command)
+		return nil
+	}}
+
+	require.NoError(t, clearState(context.Background(), client, "db", nil))
+	assert.Empty(t, commands)
+
+	require.NoError(t, clearState(context.Background(), client, "db", []string{stateKey("function", "Pruned")}))
+	assert.Equal(t, []string{recordStateCommand(map[string]stateRecord{stateKey("function", "Pruned"): {}})}, commands)
+}
+
+func Test_checkOutOfBand(t *testing.T) {
+	m := &manifest{Entities: []manifestEntity{
+		{Name: "Same", Kind: "function", File: "functions/Same.csl"},
+		{Name: "Edited", Kind: "function", File: "functions/Edited.csl"},
+		{Name: "Dropped", Kind: "function", File: "functions/Dropped.csl"},
+		{Name: "New", Kind: "function", File: "functions/New.csl"},
+		{Name: "Unrecorded", Kind: "function", File: "functions/Unrecorded.csl"},
+	}}
+	syncedOn := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	state := syncState{
+		stateKey("function", "Same"):       {Hash: "a", Definition: "() { 1 }", Version: "v1.0.0", SyncedOn: syncedOn},
+		stateKey("function", "Edited"):     {Hash: "b", Definition: "() { 1 }\nfolder: f", Version: "v1.0.0", SyncedOn: syncedOn},
+		stateKey("function", "Dropped"):    {Hash: "c", Definition: "() { 1 }", Version: "v1.0.0", SyncedOn: syncedOn},
+		stateKey("function", "Unrecorded"): {Hash: "d"},
+	}
+	live := map[string]string{
+		stateKey("function", "Same"):       "() { 1 }",
+		stateKey("function", "Edited"):     "() { 2 }\nfolder: f",
+		stateKey("function", "New"):        "() { 1 }",
+		stateKey("function", "Unrecorded"): "() { 1 }",
+	}
+
+	assert.True(t, hasDefinitions(m, state))
+	err := checkOutOfBand(m, state, live)
+	require.Error(t, err)
+	assert.Equal(t, "refusing to overwrite 1 declaration(s) changed outside of ksd. "+
+		"Update the source to keep the changes, or pass '--overwrite' to overwrite them:\n\n"+
+		"function Edited in functions/Edited.csl was changed in the database since ksd v1.0.0 synced it on 2024-05-01T10:00:00Z.\n"+
+		"Last synced:\n    () { 1 }\n    folder: f\nIn the database:\n    () { 2 }\n    folder: f", err.Error())
+
+	live[stateKey("function", "Edited")] = state[stateKey("function", "Edited")].Definition
+	assert.NoError(t, checkOutOfBand(m, state, live))
+	assert.False(t, hasDefinitions(&manifest{Entities: m.Entities[3:]}, state))
+}
+
+func Test_liveDefinitions(t *testing.T) {
+	state := &dbState{
+		functions: map[string]dbFunction{
+			"Get": {Name: "Get", Parameters: "(a:int)", Body: "{ print a }", Folder: "functions", DocString: "doc"},
+		},
+		tables: map[string]dbTable{
+			"Log": {Name: "Log", Folder: "tables", OrderedColumns: []dbColumn{
+				{Name: "Timestamp", CslType: "datetime"},
+				{Name: "Event Name", CslType: "string"},
+			}},
+		},
+		views: map[string]dbMaterializedView{
+			"Daily": {Name: "Daily", SourceTable: "Log", Query: "Log | summarize count()", Folder: "views"},
+		},
+		externals: map[string]dbExternalTable{
+			"Archive": {Name: "Archive", OrderedColumns: []dbColumn{{Name: "a", CslType: "int"}}},
+		},
+		exports: map[string]dbContinuousExport{
+			"Export": {Name: "Export", ExternalTableName: "Archive", Query: "Log"},
+		},
+		policies: map[string]string{"Log retention": `{"SoftDeletePeriod":"30.00:00:00"}`},
+	}
+
+	assert.Equal(t, map[string]string{
+		"function/Get":             "(a:int) { print a }\nfolder: functions\ndocstring: doc",
+		"table/Log":                "(Timestamp:datetime, ['Event Name']:string)\nfolder: tables\ndocstring: ",
+		"materialized-view/Daily":  "Log\nLog | summarize count()\nfolder: views\ndocstring: ",
+		"external-table/Archive":   "(a:int)\nfolder: \ndocstring: ",
+		"continuous-export/Export": "to table Archive\nLog",
+		"policy/Log retention":     `{"SoftDeletePeriod":"30.00:00:00"}`,
+	}, liveDefinitions(state))
+}
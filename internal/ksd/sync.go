@@ -2,24 +2,55 @@ package ksd
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io/fs"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-
-	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"strings"
+	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 )
 
+// SyncOptions configures Sync.
+type SyncOptions struct {
+	// Prune configures dropping entities that are no longer declared in source.
+	Prune PruneOptions
+	// Batch executes the commands of all entities in a single '.execute database script',
+	// instead of a request per command.
+	Batch bool
+	// ContinueOnErrors continues the script of a batch after a command fails,
+	// instead of stopping at the first failed command. The entities that depend on a failed entity are skipped.
+	ContinueOnErrors bool
+	// Parallelism is the maximum number of entities synced at the same time, when not syncing in a batch.
+	// Entities are synced one at a time if it is less than 2.
+	Parallelism int
+	// Track creates StateTable if it does not exist, so that what sync deploys is recorded.
+	// Once StateTable exists, every sync records what it deployed in it, and checks for entities changed
+	// in the database since they were last synced.
+	Track bool
+	// Incremental skips entities whose commands did not change since they were last synced,
+	// as recorded in StateTable. It implies Track.
+	Incremental bool
+	// Overwrite overwrites entities that were changed in the database since they were last synced.
+	Overwrite bool
+	// Force syncs entities whose commands did not change since they were last synced, in an incremental sync,
+	// and appends the rows of tables annotated with '// @data append' again.
+	Force bool
+}
+
+// Sync executes the command scripts built under root against the database targeted by endpoint.
+//
+// Scripts are executed in the dependency order recorded in the manifest by Build,
+// either a command at a time, or in a single batch.
 func Sync(
 	root string,
 	endpoint string,
 	cred CredentialOptions,
-	httpClient *http.Client) error {
+	httpClient *http.Client,
+	opts SyncOptions) error {
 	conn, err := parseEndpoint(endpoint)
 	if err != nil {
 		return err
@@ -38,94 +69,289 @@ func Sync(
 
 	ctx := context.Background()
 	root = filepath.Clean(root)
-	files, err := kslFiles(root)
+	m, err := readManifest(root)
 	if err != nil {
 		return err
 	}
 
-	// track files that sync successfully
-	succeeded := make([]bool, len(files))
-	attempt := 1
+	// the state is only recorded once StateTable exists, which a tracked or incremental sync creates
+	state, err := fetchSyncState(ctx, client, conn.db, opts.Track || opts.Incremental)
+	if err != nil {
+		return err
+	}
 
-	const maxAttempts = 3
+	// an incremental sync only syncs the entities whose commands changed since they were last synced
+	diff, err := diffState(root, m, state, opts)
+	if err != nil {
+		return err
+	}
 
-	// Skip files that fail due to a server error.
-	// Retry on files that fail.
-	//
-	// This is a naive approach in an attempt to break ties when new function declarations
-	// have dependencies between them.
-	for {
-		var attemptErr error
-		for i, file := range files {
-			if succeeded[i] {
-				continue
-			}
+	// entities changed in the database since they were last synced are not overwritten, unless asked to
+	if !opts.Overwrite && hasDefinitions(diff.changed, state) {
+		live, err := fetchLiveDefinitions(ctx, client, conn.db)
+		if err != nil {
+			return err
+		}
+		if err := checkOutOfBand(diff.changed, state, live); err != nil {
+			return err
+		}
+	}
+
+	var result *syncResult
+	if opts.Batch {
+		result, err = syncBatch(ctx, client, conn.db, root, diff.changed, opts.ContinueOnErrors)
+	} else {
+		result, err = syncEach(ctx, client, conn.db, root, diff.changed, opts.Parallelism)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := diff.record(ctx, client, conn.db, result); err != nil {
+		return err
+	}
 
-			rel, err := filepath.Rel(root, file)
-			if err != nil {
-				return err
+	if len(result.errs) > 0 {
+		return errors.Join(result.errs...)
+	}
+
+	if opts.Prune.enabled() {
+		dropped, err := prune(ctx, client, conn.db, m, opts.Prune)
+		if diff.tracked {
+			if clearErr := clearState(ctx, client, conn.db, dropped); clearErr != nil {
+				return errors.Join(err, clearErr)
 			}
+		}
+		return err
+	}
 
-			cmdScript, err := os.ReadFile(file)
-			if err != nil {
-				return fmt.Errorf("reading file %s: %w", rel, err)
+	return nil
+}
+
+// syncEach syncs the entities in the manifest of the output directory root, a command at a time,
+// with up to parallelism entities syncing at the same time.
+// An error is returned if syncing cannot continue.
+//
+// An entity starts syncing once the entities it depends on have synced.
+// When an entity fails to sync, any entity that depends on it is skipped.
+// The outcome of each entity is printed in the order of the manifest, regardless of when it finished.
+func syncEach(
+	ctx context.Context,
+	client kustoClient,
+	db string,
+	root string,
+	m *manifest,
+	parallelism int) (*syncResult, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	s := &syncer{client: client, db: db, root: root, throttle: newThrottle()}
+
+	// the number of dependencies of each entity that have not finished, and the entities that depend on each entity.
+	// Dependencies are declared earlier in the manifest, and other names are not entities of the manifest.
+	index := map[string]int{}
+	pending := make([]int, len(m.Entities))
+	dependents := make([][]int, len(m.Entities))
+	ready := []int{}
+	for i, e := range m.Entities {
+		index[e.Name] = i
+		for _, dep := range e.DependsOn {
+			if j, has := index[dep]; has && j < i {
+				pending[i]++
+				dependents[j] = append(dependents[j], i)
 			}
-			query := kql.New("")
-			query.AddUnsafe(string(cmdScript))
-
-			_, err = client.Mgmt(
-				ctx,
-				conn.db,
-				query)
-			if err != nil {
-				attemptErr = fmt.Errorf("syncing file %s: %w", rel, err)
-				// move to next file
-				continue
+		}
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	type finished struct {
+		i       int
+		outcome syncOutcome
+	}
+	outcomes := make([]*syncOutcome, len(m.Entities))
+	done := make(chan finished)
+	failed := map[string]bool{}
+	result := &syncResult{errs: []error{}}
+	var fatal error
+	printed, running := 0, 0
+	finish := func(i int, outcome syncOutcome) {
+		outcomes[i] = &outcome
+		if outcome.fatal != nil && fatal == nil {
+			fatal = outcome.fatal
+		}
+		if outcome.err != nil {
+			failed[m.Entities[i].Name] = true
+		}
+		for _, d := range dependents[i] {
+			pending[d]--
+			if pending[d] == 0 {
+				ready = append(ready, d)
 			}
+		}
 
-			succeeded[i] = true
-			fmt.Printf("Synced %s\n", rel)
+		// print the outcomes of the entities that finished, up to the first entity that has not
+		for ; printed < len(outcomes) && outcomes[printed] != nil; printed++ {
+			if o := outcomes[printed]; o.fatal == nil {
+				if o.msg != "" {
+					fmt.Println(o.msg)
+				}
+				if o.err != nil {
+					result.errs = append(result.errs, o.err)
+				} else {
+					result.synced = append(result.synced, m.Entities[printed])
+				}
+			}
 		}
+	}
 
-		if attemptErr == nil {
-			return nil
+	for {
+		for fatal == nil && len(ready) > 0 && running < parallelism {
+			i := ready[0]
+			ready = ready[1:]
+			e := m.Entities[i]
+			if dep := failedDependency(e, failed); dep != "" {
+				rel := filepath.FromSlash(e.File)
+				finish(i, syncOutcome{
+					msg: fmt.Sprintf("Skipped %s %s in %s: depends on %s, which failed to sync", e.Kind, e.Name, rel, dep),
+					err: fmt.Errorf("skipped %s %s in file %s: depends on %s, which failed to sync", e.Kind, e.Name, rel, dep),
+				})
+				continue
+			}
+
+			running++
+			go func(i int) {
+				done <- finished{i, s.syncEntity(ctx, m.Entities[i])}
+			}(i)
 		}
 
-		if attempt >= maxAttempts {
-			return attemptErr
+		// all entities finished, or none are left to start after an error that stops syncing
+		if running == 0 {
+			break
 		}
+		f := <-done
+		running--
+		finish(f.i, f.outcome)
+	}
 
-		attempt++
+	if fatal != nil {
+		return nil, fatal
 	}
+	return result, nil
 }
 
-func kslFiles(root string) (files []string, err error) {
-	files = []string{}
-	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+// syncResult is the outcome of syncing the entities of a manifest.
+type syncResult struct {
+	// the entities that synced, in the order of the manifest
+	synced []manifestEntity
+	// the errors of the entities that failed to sync, in the order of the manifest
+	errs []error
+}
+
+// syncOutcome is the outcome of syncing an entity.
+type syncOutcome struct {
+	// the message printed for the entity
+	msg string
+	// the error of the entity, if it failed to sync
+	err error
+	// an error that stops syncing
+	fatal error
+}
+
+// syncer syncs entities, a command at a time. Its methods are safe for concurrent use.
+type syncer struct {
+	client kustoClient
+	db     string
+	// the output directory
+	root     string
+	throttle *throttle
+
+	// the continuous exports in the database, fetched when the first continuous export is synced
+	exportsOnce sync.Once
+	exports     map[string]dbContinuousExport
+	exportsErr  error
+}
+
+// continuousExports returns the continuous exports in the database.
+func (s *syncer) continuousExports(ctx context.Context) (map[string]dbContinuousExport, error) {
+	s.exportsOnce.Do(func() {
+		s.exports, s.exportsErr = fetchContinuousExports(ctx, s.client, s.db)
+	})
+	return s.exports, s.exportsErr
+}
+
+// syncEntity executes the commands of the entity e.
+func (s *syncer) syncEntity(ctx context.Context, e manifestEntity) syncOutcome {
+	rel := filepath.FromSlash(e.File)
+	cmds, err := readCommands(s.root, e)
+	if err != nil {
+		return syncOutcome{fatal: err}
+	}
+
+	drifted := false
+	if e.Kind == declType(continuousExportType).String() {
+		exports, err := s.continuousExports(ctx)
 		if err != nil {
-			return err
+			return syncOutcome{fatal: err}
 		}
+		drifted = exportDrifted(exports, e.Name, cmds[0])
+	}
 
-		if d.IsDir() {
-			return nil
+	replaced := false
+	for i, cmd := range cmds {
+		var secrets []string
+		cmd, secrets, err = prepareCommand(e, cmd, s.db)
+		if err != nil {
+			break
 		}
 
-		rel, err := filepath.Rel(root, path)
-		if err != nil {
-			panic(fmt.Sprintf("calculating rel path of '%s' from root '%s: %v", path, root, err))
+		err = s.throttle.execute(ctx, s.client, s.db, cmd)
+		// a continuous export whose query drifted from source is replaced if altering its query is rejected
+		if err != nil && i == 0 && drifted {
+			err = replaceExport(e.Name, cmd, err, func(cmd string) error {
+				return s.throttle.execute(ctx, s.client, s.db, cmd)
+			})
+			replaced = err == nil
 		}
-		ext := filepath.Ext(path)
-		if !IsKustoSourceFile(ext) {
-			log.Printf("skipping file due to non-matching extension: %s", rel)
-			return nil
+		if err != nil {
+			err = redactSecrets(err, secrets)
+			break
 		}
+	}
+	if err != nil {
+		return syncOutcome{err: fmt.Errorf("syncing %s %s in file %s: %w", e.Kind, e.Name, rel, err)}
+	}
 
-		files = append(files, path)
+	if replaced {
+		return syncOutcome{msg: fmt.Sprintf("Replaced %s %s in %s: the deployed query differed from source", e.Kind, e.Name, rel)}
+	}
+	return syncOutcome{msg: fmt.Sprintf("Synced %s %s in %s", e.Kind, e.Name, rel)}
+}
 
-		return nil
-	})
+// prepareCommand returns the command of the entity e, ready to execute against the database db.
+// The database placeholder of policies is replaced, and the secret placeholders of external tables are substituted.
+// The substituted secrets are returned, to redact them from any error.
+func prepareCommand(e manifestEntity, cmd string, db string) (string, []string, error) {
+	if e.Kind == declType(policyType).String() {
+		cmd = strings.ReplaceAll(cmd, databasePlaceholder, quoteName(db))
+	}
 
-	return files, err
+	// secrets are only substituted in memory, and are redacted from any error
+	if e.Kind == declType(externalTableType).String() {
+		return substituteSecrets(cmd, os.LookupEnv)
+	}
+	return cmd, nil, nil
+}
+
+// failedDependency returns the name of a dependency of e that failed to sync.
+func failedDependency(e manifestEntity, failed map[string]bool) string {
+	for _, dep := range e.DependsOn {
+		if failed[dep] {
+			return dep
+		}
+	}
+	return ""
 }
 
 func verifyDefaultAzureCredential(cred CredentialOptions) (credAvailable bool, err error) {
@@ -0,0 +1,205 @@
+package ksd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	kustoerrors "github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient executes management commands by calling mgmt with the text of each command.
+// Queries are not supported.
+type fakeClient struct {
+	mgmt func(command string) error
+}
+
+func (c *fakeClient) Query(
+	ctx context.Context,
+	db string,
+	query kusto.Statement,
+	options ...kusto.QueryOption) (*kusto.RowIterator, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeClient) Mgmt(
+	ctx context.Context,
+	db string,
+	query kusto.Statement,
+	options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	return nil, c.mgmt(query.String())
+}
+
+func (c *fakeClient) Close() error {
+	return nil
+}
+
+func Test_syncEach(t *testing.T) {
+	srcRoot := t.TempDir()
+	outRoot := filepath.Join(srcRoot, "kout")
+	writeSources(t, srcRoot, map[string]string{
+		"tables/Log.csl":             "let Log = datatable(a:int)[]",
+		"functions/A.csl":            "let A = () { Log }",
+		"functions/B.csl":            "let B = () { A }",
+		"functions/C.csl":            "let C = () { print 1 }",
+		"functions/Broken.csl":       "let Broken = () { print 1 }",
+		"functions/UsesBroken.csl":   "let UsesBroken = () { Broken }",
+		"functions/AlsoUsesLog.csl":  "let AlsoUsesLog = () { Log }",
+		"functions/UsesAllBut.csl":   "let UsesAllBut = () { B; C; AlsoUsesLog }",
+		"functions/UsesUsesBrok.csl": "let UsesUsesBrok = () { UsesBroken }",
+	})
+	diags, err := Build(srcRoot, outRoot, BuildOptions{})
+	require.NoError(t, err)
+	require.Empty(t, diags)
+	m, err := readManifest(outRoot)
+	require.NoError(t, err)
+
+	// the entity of each command
+	entities := map[string]manifestEntity{}
+	for _, e := range m.Entities {
+		cmds, err := readCommands(outRoot, e)
+		require.NoError(t, err)
+		for _, cmd := range cmds {
+			entities[cmd] = e
+		}
+	}
+
+	for _, parallelism := range []int{0, 1, 4} {
+		var mu sync.Mutex
+		synced := map[string]bool{}
+		running, maxRunning := 0, 0
+		client := &fakeClient{mgmt: func(command string) error {
+			e := entities[command]
+			mu.Lock()
+			for _, dep := range e.DependsOn {
+				assert.True(t, synced[dep], "%s synced before its dependency %s", e.Name, dep)
+			}
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			running--
+			if e.Name == "Broken" {
+				return errors.New("broken")
+			}
+			synced[e.Name] = true
+			return nil
+		}}
+
+		result, err := syncEach(context.Background(), client, "db", outRoot, m, parallelism)
+		require.NoError(t, err)
+
+		// the outcomes are in the order of the manifest
+		msgs := []string{}
+		for _, err := range result.errs {
+			msgs = append(msgs, filepath.ToSlash(err.Error()))
+		}
+		assert.Equal(t, []string{
+			"syncing function Broken in file functions/Broken.csl: broken",
+			"skipped function UsesBroken in file functions/UsesBroken.csl: depends on Broken, which failed to sync",
+			"skipped function UsesUsesBrok in file functions/UsesUsesBrok.csl: " +
+				"depends on UsesBroken, which failed to sync",
+		}, msgs)
+		assert.Len(t, synced, len(m.Entities)-3)
+		names := []string{}
+		for _, e := range result.synced {
+			names = append(names, e.Name)
+		}
+		assert.Equal(t, []string{"C", "Log", "A", "AlsoUsesLog", "B", "UsesAllBut"}, names)
+		if parallelism < 2 {
+			assert.Equal(t, 1, maxRunning)
+		} else {
+			assert.LessOrEqual(t, maxRunning, parallelism)
+		}
+	}
+}
+
+func Test_syncEach_Fatal(t *testing.T) {
+	outRoot := t.TempDir()
+	m := &manifest{Entities: []manifestEntity{{Name: "A", Kind: "function", File: "functions/A.csl"}}}
+	client := &fakeClient{mgmt: func(command string) error { return nil }}
+
+	_, err := syncEach(context.Background(), client, "db", outRoot, m, 2)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "reading file functions/A.csl")
+}
+
+func Test_throttle_execute(t *testing.T) {
+	throttled := httpError(429, "429 Too Many Requests", "")
+	throttledBody := httpError(400, "400 Bad Request", `{"error":{"code":"ThrottledError"}}`)
+	notThrottled := httpError(400, "400 Bad Request",
+		`{"error":{"code":"General_BadRequest","message":"Function 'ThrottleStats': Request is invalid"}}`)
+	tests := []struct {
+		name  string
+		errs  []error
+		err   string
+		calls int
+	}{
+		{"success", []error{nil}, "", 1},
+		{"throttled", []error{throttled, throttledBody, nil}, "", 3},
+		{"error", []error{errors.New("syntax error")}, "syntax error", 1},
+		{"errorMentionsThrottle", []error{notThrottled}, "ThrottleStats", 1},
+		{"retriesExhausted", []error{throttled, throttled, throttled}, "429", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			client := &fakeClient{mgmt: func(command string) error {
+				assert.Equal(t, ".show version", command)
+				calls++
+				return tt.errs[calls-1]
+			}}
+
+			th := &throttle{delay: time.Millisecond, retries: 2}
+			start := time.Now()
+			err := th.execute(context.Background(), client, "db", ".show version")
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+			}
+			assert.Equal(t, tt.calls, calls)
+			// each retry waits for twice the delay of the previous one
+			assert.GreaterOrEqual(t, time.Since(start), time.Duration(1<<(tt.calls-1)-1)*time.Millisecond)
+		})
+	}
+}
+
+func Test_throttle_wait(t *testing.T) {
+	th := newThrottle()
+	th.backOff(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, th.wait(ctx), context.Canceled)
+}
+
+// httpError returns the error of a management command that failed with the HTTP status and response body.
+func httpError(code int, status string, body string) error {
+	return kustoerrors.HTTP(kustoerrors.OpMgmt, status, code, io.NopCloser(strings.NewReader(body)), "")
+}
+
+func Test_isThrottled(t *testing.T) {
+	assert.True(t, isThrottled(httpError(429, "429 Too Many Requests", "")))
+	assert.True(t, isThrottled(httpError(400, "400 Bad Request", `{"error":{"code":"ThrottledError"}}`)))
+	assert.False(t, isThrottled(httpError(400, "400 Bad Request", "")))
+	assert.False(t, isThrottled(httpError(400, "400 Bad Request",
+		`{"error":{"code":"SemanticError","message":"Failed to resolve 'ThrottleStats'"}}`)))
+	assert.False(t, isThrottled(errors.New("Function 'ThrottleStats' failed: throttled")))
+	assert.False(t, isThrottled(errors.New("syntax error")))
+}
@@ -0,0 +1,104 @@
+package ksd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	kustoerrors "github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+)
+
+// the defaults of throttle
+const (
+	throttleDelay   = time.Second
+	throttleRetries = 5
+)
+
+// throttle executes commands, and backs off when the service throttles them.
+// It is shared by the commands executed at the same time, so that all of them back off together.
+type throttle struct {
+	// the delay before the first retry, doubled on each retry
+	delay time.Duration
+	// the maximum number of retries of a command
+	retries int
+
+	mu sync.Mutex
+	// no command is executed before resume
+	resume time.Time
+}
+
+func newThrottle() *throttle {
+	return &throttle{delay: throttleDelay, retries: throttleRetries}
+}
+
+// execute executes the management command, retrying it with exponential backoff while it is throttled.
+func (t *throttle) execute(ctx context.Context, client kustoClient, db string, command string) error {
+	query := kql.New("")
+	query.AddUnsafe(command)
+	for attempt := 0; ; attempt++ {
+		if err := t.wait(ctx); err != nil {
+			return err
+		}
+
+		_, err := client.Mgmt(ctx, db, query)
+		if err == nil || !isThrottled(err) || attempt == t.retries {
+			return err
+		}
+
+		delay := t.delay << attempt
+		t.backOff(delay)
+		log.Printf("sync: throttled by the service, retrying in %v", delay)
+	}
+}
+
+// wait waits until commands can be executed, or until ctx is done.
+func (t *throttle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	d := time.Until(t.resume)
+	t.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		// another command may have been throttled while waiting
+		return t.wait(ctx)
+	}
+}
+
+// backOff holds off executing commands for the delay, unless they are already held off for longer.
+func (t *throttle) backOff(delay time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if resume := time.Now().Add(delay); resume.After(t.resume) {
+		t.resume = resume
+	}
+}
+
+// isThrottled returns true if err reports that the service throttled the request,
+// either with the status 429 Too Many Requests, or with a ThrottledError in the body of the response.
+//
+// The message of the error is never inspected, since it may contain the names of entities.
+func isThrottled(err error) bool {
+	var httpErr *kustoerrors.HttpError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	if httpErr.IsThrottled() {
+		return true
+	}
+
+	body, ok := httpErr.UnmarshalREST()["error"].(map[string]any)
+	return ok && body["code"] == throttledErrorCode
+}
+
+// throttledErrorCode is the code of the error in the body of a response to a throttled request.
+const throttledErrorCode = "ThrottledError"
@@ -0,0 +1,340 @@
+package ksd
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenKind is the lexical class of a token.
+type tokenKind uint8
+
+const (
+	// the end of input. The token has no text.
+	tokenEOF tokenKind = iota
+	// spaces, tabs and other whitespace within a line
+	tokenSpace
+	// a line break, i.e. "\n" or "\r\n"
+	tokenNewline
+	// a '//' comment, up to the end of the line
+	tokenComment
+	// a plain identifier or keyword, i.e. Requests or where
+	tokenIdentifier
+	// a number, including any unit suffix, i.e. 42, 1.5e3, 0x1F or 10m
+	tokenNumber
+	// a string literal of any form, i.e. 'a', "a", @'a', h'a' or ```a```
+	tokenString
+	// an operator or punctuation, i.e. '(', '|', '==' or '..'
+	tokenPunct
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of file"
+	case tokenSpace:
+		return "whitespace"
+	case tokenNewline:
+		return "line break"
+	case tokenComment:
+		return "comment"
+	case tokenIdentifier:
+		return "identifier"
+	case tokenNumber:
+		return "number"
+	case tokenString:
+		return "string"
+	case tokenPunct:
+		return "punctuation"
+	default:
+		return "unknown"
+	}
+}
+
+// token is a lexical token of KQL source.
+type token struct {
+	kind tokenKind
+	text string
+
+	// byte offset of the token in the source
+	pos int
+	// position of the first character of the token, starting at 1
+	row int
+	col int
+}
+
+// end returns the byte offset one-past the end of the token.
+func (t token) end() int {
+	return t.pos + len(t.text)
+}
+
+// trivia returns true if the token has no meaning to the parser, other than separating tokens.
+func (t token) trivia() bool {
+	return t.kind == tokenSpace || t.kind == tokenNewline || t.kind == tokenComment
+}
+
+// is returns true if the token is the punctuation p.
+func (t token) is(p string) bool {
+	return t.kind == tokenPunct && t.text == p
+}
+
+// operators are the punctuation tokens longer than a single character.
+var operators = []string{"<|", "..", "==", "!=", "<>", "<=", ">=", "=~", "!~", "=>", "->"}
+
+// tokenize splits src into tokens, ending with a tokenEOF token. Every character of src
+// belongs to exactly one token, and so the text of the tokens joined is src.
+//
+// row and col are the position of the first character of src.
+// The tokens up to the error are returned if src contains an unterminated string literal.
+func tokenize(src string, row int, col int) ([]token, error) {
+	l := &lexer{src: src, row: row, col: col}
+	tokens := []token{}
+	for l.pos < len(src) {
+		t, err := l.next()
+		if err != nil {
+			return append(tokens, l.eof()), err
+		}
+		tokens = append(tokens, t)
+	}
+	return append(tokens, l.eof()), nil
+}
+
+// lexer reads tokens from src while tracking the row and column.
+type lexer struct {
+	src string
+	pos int
+	row int
+	col int
+}
+
+func (l *lexer) eof() token {
+	return token{kind: tokenEOF, pos: len(l.src), row: l.row, col: l.col}
+}
+
+// next reads the token at the cursor.
+func (l *lexer) next() (token, error) {
+	start := token{pos: l.pos, row: l.row, col: l.col}
+	rest := l.src[l.pos:]
+	r, size := utf8.DecodeRuneInString(rest)
+
+	var end int
+	switch {
+	case r == '\n':
+		start.kind, end = tokenNewline, 1
+	case r == '\r' && strings.HasPrefix(rest, "\r\n"):
+		start.kind, end = tokenNewline, 2
+	case unicode.IsSpace(r):
+		start.kind = tokenSpace
+		end = strings.IndexFunc(rest, func(r rune) bool { return r == '\n' || !unicode.IsSpace(r) })
+		// a '\r' that starts a line break is not part of the whitespace
+		if crlf := strings.Index(rest, "\r\n"); crlf != -1 && (end == -1 || crlf < end) {
+			end = crlf
+		}
+		if end == -1 {
+			end = len(rest)
+		}
+	case strings.HasPrefix(rest, "//"):
+		start.kind = tokenComment
+		end = strings.IndexByte(rest, '\n')
+		if end == -1 {
+			end = len(rest)
+		} else if end > 0 && rest[end-1] == '\r' {
+			end--
+		}
+	case isStringStart(rest):
+		start.kind = tokenString
+		var err error
+		end, err = l.stringEnd(rest)
+		if err != nil {
+			return token{}, err
+		}
+	case isIdentifierStart(r) || r == '$':
+		start.kind = tokenIdentifier
+		end = size + identifierEnd(rest[size:])
+	case r >= '0' && r <= '9' || r == '.' && len(rest) > 1 && rest[1] >= '0' && rest[1] <= '9':
+		start.kind = tokenNumber
+		end = numberEnd(rest)
+	default:
+		start.kind, end = tokenPunct, size
+		for _, op := range operators {
+			if strings.HasPrefix(rest, op) {
+				end = len(op)
+				break
+			}
+		}
+	}
+
+	start.text = rest[:end]
+	l.advance(start.text)
+	return start, nil
+}
+
+// advance moves the cursor past text.
+func (l *lexer) advance(text string) {
+	for _, r := range text {
+		if r == '\n' {
+			l.row++
+			l.col = 1
+		} else {
+			l.col++
+		}
+	}
+	l.pos += len(text)
+}
+
+// isStringStart returns true if a string literal starts at the beginning of s.
+func isStringStart(s string) bool {
+	if s[0] == 'h' || s[0] == 'H' {
+		s = s[1:]
+	}
+	if strings.HasPrefix(s, "@") {
+		s = s[1:]
+	}
+	return strings.HasPrefix(s, "'") || strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "```")
+}
+
+// stringEnd returns the length of the string literal at the beginning of s, including any prefix.
+func (l *lexer) stringEnd(s string) (int, error) {
+	prefix := 0
+	if s[0] == 'h' || s[0] == 'H' {
+		prefix++
+	}
+	verbatim := strings.HasPrefix(s[prefix:], "@")
+	if verbatim {
+		prefix++
+	}
+
+	body := s[prefix:]
+	switch {
+	case strings.HasPrefix(body, "```"):
+		end := strings.Index(body[3:], "```")
+		if end == -1 {
+			return 0, l.errorf("unterminated multi-line string literal")
+		}
+		return prefix + 3 + end + 3, nil
+	case verbatim:
+		// a doubled quote is an escaped quote
+		quote := body[0]
+		for i := 1; i < len(body); i++ {
+			if body[i] == quote {
+				if i+1 < len(body) && body[i+1] == quote {
+					i++
+					continue
+				}
+				return prefix + i + 1, nil
+			}
+		}
+		return 0, l.errorf("unterminated string literal")
+	default:
+		quote := body[0]
+		for i := 1; i < len(body); i++ {
+			switch body[i] {
+			case '\\':
+				i++
+			case quote:
+				return prefix + i + 1, nil
+			case '\n':
+				return 0, l.errorf("unterminated string literal")
+			}
+		}
+		return 0, l.errorf("unterminated string literal")
+	}
+}
+
+func (l *lexer) errorf(m string, args ...any) error {
+	return newParseError(l.row, l.col, m, args...)
+}
+
+// identifierEnd returns the length of the identifier characters at the beginning of s.
+func identifierEnd(s string) int {
+	end := strings.IndexFunc(s, func(r rune) bool { return !isIdentifierPart(r) })
+	if end == -1 {
+		return len(s)
+	}
+	return end
+}
+
+// numberEnd returns the length of the number at the beginning of s.
+// Numbers include a fraction, an exponent and any unit suffix, i.e. 1.5e-3 or 10ms.
+func numberEnd(s string) int {
+	i := 0
+	digits := func() {
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+	}
+
+	digits()
+	// a '.' followed by another '.' is a range, i.e. 1..10
+	if i < len(s) && s[i] == '.' && !strings.HasPrefix(s[i:], "..") {
+		i++
+		digits()
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			i = j
+			digits()
+		}
+	}
+	// hexadecimal digits and units, i.e. 0x1F or 10ms
+	return i + identifierEnd(s[i:])
+}
+
+// skipString returns the index one-past the end of the string literal starting at text[start].
+func skipString(text string, start int) int {
+	quote := text[start]
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		case '\n':
+			// unterminated, strings cannot span lines
+			return i
+		}
+	}
+	return len(text)
+}
+
+// unquoteString returns the value of the string literal s, i.e. 'it\'s' or @'c:\path'.
+func unquoteString(s string) string {
+	if s != "" && (s[0] == 'h' || s[0] == 'H') {
+		s = s[1:]
+	}
+	if strings.HasPrefix(s, "```") && strings.HasSuffix(s, "```") && len(s) >= 6 {
+		return s[3 : len(s)-3]
+	}
+	if strings.HasPrefix(s, "@") && len(s) >= 3 {
+		quote := s[1:2]
+		return strings.ReplaceAll(s[2:len(s)-1], quote+quote, quote)
+	}
+	if len(s) < 2 {
+		return s
+	}
+
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,171 @@
+package ksd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_tokenize(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"identifiers", "T | where x", []string{"T", " ", "|", " ", "where", " ", "x"}},
+		{"operators", "a==b<|c..d!=e", []string{"a", "==", "b", "<|", "c", "..", "d", "!=", "e"}},
+		{"numbers", "1 1.5 1e-3 0x1F 10ms .5", []string{"1", " ", "1.5", " ", "1e-3", " ", "0x1F", " ", "10ms", " ", ".5"}},
+		{"range", "1..10", []string{"1", "..", "10"}},
+		{"string", `'it\'s' "a\"b"`, []string{`'it\'s'`, " ", `"a\"b"`}},
+		{"verbatim", `@'c:\path' @"say ""hi"""`, []string{`@'c:\path'`, " ", `@"say ""hi"""`}},
+		{"multiline", "```a\n'b\n```", []string{"```a\n'b\n```"}},
+		{"obfuscated", `h'secret' H@"c:\key" h` + "```x```", []string{`h'secret'`, " ", `H@"c:\key"`, " ", "h```x```"}},
+		{"comment", "a // it's\nb", []string{"a", " ", "// it's", "\n", "b"}},
+		{"crlf", "a // c\r\nb\r\n", []string{"a", " ", "// c", "\r\n", "b", "\r\n"}},
+		{"loneCarriageReturn", "a\rb", []string{"a", "\r", "b"}},
+		{"joinSides", "$left.x", []string{"$left", ".", "x"}},
+		{"nonASCII", "Café", []string{"Café"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toks, err := tokenize(tt.input, 1, 1)
+			require.NoError(t, err)
+
+			texts := []string{}
+			for _, tok := range toks {
+				if tok.kind != tokenEOF {
+					texts = append(texts, tok.text)
+				}
+			}
+			assert.Equal(t, tt.expected, texts)
+		})
+	}
+}
+
+func Test_tokenize_kinds(t *testing.T) {
+	toks, err := tokenize("let x = h'a' // c\r\n1", 1, 1)
+	require.NoError(t, err)
+
+	kinds := []tokenKind{}
+	for _, tok := range toks {
+		kinds = append(kinds, tok.kind)
+	}
+	assert.Equal(t, []tokenKind{
+		tokenIdentifier, tokenSpace, tokenIdentifier, tokenSpace, tokenPunct, tokenSpace, tokenString,
+		tokenSpace, tokenComment, tokenNewline, tokenNumber, tokenEOF,
+	}, kinds)
+}
+
+func Test_tokenize_positions(t *testing.T) {
+	toks, err := tokenize("a\r\n  'é' b\n```x\ny``` c", 3, 5)
+	require.NoError(t, err)
+
+	type position struct {
+		text string
+		row  int
+		col  int
+	}
+	positions := []position{}
+	for _, tok := range toks {
+		if !tok.trivia() {
+			positions = append(positions, position{tok.text, tok.row, tok.col})
+		}
+	}
+	assert.Equal(t, []position{
+		{"a", 3, 5},
+		{"'é'", 4, 3},
+		{"b", 4, 7},
+		{"```x\ny```", 5, 1},
+		{"c", 6, 6},
+		{"", 6, 7},
+	}, positions)
+}
+
+func Test_tokenize_errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		row   int
+		col   int
+	}{
+		{"string", "a 'b", 1, 3},
+		{"stringNewline", "a\n  \"b\nc\"", 2, 3},
+		{"escapedQuote", `'a\'`, 1, 1},
+		{"verbatim", "@'a''", 1, 1},
+		{"multiline", "x ```a\nb", 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tokenize(tt.input, 1, 1)
+			require.Error(t, err)
+
+			var parseErr *ParseError
+			require.ErrorAs(t, err, &parseErr)
+			assert.Equal(t, tt.row, parseErr.row)
+			assert.Equal(t, tt.col, parseErr.col)
+		})
+	}
+}
+
+func Test_unquoteString(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`'a'`, "a"},
+		{`'it\'s'`, "it's"},
+		{`"a\\b\n"`, "a\\b\n"},
+		{`@'c:\path'`, `c:\path`},
+		{`@"say ""hi"""`, `say "hi"`},
+		{`h'secret'`, "secret"},
+		{"```a\nb```", "a\nb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, tt.expected, unquoteString(tt.input))
+		})
+	}
+}
+
+func FuzzTokenize(f *testing.F) {
+	f.Add("let x = (a:string = 'it\\'s') { T | where a == @\"c:\\\" }")
+	f.Add("// c\r\nlet y = datatable(a:int // doc\r\n)[1, 2]")
+	f.Add("h'secret' ```a\nb``` 1..10 1.5e-3 $left")
+	f.Fuzz(func(t *testing.T, src string) {
+		toks, err := tokenize(src, 1, 1)
+		if err != nil {
+			var parseErr *ParseError
+			require.ErrorAs(t, err, &parseErr)
+		}
+
+		// tokens cover the input up to any error, without gaps or overlaps
+		var b strings.Builder
+		row, col := 1, 1
+		for i, tok := range toks {
+			if tok.kind == tokenEOF {
+				require.Equal(t, len(toks)-1, i, "EOF must be the last token")
+				break
+			}
+			require.NotEmpty(t, tok.text)
+			require.Equal(t, b.Len(), tok.pos)
+			require.Equal(t, row, tok.row)
+			require.Equal(t, col, tok.col)
+
+			b.WriteString(tok.text)
+			for _, r := range tok.text {
+				if r == '\n' {
+					row, col = row+1, 1
+				} else {
+					col++
+				}
+			}
+		}
+		if err == nil {
+			require.Equal(t, src, b.String())
+		} else {
+			require.True(t, strings.HasPrefix(src, b.String()))
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package ksd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scalarTypes maps each Kusto scalar data type, and its aliases,
+// to the canonical type name reported by the service.
+var scalarTypes = map[string]string{
+	"bool":     "bool",
+	"boolean":  "bool",
+	"datetime": "datetime",
+	"date":     "datetime",
+	"decimal":  "decimal",
+	"dynamic":  "dynamic",
+	"guid":     "guid",
+	"uniqueid": "guid",
+	"int":      "int",
+	"long":     "long",
+	"real":     "real",
+	"double":   "real",
+	"string":   "string",
+	"timespan": "timespan",
+	"time":     "timespan",
+}
+
+// canonicalType returns the canonical name of the scalar type t,
+// and whether t is a known scalar type.
+func canonicalType(t string) (string, bool) {
+	canonical, ok := scalarTypes[strings.TrimSpace(t)]
+	return canonical, ok
+}
+
+// suggestType returns a suggestion for the unknown type t.
+func suggestType(t string) string {
+	best := ""
+	bestDistance := 3
+	for _, name := range sortedKeys(scalarTypes) {
+		if d := editDistance(strings.ToLower(t), name); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+
+	if best != "" {
+		return fmt.Sprintf("Did you mean '%s'?", best)
+	}
+	return fmt.Sprintf("Expected one of: %s", strings.Join(sortedKeys(scalarTypes), ", "))
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
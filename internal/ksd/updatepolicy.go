@@ -0,0 +1,89 @@
+package ksd
+
+import "encoding/json"
+
+// updatePolicy is an update policy on a table, declared with
+// '// @updatePolicy Source=RawTable Function=Transform IsTransactional=true PropagateIngestionProperties=false'.
+type updatePolicy struct {
+	// the table whose ingested data triggers the policy
+	source string
+	// the function that transforms the ingested data
+	function string
+
+	transactional        bool
+	propagateIngestProps bool
+
+	// position of the annotation
+	row int
+	col int
+}
+
+// applyUpdatePolicyAnnotation applies '// @updatePolicy'. A table may have multiple update policies.
+func applyUpdatePolicyAnnotation(decl *declaration, a annotation) error {
+	props, err := properties(
+		a,
+		[]string{"Source", "Function", "IsTransactional", "PropagateIngestionProperties"},
+		[]string{"Source", "Function"})
+	if err != nil {
+		return err
+	}
+
+	p := updatePolicy{row: a.row, col: a.col}
+	names := []struct {
+		key    string
+		target *string
+	}{
+		{"Source", &p.source},
+		{"Function", &p.function},
+	}
+	for _, n := range names {
+		s, err := newScanner(props[n.key], a.row, a.col)
+		var name string
+		if err == nil {
+			name, err = s.identifier()
+		}
+		if err != nil || !s.eof() {
+			return newParseError(
+				a.row, a.col, "invalid value '%s' for property '%s'. Expected a name", props[n.key], n.key)
+		}
+		*n.target = name
+	}
+
+	if p.transactional, err = boolProperty(a, props, "IsTransactional"); err != nil {
+		return err
+	}
+	if p.propagateIngestProps, err = boolProperty(a, props, "PropagateIngestionProperties"); err != nil {
+		return err
+	}
+
+	decl.updatePolicies = append(decl.updatePolicies, p)
+	return nil
+}
+
+// updatePolicyJSON returns the update policies as the JSON expected by '.alter table policy update'.
+func updatePolicyJSON(policies []updatePolicy) (string, error) {
+	type policyJSON struct {
+		IsEnabled                    bool
+		Source                       string
+		Query                        string
+		IsTransactional              bool
+		PropagateIngestionProperties bool
+	}
+
+	values := make([]policyJSON, 0, len(policies))
+	for _, p := range policies {
+		values = append(values, policyJSON{
+			IsEnabled:                    true,
+			Source:                       p.source,
+			Query:                        quoteName(p.function) + "()",
+			IsTransactional:              p.transactional,
+			PropagateIngestionProperties: p.propagateIngestProps,
+		})
+	}
+
+	content, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
@@ -0,0 +1,17 @@
+package ksd
+
+import "runtime/debug"
+
+// Version is the version of ksd, set at build time by the release, i.e.
+//
+//	-ldflags "-X github.com/weikanglim/ksd/internal/ksd.Version=1.2.0"
+//
+// Otherwise, it is the version of the module when installed with 'go install', or "dev".
+var Version = moduleVersion()
+
+func moduleVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
@@ -4,6 +4,7 @@ Copyright © 2023 Wei Lim
 package main
 
 import (
+	"errors"
 	"os"
 
 	"github.com/weikanglim/ksd/cmd"
@@ -13,6 +14,10 @@ func main() {
 	rootCmd := cmd.NewRootCmd()
 	err := rootCmd.Execute()
 	if err != nil {
+		var exitErr *cmd.ExitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		os.Exit(1)
 	}
 }
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"encoding/json"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -109,3 +110,75 @@ func TestBuild(t *testing.T) {
 		})
 	}
 }
+
+func TestBuild_SARIF(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"A.csl":       "let A = () { B }",
+		"B.csl":       "let B = () { A }",
+		"Dup.csl":     "let Dup = () { print 1 }",
+		"dup/Dup.csl": "let Dup = () { print 2 }",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	}
+
+	res := executeCmd([]string{"build", root, "--format", "sarif"})
+	require.EqualError(t, res.Err, "build failed with 2 error(s)")
+
+	var log struct {
+		Runs []struct {
+			Results []struct {
+				RuleID    string `json:"ruleId"`
+				Level     string `json:"level"`
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct {
+							URI string `json:"uri"`
+						} `json:"artifactLocation"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(res.StdOut), &log))
+	require.Len(t, log.Runs, 1)
+
+	uris := []string{}
+	for _, r := range log.Runs[0].Results {
+		require.Equal(t, ksd.RuleBuild, r.RuleID)
+		require.Equal(t, "error", r.Level)
+		uris = append(uris, r.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	}
+	require.Equal(t, []string{"dup/Dup.csl", "A.csl"}, uris)
+}
+
+func TestBuild_ConfigOutDir(t *testing.T) {
+	project := t.TempDir()
+	files := map[string]string{
+		".git/HEAD":           "ref: refs/heads/main",
+		ksd.ConfigFile:        "root: src\nout: dist\n",
+		"src/functions/A.csl": "let A = () { print 1 }",
+		"dist/keep.txt":       "not built by ksd",
+	}
+	for name, content := range files {
+		path := filepath.Join(project, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	}
+	Chdir(t, project)
+
+	// a directory that ksd did not build is never cleaned
+	res := executeCmd([]string{"build"})
+	require.Error(t, res.Err)
+	require.Contains(t, res.Err.Error(), "is not empty, and has no manifest.json")
+	require.FileExists(t, filepath.Join(project, "dist", "keep.txt"))
+
+	require.NoError(t, os.Remove(filepath.Join(project, "dist", "keep.txt")))
+	res = executeCmd([]string{"build"})
+	require.NoError(t, res.Err)
+	require.FileExists(t, filepath.Join(project, "dist", ksd.ManifestFile))
+	require.FileExists(t, filepath.Join(project, "dist", "functions", "A.csl"))
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan_Errors(t *testing.T) {
+	anyEndpoint := "https://examples.kusto.windows.net/mydb"
+
+	tests := []struct {
+		name   string
+		args   []string
+		errMsg string
+	}{
+		{
+			"MissingDatabase",
+			[]string{"plan", "testdata/src", "--endpoint", "https://examples.kusto.windows.net"},
+			"endpoint must target a database",
+		},
+		{
+			"MissingEndpoint",
+			[]string{"plan"},
+			"missing `--endpoint`",
+		},
+		{
+			"DirectoryNotExist",
+			[]string{"plan", "dirNotExist", "--endpoint", anyEndpoint},
+			"directory dirNotExist does not exist",
+		},
+		{
+			"InvalidOutput",
+			[]string{"plan", "--output", "yaml", "--endpoint", anyEndpoint},
+			"invalid value for `--output`",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := executeCmd(tt.args)
+			require.Error(t, res.Err)
+			require.Contains(t, res.StdErr, tt.errMsg)
+		})
+	}
+}
+
+// Live tests for plan
+func TestPlan_Live(t *testing.T) {
+	cfg, err := getLiveConfig()
+	if err != nil {
+		t.Skip(err.Error())
+	}
+
+	planArgs := []string{"plan"}
+	planArgs = append(planArgs, argsFromConfig(cfg, true)...)
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{
+			"Text",
+			append(planArgs, "testdata/src"),
+		},
+		{
+			"Json",
+			append(planArgs, "testdata/src", "--output", "json"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := executeCmd(tt.args)
+			if res.Err != nil {
+				require.ErrorContains(t, res.Err, "changes pending")
+			}
+			require.Contains(t, res.StdOut, "HourlyMetric")
+		})
+	}
+}
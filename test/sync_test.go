@@ -32,6 +32,16 @@ func TestSync_Errors(t *testing.T) {
 			[]string{"sync", "dirNotExist"},
 			"directory dirNotExist does not exist",
 		},
+		{
+			"PruneFolder_MissingPrune",
+			[]string{"sync", "--prune-folder", "functions", "--endpoint", anyEndpoint},
+			"`--prune` or `--prune-tables` must be set when `--prune-folder` is provided",
+		},
+		{
+			"PruneName_MissingPrune",
+			[]string{"sync", "--prune-name", "Legacy*", "--endpoint", anyEndpoint},
+			"`--prune` or `--prune-tables` must be set when `--prune-name` is provided",
+		},
 		{
 			"ClientAuth_MissingSecretAndTenant",
 			[]string{"sync", "--client-id", "some-id", "--endpoint", anyEndpoint},